@@ -0,0 +1,59 @@
+package fsm
+
+// AllocateSpaces allocates space with each of the given sizes on the
+// file and returns them, in a way cheaper than calling AllocateSpace for
+// each, and space allocated together is consecutive in general. The space
+// is accessed with AccessSpace.
+// Like the other allocation APIs, it panics when an error occurs, and
+// TryAllocateSpaces returns the error instead.
+func (fs *FileStorage) AllocateSpaces(spaceSizes []int) []int64 {
+	spaces, err := fs.TryAllocateSpaces(spaceSizes)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return spaces
+}
+
+// TryAllocateSpaces is like AllocateSpaces but returns an error, e.g.
+// ErrBlockTooLarge or an I/O error, instead of panicking.
+// The file storage stays unchanged when an error occurs.
+func (fs *FileStorage) TryAllocateSpaces(spaceSizes []int) ([]int64, error) {
+	if fs.options.ReadOnly {
+		return nil, ErrReadOnly
+	}
+
+	spaces, err := fs.pool.AllocateSpaces(spaceSizes)
+
+	if err != nil {
+		return nil, convertError(err)
+	}
+
+	fs.completeChange()
+	return spaces, nil
+}
+
+// FreeSpaces releases the given spaces back to the file.
+// It panics when an error occurs, see TryFreeSpaces.
+func (fs *FileStorage) FreeSpaces(spaces []int64) {
+	if err := fs.TryFreeSpaces(spaces); err != nil {
+		panic(err)
+	}
+}
+
+// TryFreeSpaces is like FreeSpaces but returns an error, e.g.
+// ErrInvalidSpace or an I/O error, instead of panicking. No space
+// is released if any of the spaces is invalid or duplicate.
+func (fs *FileStorage) TryFreeSpaces(spaces []int64) error {
+	if fs.options.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if err := fs.pool.FreeSpaces(spaces); err != nil {
+		return convertError(err)
+	}
+
+	fs.completeChange()
+	return nil
+}
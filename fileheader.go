@@ -3,17 +3,49 @@ package fsm
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
 	"unsafe"
 
+	"github.com/roy2220/fsm/internal/buddy"
 	"github.com/roy2220/fsm/internal/list"
+	"github.com/roy2220/fsm/internal/pool"
 )
 
 const (
-	fileHeaderSize = (int(unsafe.Sizeof(fileHeader{})) + (pageSize - 1)) &^ (pageSize - 1)
-	fileSignature  = "!MSF."
+	fileHeaderSize     = (numberOfFileHeaderSlots*fileHeaderSlotSize + (pageSize - 1)) &^ (pageSize - 1)
+	fileHeaderSlotSize = (len(fileSignature) + int(unsafe.Sizeof(fileHeader{})) + 4 + (sectorSize - 1)) &^ (sectorSize - 1)
+	fileSignature      = "!MSF."
 )
 
+const (
+	numberOfFileHeaderSlots = 2
+	sectorSize              = 512
+)
+
+const (
+	// fileHeaderDirty indicates the file storage is open or was not
+	// closed cleanly.
+	fileHeaderDirty = 1 << iota
+
+	// fileHeaderJournaled indicates the file storage is open with the
+	// write-ahead log, so that the file is consistent as of the last
+	// commit even if it was not closed cleanly.
+	fileHeaderJournaled
+
+	// fileHeaderLegacy indicates the file header is loaded from a legacy
+	// file header, which has no checksums, and is never stored.
+	fileHeaderLegacy
+)
+
+// legacyFileHeaderSize is the size of the fields of legacy file headers,
+// i.e. the single file header of files created before file header slots,
+// which takes the same fileHeaderSize bytes with the rest zeroed.
+const legacyFileHeaderSize = len(fileSignature) + 5*8 + list.Size64 + 2*8
+
 type fileHeader struct {
+	SequenceNumber            int64
 	SpaceSize                 int64
 	UsedSpaceSize             int64
 	MappedSpaceSize           int64
@@ -22,11 +54,22 @@ type fileHeader struct {
 	PooledBlockList           [list.Size64]byte
 	DismissedSpaceSize        int64
 	PrimarySpace              int64
+	Flags                     int64
+
+	BlockAllocationBitmapChecksum uint32
+	PageChecksumsSize             int64
+	PageChecksumsChecksum         uint32
+	RootDirectory                 int64
+	NumberOfPoolShards            int64
+	MorePooledBlockLists          [pool.MaxNumberOfShards - 1][list.Size64]byte
+	BlockAllocationBitmapOffset   int64
 }
 
 func (fh *fileHeader) Serialize(buffer []byte) {
-	_ = buffer[fileHeaderSize-1]
+	_ = buffer[fileHeaderSlotSize-1]
 	i := copy(buffer, fileSignature)
+	binary.BigEndian.PutUint64(buffer[i:], uint64(fh.SequenceNumber))
+	i += 8
 	binary.BigEndian.PutUint64(buffer[i:], uint64(fh.SpaceSize))
 	i += 8
 	binary.BigEndian.PutUint64(buffer[i:], uint64(fh.UsedSpaceSize))
@@ -42,21 +85,48 @@ func (fh *fileHeader) Serialize(buffer []byte) {
 	i += 8
 	binary.BigEndian.PutUint64(buffer[i:], ^uint64(fh.PrimarySpace))
 	i += 8
+	binary.BigEndian.PutUint64(buffer[i:], uint64(fh.Flags))
+	i += 8
+	binary.BigEndian.PutUint32(buffer[i:], fh.BlockAllocationBitmapChecksum)
+	i += 4
+	binary.BigEndian.PutUint64(buffer[i:], uint64(fh.PageChecksumsSize))
+	i += 8
+	binary.BigEndian.PutUint32(buffer[i:], fh.PageChecksumsChecksum)
+	i += 4
+	binary.BigEndian.PutUint64(buffer[i:], ^uint64(fh.RootDirectory))
+	i += 8
+	binary.BigEndian.PutUint64(buffer[i:], uint64(fh.NumberOfPoolShards))
+	i += 8
 
-	for ; i < fileHeaderSize; i++ {
+	for j := range fh.MorePooledBlockLists {
+		i += copy(buffer[i:], fh.MorePooledBlockLists[j][:])
+	}
+
+	binary.BigEndian.PutUint64(buffer[i:], uint64(fh.BlockAllocationBitmapOffset))
+	i += 8
+
+	for ; i < fileHeaderSlotSize-4; i++ {
 		buffer[i] = 0
 	}
+
+	binary.BigEndian.PutUint32(buffer[i:], crc32.Checksum(buffer[:i], crc32cTable))
 }
 
 func (fh *fileHeader) Deserialize(data []byte) error {
-	_ = data[fileHeaderSize-1]
+	_ = data[fileHeaderSlotSize-1]
 	i := 0
 
 	if string(data[i:i+len(fileSignature)]) != fileSignature {
 		return errBadFileSignature
 	}
 
+	if checksum := binary.BigEndian.Uint32(data[fileHeaderSlotSize-4:]); checksum != crc32.Checksum(data[:fileHeaderSlotSize-4], crc32cTable) {
+		return errBadFileHeaderChecksum
+	}
+
 	i += len(fileSignature)
+	fh.SequenceNumber = int64(binary.BigEndian.Uint64(data[i:]))
+	i += 8
 	fh.SpaceSize = int64(binary.BigEndian.Uint64(data[i:]))
 	i += 8
 	fh.UsedSpaceSize = int64(binary.BigEndian.Uint64(data[i:]))
@@ -72,7 +142,222 @@ func (fh *fileHeader) Deserialize(data []byte) error {
 	i += 8
 	fh.PrimarySpace = int64(^binary.BigEndian.Uint64(data[i:]))
 	i += 8
+	fh.Flags = int64(binary.BigEndian.Uint64(data[i:]))
+	i += 8
+	fh.BlockAllocationBitmapChecksum = binary.BigEndian.Uint32(data[i:])
+	i += 4
+	fh.PageChecksumsSize = int64(binary.BigEndian.Uint64(data[i:]))
+	i += 8
+	fh.PageChecksumsChecksum = binary.BigEndian.Uint32(data[i:])
+	i += 4
+	fh.RootDirectory = int64(^binary.BigEndian.Uint64(data[i:]))
+	i += 8
+	fh.NumberOfPoolShards = int64(binary.BigEndian.Uint64(data[i:]))
+	i += 8
+
+	for j := range fh.MorePooledBlockLists {
+		i += copy(fh.MorePooledBlockLists[j][:], data[i:])
+	}
+
+	fh.BlockAllocationBitmapOffset = int64(binary.BigEndian.Uint64(data[i:]))
+
+	if fh.BlockAllocationBitmapOffset == 0 {
+		// zero for files written before the block allocation bitmap
+		// moved, which have it right after the used space
+		fh.BlockAllocationBitmapOffset = int64(fileHeaderSize) + fh.UsedSpaceSize
+	}
+
+	return nil
+}
+
+// DeserializeLegacy deserializes the file header from the given data of a
+// legacy file header.
+func (fh *fileHeader) DeserializeLegacy(data []byte) error {
+	_ = data[fileHeaderSize-1]
+	i := 0
+
+	if string(data[i:i+len(fileSignature)]) != fileSignature {
+		return errBadFileSignature
+	}
+
+	for _, b := range data[legacyFileHeaderSize:fileHeaderSize] {
+		if b != 0 {
+			return errBadFileHeaderChecksum
+		}
+	}
+
+	i += len(fileSignature)
+	*fh = fileHeader{Flags: fileHeaderLegacy, RootDirectory: -1}
+	fh.SpaceSize = int64(binary.BigEndian.Uint64(data[i:]))
+	i += 8
+	fh.UsedSpaceSize = int64(binary.BigEndian.Uint64(data[i:]))
+	i += 8
+	fh.MappedSpaceSize = int64(binary.BigEndian.Uint64(data[i:]))
+	i += 8
+	fh.AllocatedSpaceSize = int64(binary.BigEndian.Uint64(data[i:]))
+	i += 8
+	fh.BlockAllocationBitmapSize = int64(binary.BigEndian.Uint64(data[i:]))
+	i += 8
+	i += copy(fh.PooledBlockList[:], data[i:])
+	fh.DismissedSpaceSize = int64(binary.BigEndian.Uint64(data[i:]))
+	i += 8
+	fh.PrimarySpace = int64(^binary.BigEndian.Uint64(data[i:]))
+	fh.BlockAllocationBitmapOffset = int64(fileHeaderSize) + fh.UsedSpaceSize
 	return nil
 }
 
-var errBadFileSignature = errors.New("fsm: bad file signature")
+// Check checks the consistency of the fields of the file header.
+func (fh *fileHeader) Check() error {
+	if fh.SpaceSize < 0 || fh.SpaceSize%buddy.MaxBlockSize != 0 {
+		return fmt.Errorf("bad space size %d", fh.SpaceSize)
+	}
+
+	if fh.UsedSpaceSize < 0 || fh.UsedSpaceSize > fh.SpaceSize || fh.UsedSpaceSize%buddy.MinBlockSize != 0 {
+		return fmt.Errorf("bad used space size %d", fh.UsedSpaceSize)
+	}
+
+	if fh.MappedSpaceSize < fh.UsedSpaceSize {
+		return fmt.Errorf("bad mapped space size %d", fh.MappedSpaceSize)
+	}
+
+	if fh.AllocatedSpaceSize < 0 || fh.AllocatedSpaceSize > fh.UsedSpaceSize {
+		return fmt.Errorf("bad allocated space size %d", fh.AllocatedSpaceSize)
+	}
+
+	if fh.BlockAllocationBitmapSize < 0 {
+		return fmt.Errorf("bad block allocation bitmap size %d", fh.BlockAllocationBitmapSize)
+	}
+
+	if fh.PageChecksumsSize < 0 {
+		return fmt.Errorf("bad page checksums size %d", fh.PageChecksumsSize)
+	}
+
+	if fh.BlockAllocationBitmapOffset < int64(fileHeaderSize)+fh.UsedSpaceSize {
+		return fmt.Errorf("bad block allocation bitmap offset %d", fh.BlockAllocationBitmapOffset)
+	}
+
+	// zero for files created before pool shards, which have one shard
+	if fh.NumberOfPoolShards < 0 || fh.NumberOfPoolShards > pool.MaxNumberOfShards {
+		return fmt.Errorf("bad number of pool shards %d", fh.NumberOfPoolShards)
+	}
+
+	return nil
+}
+
+// FileHeaderCopyOffset returns the offset in the file of the copy of the
+// file header, which follows the block allocation bitmap and the page
+// checksums at the next page boundary, so that recovery finds the block
+// allocation bitmap by scanning the file even if the file header slots
+// are lost, see findFileHeaderCopy.
+func (fh *fileHeader) FileHeaderCopyOffset() int64 {
+	bitmapEnd := fh.BlockAllocationBitmapOffset + fh.BlockAllocationBitmapSize + fh.PageChecksumsSize
+	return (bitmapEnd + (pageSize - 1)) &^ (pageSize - 1)
+}
+
+// BitmapEnd returns the end offset in the file of the range holding the
+// block allocation bitmap, the page checksums and the copy of the file
+// header.
+func (fh *fileHeader) BitmapEnd() int64 {
+	return fh.FileHeaderCopyOffset() + int64(fileHeaderSlotSize)
+}
+
+// loadFileHeader picks the newest valid file header out of the
+// header slots in the given data, or takes the legacy file header
+// if any. Files with legacy file headers get upgraded on the first
+// commit.
+func loadFileHeader(data []byte) (fileHeader, int, error) {
+	_ = data[fileHeaderSize-1]
+	var latestFileHeader fileHeader
+	latestSlotIndex := -1
+	var err error
+
+	for slotIndex := 0; slotIndex < numberOfFileHeaderSlots; slotIndex++ {
+		var fileHeader fileHeader
+
+		if err2 := fileHeader.Deserialize(data[slotIndex*fileHeaderSlotSize:]); err2 != nil {
+			if err == nil || err == errBadFileSignature {
+				err = err2
+			}
+
+			continue
+		}
+
+		if err2 := fileHeader.Check(); err2 != nil {
+			err = err2
+			continue
+		}
+
+		if latestSlotIndex < 0 || fileHeader.SequenceNumber > latestFileHeader.SequenceNumber {
+			latestFileHeader = fileHeader
+			latestSlotIndex = slotIndex
+		}
+	}
+
+	if latestSlotIndex < 0 {
+		// the file may have a legacy file header instead, which is taken
+		// as the one in the first slot, so that the first commit goes to
+		// the second slot and leaves it intact
+		if err2 := latestFileHeader.DeserializeLegacy(data); err2 != nil || latestFileHeader.Check() != nil {
+			return fileHeader{}, 0, &CorruptionError{"file header", err.Error()}
+		}
+
+		latestSlotIndex = 0
+	}
+
+	return latestFileHeader, latestSlotIndex, nil
+}
+
+// makeInitialFileHeaders returns the raw file headers of an empty file storage.
+func makeInitialFileHeaders() []byte {
+	rawFileHeaders := make([]byte, fileHeaderSize)
+	fileHeader := fileHeader{PrimarySpace: -1, RootDirectory: -1, BlockAllocationBitmapOffset: int64(fileHeaderSize)}
+	fileHeader.Serialize(rawFileHeaders)
+	return rawFileHeaders
+}
+
+// initFile writes the file headers of an empty file storage to the given
+// file if the file is empty, i.e. it has just been created, by the caller or
+// by another process which is yet to take the lock.
+func initFile(file *os.File) error {
+	fileInfo, err := file.Stat()
+
+	if err != nil {
+		return err
+	}
+
+	if fileInfo.Size() >= 1 {
+		return nil
+	}
+
+	_, err = file.WriteAt(makeInitialFileHeaders(), 0)
+	return err
+}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// CorruptionError represents an error about the corruption of a part of file storages.
+type CorruptionError struct {
+	// Part is the part corrupted, e.g. "file header".
+	Part string
+
+	// Reason describes the corruption.
+	Reason string
+}
+
+// Error implements error.Error.
+func (ce *CorruptionError) Error() string {
+	return fmt.Sprintf("fsm: corrupted %s: %s", ce.Part, ce.Reason)
+}
+
+// Unwrap returns ErrCorrupted.
+func (ce *CorruptionError) Unwrap() error {
+	return ErrCorrupted
+}
+
+// ErrCorrupted is returned, wrapped by *CorruptionError, when a file storage is found corrupted.
+var ErrCorrupted = errors.New("fsm: corrupted")
+
+var (
+	errBadFileSignature      = errors.New("bad signature")
+	errBadFileHeaderChecksum = errors.New("bad checksum")
+)
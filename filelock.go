@@ -0,0 +1,115 @@
+package fsm
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+const (
+	minLockRetryInterval = time.Millisecond
+	maxLockRetryInterval = 100 * time.Millisecond
+)
+
+// lockFile takes an advisory lock, shared or exclusive, on the given file,
+// retrying until the given timeout expires if the file is locked by another
+// process, in which case ErrLocked is returned. The lock is released when
+// the file is closed.
+func lockFile(file *os.File, shared bool, timeout time.Duration) error {
+	return retryLocking(timeout, func() (bool, error) {
+		return tryLockFile(file, shared)
+	})
+}
+
+// lockInitializedFile takes a shared lock on the given file like lockFile,
+// but also waits while the file is empty, which means the file has been
+// created by another process not yet having it locked and initialized.
+func lockInitializedFile(file *os.File, timeout time.Duration) error {
+	return retryLocking(timeout, func() (bool, error) {
+		if ok, err := tryLockFile(file, true); !ok || err != nil {
+			return false, err
+		}
+
+		fileInfo, err := file.Stat()
+
+		if err != nil {
+			return false, err
+		}
+
+		if fileInfo.Size() >= 1 {
+			return true, nil
+		}
+
+		return false, unlockFile(file)
+	})
+}
+
+func retryLocking(timeout time.Duration, tryLock func() (bool, error)) error {
+	deadline := time.Now().Add(timeout)
+	retryInterval := minLockRetryInterval
+
+	for {
+		ok, err := tryLock()
+
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			return nil
+		}
+
+		remainingTime := time.Until(deadline)
+
+		if remainingTime <= 0 {
+			return ErrLocked
+		}
+
+		if retryInterval > remainingTime {
+			retryInterval = remainingTime
+		}
+
+		time.Sleep(retryInterval)
+
+		if retryInterval *= 2; retryInterval > maxLockRetryInterval {
+			retryInterval = maxLockRetryInterval
+		}
+	}
+}
+
+// lockSharedFile takes a shared lock on the given file like
+// lockInitializedFile for opening a file storage in shared mode. If the
+// file is open by no other processes, which is told by trying to lock the
+// file exclusively first, the control block of shared file storages (see
+// openShared) is cleared in the meantime, as it can only be left over by
+// processes which have all died.
+func lockSharedFile(file *os.File, timeout time.Duration) error {
+	ok, err := tryLockFile(file, false)
+
+	if err != nil {
+		return err
+	}
+
+	if ok {
+		err := initFile(file)
+
+		if err == nil {
+			_, err = file.WriteAt(make([]byte, sharedControlBlockSize), int64(sharedControlBlockOffset))
+		}
+
+		if err2 := unlockFile(file); err == nil {
+			err = err2
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return lockInitializedFile(file, timeout)
+}
+
+// ErrLocked is returned when opening a file storage on a file which is
+// open by another process, exclusively, or in read-only mode when opening
+// not in read-only mode (see OpenOptions.LockTimeout).
+var ErrLocked = errors.New("fsm: locked")
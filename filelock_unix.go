@@ -0,0 +1,38 @@
+// +build darwin linux
+
+package fsm
+
+import (
+	"os"
+	"syscall"
+)
+
+// tryLockFile takes a lock on the given file with flock(2) and reports
+// whether it succeeds, without waiting.
+func tryLockFile(file *os.File, shared bool) (bool, error) {
+	how := syscall.LOCK_EX | syscall.LOCK_NB
+
+	if shared {
+		how = syscall.LOCK_SH | syscall.LOCK_NB
+	}
+
+	for {
+		err := syscall.Flock(int(file.Fd()), how)
+
+		switch err {
+		case nil:
+			return true, nil
+		case syscall.EINTR:
+			continue
+		case syscall.EWOULDBLOCK:
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+}
+
+// unlockFile releases the lock on the given file.
+func unlockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,70 @@
+// +build windows
+
+package fsm
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+
+	errorLockViolation syscall.Errno = 33
+)
+
+// lockOffsetHigh is the high 32 bits of the offset of the byte locked,
+// which is far beyond the end of the file, as locks on Windows are
+// mandatory and would block reading and writing the file otherwise.
+const lockOffsetHigh = 0x40000000
+
+var (
+	kernel32     = syscall.NewLazyDLL("kernel32.dll")
+	lockFileEx   = kernel32.NewProc("LockFileEx")
+	unlockFileEx = kernel32.NewProc("UnlockFileEx")
+)
+
+// tryLockFile takes a lock on the given file with LockFileEx and reports
+// whether it succeeds, without waiting.
+func tryLockFile(file *os.File, shared bool) (bool, error) {
+	flags := uintptr(lockfileFailImmediately)
+
+	if !shared {
+		flags |= lockfileExclusiveLock
+	}
+
+	if err := callLockFileEx(file, flags); err != nil {
+		if err == errorLockViolation {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
+
+// unlockFile releases the lock on the given file.
+func unlockFile(file *os.File) error {
+	overlapped := syscall.Overlapped{OffsetHigh: lockOffsetHigh}
+	r1, _, err := syscall.Syscall6(unlockFileEx.Addr(), 5, file.Fd(), 0, 1, 0, uintptr(unsafe.Pointer(&overlapped)), 0)
+
+	if r1 == 0 {
+		return err
+	}
+
+	return nil
+}
+
+func callLockFileEx(file *os.File, flags uintptr) error {
+	overlapped := syscall.Overlapped{OffsetHigh: lockOffsetHigh}
+	r1, _, err := syscall.Syscall6(lockFileEx.Addr(), 6, file.Fd(), flags, 0, 1, 0, uintptr(unsafe.Pointer(&overlapped)))
+
+	if r1 == 0 {
+		return err
+	}
+
+	return nil
+}
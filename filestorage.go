@@ -2,7 +2,11 @@
 package fsm
 
 import (
+	"errors"
+	"hash/crc32"
 	"os"
+	"sort"
+	"time"
 
 	"github.com/roy2220/fsm/internal/buddy"
 	"github.com/roy2220/fsm/internal/pool"
@@ -10,10 +14,24 @@ import (
 
 // FileStorage represents a file storage.
 type FileStorage struct {
-	spaceMapper  spaceMapper
-	buddy        buddy.Buddy
-	pool         pool.Pool
-	primarySpace int64
+	spaceMapper   spaceMapper
+	buddy         buddy.Buddy
+	pool          pool.Pool
+	primarySpace  int64
+	roots         map[string]int64
+	rootDirectory int64
+
+	fileHeaderSlotIndex      int
+	fileHeaderSequenceNumber int64
+	bitmapOffset             int64
+	bitmapEnd                int64
+	wal                      *wal
+	inTransaction            bool
+	options                  OpenOptions
+	pageChecksums            pageChecksums
+	dirtyPages               *dirtyPages
+	scrubCursor              int
+	sharing                  *sharing
 }
 
 // Init initializes the file storage and returns it.
@@ -21,36 +39,159 @@ func (fs *FileStorage) Init() *FileStorage {
 	fs.buddy.Init(&fs.spaceMapper)
 	fs.pool.Init(&fs.buddy)
 	fs.primarySpace = -1
+	fs.rootDirectory = -1
 	return fs
 }
 
 // Open opens a file storage on the given file.
 func (fs *FileStorage) Open(fileName string, createFileIfNotExists bool) error {
-	file, err := os.OpenFile(fileName, os.O_RDWR, 0666)
+	return fs.OpenWithOptions(fileName, OpenOptions{
+		CreateFileIfNotExists: createFileIfNotExists,
+	})
+}
+
+// OpenWithOptions opens a file storage on the given file with the given options.
+func (fs *FileStorage) OpenWithOptions(fileName string, options OpenOptions) error {
+	if a := options.MinSpaceAlignment; a < 0 || a&(a-1) != 0 || a > maxMinSpaceAlignment {
+		return ErrInvalidAlignment
+	}
+
+	if n := options.NumberOfPoolShards; n < 0 || n > MaxNumberOfPoolShards {
+		return ErrInvalidNumberOfPoolShards
+	}
+
+	if options.ReadOnly {
+		return fs.openReadOnly(fileName, options)
+	}
+
+	fileMode := options.FileMode
+
+	if fileMode == 0 {
+		fileMode = 0666
+	}
+
+	file, err := os.OpenFile(fileName, os.O_RDWR, fileMode)
 
 	if err != nil {
-		if !(createFileIfNotExists && os.IsNotExist(err)) {
+		if !(options.CreateFileIfNotExists && os.IsNotExist(err)) {
 			return err
 		}
 
-		file, err = os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0666)
+		file, err = os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, fileMode)
 
 		if err != nil {
 			return err
 		}
+	}
 
-		rawFileHeader := make([]byte, fileHeaderSize)
-		copy(rawFileHeader, fileSignature)
+	if fs.sharing != nil {
+		if err := lockSharedFile(file, options.LockTimeout); err != nil {
+			file.Close()
+			return err
+		}
+	} else if !options.NoLock {
+		if err := lockFile(file, false, options.LockTimeout); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	// the file may have been created by another process not yet having it
+	// locked and initialized
+	if err := initFile(file); err != nil {
+		file.Close()
+		return err
+	}
 
-		if _, err := file.WriteAt(rawFileHeader, 0); err != nil {
+	walFile, err := openWALFile(fileName, options.UseWAL, fileMode)
+
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	if walFile != nil {
+		if err := replayWAL(walFile, file); err != nil {
+			walFile.Close()
 			file.Close()
 			return err
 		}
+
+		if !options.UseWAL {
+			walFile.Close()
+			os.Remove(walFile.Name())
+			walFile = nil
+		}
 	}
 
 	fs.spaceMapper.File = file
+	fs.spaceMapper.Private = options.UseWAL
+	fs.spaceMapper.Shared = fs.sharing != nil
+	fs.spaceMapper.Advice = options.MmapAdvice
+
+	if options.StableAccessors {
+		fs.spaceMapper.ReservedSpaceSize = options.maxSpaceSize()
+	}
+
+	fs.options = options
+	fs.setMappingPolicy()
+	fs.setMinSpaceAlignment()
+	fs.setDirtyPageTracking()
+	fs.buddy.Build().SetUsedSpaceGuard(fs.moveBitmapAhead)
+
+	if fs.sharing != nil {
+		// the file is loaded and marked dirty unless other processes
+		// are sharing it already
+		err = fs.openShared()
+	} else {
+		if options.Recover {
+			err = fs.recoverFile()
+		} else {
+			err = fs.loadFile(options.AllowUncleanShutdown)
+
+			if n := options.NumberOfPoolShards; err == nil && n >= 1 {
+				fs.pool.Build().SetNumberOfShards(n)
+			}
+		}
+
+		if err == nil {
+			err = fs.setDirtySpaceSize()
+		}
+
+		if err == nil {
+			err = fs.buddy.RemapSpace()
+		}
+	}
+
+	if err != nil {
+		fs.spaceMapper.Close()
+
+		if walFile != nil {
+			walFile.Close()
+		}
+
+		file.Close()
+		return err
+	}
+
+	if walFile != nil {
+		fs.wal = &wal{File: walFile, NoSync: options.SyncPolicy == SyncNever}
+	}
+
+	if fs.sharing != nil {
+		// the file is marked dirty on starting sharing, see startSharing
+		return nil
+	}
+
+	// mark the file storage dirty until closed
+	if err := fs.Sync(); err != nil {
+		fs.spaceMapper.Close()
+
+		if walFile != nil {
+			walFile.Close()
+			fs.wal = nil
+		}
 
-	if err := fs.loadFile(); err != nil {
 		file.Close()
 		return err
 	}
@@ -58,12 +199,35 @@ func (fs *FileStorage) Open(fileName string, createFileIfNotExists bool) error {
 	return nil
 }
 
-// Close closes the file storage.
+// Close closes the file storage. The transaction in progress,
+// if any, gets rolled back.
 func (fs *FileStorage) Close() error {
+	if fs.options.ReadOnly {
+		return fs.closeReadOnly()
+	}
+
+	if fs.inTransaction {
+		if err := fs.Rollback(); err != nil {
+			return err
+		}
+	}
+
 	if err := fs.storeFile(); err != nil {
 		return err
 	}
 
+	if fs.wal != nil {
+		if err := fs.wal.File.Close(); err != nil {
+			return err
+		}
+
+		if err := os.Remove(fs.wal.File.Name()); err != nil {
+			return err
+		}
+
+		fs.wal = nil
+	}
+
 	if err := fs.spaceMapper.File.Close(); err != nil {
 		return err
 	}
@@ -71,67 +235,372 @@ func (fs *FileStorage) Close() error {
 	return nil
 }
 
+// Sync flushes the space mapped and commits the allocation state
+// to the file, leaving the file storage open.
+func (fs *FileStorage) Sync() error {
+	if fs.options.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if fs.inTransaction {
+		return ErrTransactionInProgress
+	}
+
+	fileHeader := fs.makeFileHeader()
+
+	if fs.wal != nil {
+		return fs.commitChangesWithWAL(&fileHeader)
+	}
+
+	if fs.options.SyncPolicy != SyncNever {
+		if err := fs.spaceMapper.Sync(); err != nil {
+			return err
+		}
+	}
+
+	return fs.commitFileHeader(&fileHeader, true)
+}
+
 // AllocateSpace allocates space with the given size on the file,
 // returns the space allocated and an ephemeral accessor (a byte
 // slice for reading/writing space, may get *INVALIDATED* after
-// calling Allocate.../Free...).
+// calling Allocate.../Free...). The space is aligned to 8 bytes at
+// least, see OpenOptions.MinSpaceAlignment. Space larger than 4 GiB is
+// allocated as a run of contiguous blocks of 4 GiB.
+// It panics when an error occurs, see TryAllocateSpace.
 func (fs *FileStorage) AllocateSpace(spaceSize int) (int64, []byte) {
-	space, spaceSize := fs.pool.AllocateSpace(spaceSize)
-	spaceAccessor := fs.spaceMapper.AccessSpace()[space : space+int64(spaceSize)]
+	space, spaceAccessor, err := fs.TryAllocateSpace(spaceSize)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return space, spaceAccessor
+}
+
+// TryAllocateSpace is like AllocateSpace but returns an error,
+// e.g. ErrBlockTooLarge or an I/O error, instead of panicking.
+// The file storage stays unchanged when an error occurs.
+func (fs *FileStorage) TryAllocateSpace(spaceSize int) (int64, []byte, error) {
+	if fs.options.ReadOnly {
+		return 0, nil, ErrReadOnly
+	}
+
+	space, spaceSize, err := fs.pool.AllocateSpace(spaceSize)
+
+	if err != nil {
+		return 0, nil, convertError(err)
+	}
+
+	fs.completeChange()
+	spaceAccessor := fs.accessSpace(space, spaceSize)
+	return space, spaceAccessor, nil
+}
+
+// AllocateSpaceAligned is like AllocateSpace but the space allocated
+// is aligned to the given alignment, which must be a power of two no
+// more than 4 GiB. Unlike AllocateAlignedSpace, small space with a small
+// alignment, e.g. 16 or 512 bytes, does not take a whole block of 4 KiB.
+// The alignment is not kept when the space moves on reallocation.
+// It panics when an error occurs, see TryAllocateSpaceAligned.
+func (fs *FileStorage) AllocateSpaceAligned(spaceSize int, alignment int) (int64, []byte) {
+	space, spaceAccessor, err := fs.TryAllocateSpaceAligned(spaceSize, alignment)
+
+	if err != nil {
+		panic(err)
+	}
+
 	return space, spaceAccessor
 }
 
+// TryAllocateSpaceAligned is like AllocateSpaceAligned but returns an
+// error, e.g. ErrInvalidAlignment or an I/O error, instead of panicking.
+// The file storage stays unchanged when an error occurs.
+func (fs *FileStorage) TryAllocateSpaceAligned(spaceSize int, alignment int) (int64, []byte, error) {
+	if fs.options.ReadOnly {
+		return 0, nil, ErrReadOnly
+	}
+
+	space, spaceSize, err := fs.pool.AllocateSpaceAligned(spaceSize, alignment)
+
+	if err != nil {
+		return 0, nil, convertError(err)
+	}
+
+	fs.completeChange()
+	spaceAccessor := fs.accessSpace(space, spaceSize)
+	return space, spaceAccessor, nil
+}
+
+// AllocateZeroedSpace is like AllocateSpace but guarantees the space
+// allocated is zeroed, where space beyond what has ever been used is
+// known to be zero and not cleared again.
+// It panics when an error occurs, see TryAllocateZeroedSpace.
+func (fs *FileStorage) AllocateZeroedSpace(spaceSize int) (int64, []byte) {
+	space, spaceAccessor, err := fs.TryAllocateZeroedSpace(spaceSize)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return space, spaceAccessor
+}
+
+// TryAllocateZeroedSpace is like AllocateZeroedSpace but returns an
+// error, e.g. ErrBlockTooLarge or an I/O error, instead of panicking.
+// The file storage stays unchanged when an error occurs.
+func (fs *FileStorage) TryAllocateZeroedSpace(spaceSize int) (int64, []byte, error) {
+	if fs.options.ReadOnly {
+		return 0, nil, ErrReadOnly
+	}
+
+	space, spaceSize, err := fs.pool.AllocateZeroedSpace(spaceSize)
+
+	if err != nil {
+		return 0, nil, convertError(err)
+	}
+
+	fs.completeChange()
+	spaceAccessor := fs.accessSpace(space, spaceSize)
+	return space, spaceAccessor, nil
+}
+
 // FreeSpace releases the given space back to the file.
+// It panics when an error occurs, see TryFreeSpace.
 func (fs *FileStorage) FreeSpace(space int64) {
-	fs.pool.FreeSpace(space)
+	if err := fs.TryFreeSpace(space); err != nil {
+		panic(err)
+	}
+}
+
+// TryFreeSpace is like FreeSpace but returns an error, e.g.
+// ErrInvalidSpace or an I/O error, instead of panicking.
+func (fs *FileStorage) TryFreeSpace(space int64) error {
+	if fs.options.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if err := fs.pool.FreeSpace(space); err != nil {
+		return convertError(err)
+	}
+
+	fs.completeChange()
+	return nil
+}
+
+// ReallocateSpace resizes the given space on the file to the given size,
+// preserving the content of the space up to the lesser of the old and new
+// sizes, returns the space resized (which may differ from the given one)
+// and an ephemeral accessor (a byte slice for reading/writing space, may
+// get *INVALIDATED* after calling Allocate.../Free...). The space grows or
+// shrinks in place if possible.
+// It panics when an error occurs, see TryReallocateSpace.
+func (fs *FileStorage) ReallocateSpace(space int64, spaceSize int) (int64, []byte) {
+	space, spaceAccessor, err := fs.TryReallocateSpace(space, spaceSize)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return space, spaceAccessor
+}
+
+// TryReallocateSpace is like ReallocateSpace but returns an error, e.g.
+// ErrInvalidSpace, ErrBlockTooLarge or an I/O error, instead of panicking.
+// The file storage stays unchanged when an error occurs, except for an I/O
+// error in releasing the old space after it is moved, in which case the
+// new space is still returned along with the error.
+func (fs *FileStorage) TryReallocateSpace(space int64, spaceSize int) (int64, []byte, error) {
+	if fs.options.ReadOnly {
+		return 0, nil, ErrReadOnly
+	}
+
+	space, spaceSize, err := fs.pool.ReallocateSpace(space, spaceSize)
+
+	// the space returned is valid as long as it's size is not zero
+	if spaceSize == 0 {
+		return 0, nil, convertError(err)
+	}
+
+	fs.completeChange()
+	spaceAccessor := fs.accessSpace(space, spaceSize)
+	return space, spaceAccessor, err
 }
 
 // AccessSpace returns an ephemeral accessor of the given space
 // on the file (a byte slice for reading/writing space, may get
 // *INVALIDATED* after calling Allocate.../Free...).
+// It panics when an error occurs, see TryAccessSpace.
 func (fs *FileStorage) AccessSpace(space int64) []byte {
-	spaceSize := fs.pool.GetSpaceSize(space)
-	spaceAccessor := fs.spaceMapper.AccessSpace()[space : space+int64(spaceSize)]
+	spaceAccessor, err := fs.TryAccessSpace(space)
+
+	if err != nil {
+		panic(err)
+	}
+
 	return spaceAccessor
 }
 
+// TryAccessSpace is like AccessSpace but returns ErrInvalidSpace
+// instead of panicking when the given space is invalid.
+func (fs *FileStorage) TryAccessSpace(space int64) ([]byte, error) {
+	spaceSize, err := fs.pool.GetSpaceSize(space)
+
+	if err != nil {
+		return nil, convertError(err)
+	}
+
+	spaceAccessor := fs.accessSpace(space, spaceSize)
+	return spaceAccessor, nil
+}
+
 // AllocateAlignedSpace allocates aligned space, aka a block,
 // with the given size on the file, returns the aligned space
 // allocated and an ephemeral accessor (a byte slice for
 // reading/writing space, may get *INVALIDATED* after calling
 // Allocate.../Free...).
+// It panics when an error occurs, see TryAllocateAlignedSpace.
 func (fs *FileStorage) AllocateAlignedSpace(blockSize int) (int64, []byte) {
-	block, blockSize := fs.buddy.MustAllocateBlock(blockSize)
-	blockAccessor := fs.spaceMapper.AccessSpace()[block : block+int64(blockSize)]
+	block, blockAccessor, err := fs.TryAllocateAlignedSpace(blockSize)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return block, blockAccessor
+}
+
+// TryAllocateAlignedSpace is like AllocateAlignedSpace but returns
+// an error, e.g. ErrBlockTooLarge or an I/O error, instead of
+// panicking. The file storage stays unchanged when an error occurs.
+func (fs *FileStorage) TryAllocateAlignedSpace(blockSize int) (int64, []byte, error) {
+	if fs.options.ReadOnly {
+		return 0, nil, ErrReadOnly
+	}
+
+	block, blockSize, err := fs.buddy.AllocateBlock(blockSize)
+
+	if err != nil {
+		return 0, nil, convertError(err)
+	}
+
+	fs.completeChange()
+	blockAccessor := fs.accessSpace(block, blockSize)
+	return block, blockAccessor, nil
+}
+
+// AllocateZeroedAlignedSpace is like AllocateAlignedSpace but
+// guarantees the aligned space allocated is zeroed, where space
+// beyond what has ever been used is known to be zero and not
+// cleared again.
+// It panics when an error occurs, see TryAllocateZeroedAlignedSpace.
+func (fs *FileStorage) AllocateZeroedAlignedSpace(blockSize int) (int64, []byte) {
+	block, blockAccessor, err := fs.TryAllocateZeroedAlignedSpace(blockSize)
+
+	if err != nil {
+		panic(err)
+	}
+
 	return block, blockAccessor
 }
 
+// TryAllocateZeroedAlignedSpace is like AllocateZeroedAlignedSpace but
+// returns an error, e.g. ErrBlockTooLarge or an I/O error, instead of
+// panicking. The file storage stays unchanged when an error occurs.
+func (fs *FileStorage) TryAllocateZeroedAlignedSpace(blockSize int) (int64, []byte, error) {
+	if fs.options.ReadOnly {
+		return 0, nil, ErrReadOnly
+	}
+
+	block, blockSize, err := fs.buddy.AllocateZeroedBlock(blockSize)
+
+	if err != nil {
+		return 0, nil, convertError(err)
+	}
+
+	fs.completeChange()
+	blockAccessor := fs.accessSpace(block, blockSize)
+	return block, blockAccessor, nil
+}
+
 // FreeAlignedSpace releases the given aligned space, aka a
 // block, back to the file.
+// It panics when an error occurs, see TryFreeAlignedSpace.
 func (fs *FileStorage) FreeAlignedSpace(block int64) {
-	fs.buddy.MustFreeBlock(block)
+	if err := fs.TryFreeAlignedSpace(block); err != nil {
+		panic(err)
+	}
+}
+
+// TryFreeAlignedSpace is like FreeAlignedSpace but returns an error,
+// e.g. ErrInvalidSpace or an I/O error, instead of panicking.
+func (fs *FileStorage) TryFreeAlignedSpace(block int64) error {
+	if fs.options.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if err := fs.buddy.FreeBlock(block); err != nil {
+		return convertError(err)
+	}
+
+	fs.completeChange()
+	return nil
 }
 
 // AccessAlignedSpace returns an ephemeral accessor of the
 // given aligned space, aka a block, on the file (a byte slice
 // for reading/writing space, may get *INVALIDATED* after
 // calling Allocate.../Free...).
+// It panics when an error occurs, see TryAccessAlignedSpace.
 func (fs *FileStorage) AccessAlignedSpace(block int64) []byte {
-	blockSize := fs.buddy.MustGetBlockSize(block)
-	blockAccessor := fs.spaceMapper.AccessSpace()[block : block+int64(blockSize)]
+	blockAccessor, err := fs.TryAccessAlignedSpace(block)
+
+	if err != nil {
+		panic(err)
+	}
+
 	return blockAccessor
 }
 
+// TryAccessAlignedSpace is like AccessAlignedSpace but returns
+// ErrInvalidSpace instead of panicking when the given aligned
+// space is invalid.
+func (fs *FileStorage) TryAccessAlignedSpace(block int64) ([]byte, error) {
+	blockSize, err := fs.buddy.GetBlockSize(block)
+
+	if err != nil {
+		return nil, convertError(err)
+	}
+
+	blockAccessor := fs.accessSpace(block, blockSize)
+	return blockAccessor, nil
+}
+
 // SetPrimarySpace set the primary space on the file.
 // The primary space is allocated by user and serves for
 // user-defined metadata.
+// It panics when an error occurs, see TrySetPrimarySpace.
 func (fs *FileStorage) SetPrimarySpace(primarySpace int64) {
+	if err := fs.TrySetPrimarySpace(primarySpace); err != nil {
+		panic(err)
+	}
+}
+
+// TrySetPrimarySpace is like SetPrimarySpace but returns ErrReadOnly
+// instead of panicking in read-only mode.
+func (fs *FileStorage) TrySetPrimarySpace(primarySpace int64) error {
+	if fs.options.ReadOnly {
+		return ErrReadOnly
+	}
+
 	fs.primarySpace = primarySpace
+	return nil
 }
 
 // PrimarySpace returns the primary space on the file.
 // The primary space is allocated by user and serves for
-// user-defined metadata.
+// user-defined metadata. It is also the root named the
+// empty string, see Root.
 func (fs *FileStorage) PrimarySpace() int64 {
 	return fs.primarySpace
 }
@@ -148,28 +617,150 @@ func (fs *FileStorage) Stats() Stats {
 	}
 }
 
-func (fs *FileStorage) loadFile() error {
+// setMappingPolicy sets up the buddy system to map space
+// according to the options.
+func (fs *FileStorage) setMappingPolicy() {
+	minMappedSpaceSize := 0
+
+	if fs.options.InitialSize >= 1 {
+		minMappedSpaceSize = (fs.options.InitialSize + (pageSize - 1)) &^ (pageSize - 1)
+	}
+
+	maxUsedSpaceSize := fs.options.maxSpaceSize()
+	var mappedSpaceSizeCalculator func(int) int
+
+	if growthPolicy := fs.options.GrowthPolicy; growthPolicy != nil {
+		mappedSpaceSizeCalculator = func(usedSpaceSize int) int {
+			return (growthPolicy(usedSpaceSize) + (pageSize - 1)) &^ (pageSize - 1)
+		}
+	}
+
+	fs.buddy.Build().
+		SetMinMappedSpaceSize(minMappedSpaceSize).
+		SetMaxUsedSpaceSize(maxUsedSpaceSize).
+		SetMappedSpaceSizeCalculator(mappedSpaceSizeCalculator)
+}
+
+func (fs *FileStorage) setMinSpaceAlignment() {
+	minSpaceAlignment := fs.options.MinSpaceAlignment
+
+	if minSpaceAlignment == 0 {
+		minSpaceAlignment = pool.DefaultMinAlignment
+	}
+
+	fs.pool.Build().SetMinAlignment(minSpaceAlignment)
+}
+
+// setDirtyPageTracking sets up tracking the pages changed, for journaling
+// them through the write-ahead log and refreshing their page checksums only.
+func (fs *FileStorage) setDirtyPageTracking() {
+	fs.dirtyPages = nil
+	var changeListener func(int64, int)
+
+	if fs.options.UsePageChecksums || fs.options.UseWAL {
+		fs.dirtyPages = &dirtyPages{keepsExposedPages: fs.options.StableAccessors}
+		changeListener = fs.dirtyPages.AddChanged
+	}
+
+	fs.pool.Build().SetChangeListener(changeListener)
+	fs.spaceMapper.GetDirtyPages = fs.dirtyPages.PageIndexes
+}
+
+// accessSpace returns an accessor of the given range of the space,
+// whose pages are taken as dirty while the accessor is valid.
+func (fs *FileStorage) accessSpace(offset int64, size int) []byte {
+	fs.dirtyPages.AddExposed(offset, size)
+	return fs.spaceMapper.AccessSpace()[offset : offset+int64(size)]
+}
+
+// completeChange completes a change to the allocation state, which
+// invalidates the accessors, and commits the change in shared mode so
+// that it's never rolled back, see storeSharedState.
+func (fs *FileStorage) completeChange() {
+	fs.dirtyPages.InvalidateAccessors()
+
+	if fs.sharing != nil {
+		fs.storeSharedState()
+	}
+}
+
+// setDirtySpaceSize sets the dirty space size of the buddy system to the
+// size of the space in the file, as any bytes there may be non-zero.
+func (fs *FileStorage) setDirtySpaceSize() error {
+	fileInfo, err := fs.spaceMapper.File.Stat()
+
+	if err != nil {
+		return err
+	}
+
+	dirtySpaceSize := int(fileInfo.Size()) - fileHeaderSize
+
+	if dirtySpaceSize < fs.buddy.UsedSpaceSize() {
+		dirtySpaceSize = fs.buddy.UsedSpaceSize()
+	}
+
+	fs.buddy.Build().SetDirtySpaceSize(dirtySpaceSize)
+	return nil
+}
+
+// raiseDirtySpaceSize raises the dirty space size of the buddy system to
+// cover the block allocation bitmap and the page checksums, which are
+// written to the file beyond the used space, up to the given file offset.
+func (fs *FileStorage) raiseDirtySpaceSize(fileOffset int64) {
+	dirtySpaceSize := int(fileOffset) - fileHeaderSize
+
+	if dirtySpaceSize > fs.buddy.DirtySpaceSize() {
+		fs.buddy.Build().SetDirtySpaceSize(dirtySpaceSize)
+	}
+}
+
+func (fs *FileStorage) loadFile(allowsUncleanShutdown bool) error {
 	buffer := [fileHeaderSize]byte{}
 
 	if _, err := fs.spaceMapper.File.ReadAt(buffer[:], 0); err != nil {
 		return err
 	}
 
-	var fileHeader fileHeader
+	fileHeader, fileHeaderSlotIndex, err := loadFileHeader(buffer[:])
 
-	if err := fileHeader.Deserialize(buffer[:]); err != nil {
+	if err != nil {
 		return err
 	}
 
+	if fileHeader.Flags&(fileHeaderDirty|fileHeaderJournaled) == fileHeaderDirty && !allowsUncleanShutdown {
+		return ErrUncleanShutdown
+	}
+
 	blockAllocationBitmap := make([]byte, fileHeader.BlockAllocationBitmapSize)
 
-	if _, err := fs.spaceMapper.File.ReadAt(
-		blockAllocationBitmap,
-		int64(fileHeaderSize+int(fileHeader.UsedSpaceSize)),
-	); err != nil {
+	if _, err := fs.spaceMapper.File.ReadAt(blockAllocationBitmap, fileHeader.BlockAllocationBitmapOffset); err != nil {
 		return err
 	}
 
+	if checksum := crc32.Checksum(blockAllocationBitmap, crc32cTable); checksum != fileHeader.BlockAllocationBitmapChecksum &&
+		fileHeader.Flags&fileHeaderLegacy == 0 {
+		return &CorruptionError{"block allocation bitmap", "bad checksum"}
+	}
+
+	var pageChecksums pageChecksums
+
+	if fs.options.UsePageChecksums && fileHeader.PageChecksumsSize == 4*fileHeader.UsedSpaceSize/pageSize {
+		pageChecksums = make([]byte, fileHeader.PageChecksumsSize)
+
+		if _, err := fs.spaceMapper.File.ReadAt(
+			pageChecksums,
+			fileHeader.BlockAllocationBitmapOffset+fileHeader.BlockAllocationBitmapSize,
+		); err != nil {
+			return err
+		}
+
+		if checksum := crc32.Checksum(pageChecksums, crc32cTable); checksum != fileHeader.PageChecksumsChecksum {
+			return &CorruptionError{"page checksums", "bad checksum"}
+		}
+	}
+
+	fs.setBitmapRange(fileHeader.BlockAllocationBitmapOffset, fileHeader.BitmapEnd())
+
 	if err := fs.spaceMapper.MapSpace(int(fileHeader.MappedSpaceSize)); err != nil {
 		return err
 	}
@@ -180,17 +771,71 @@ func (fs *FileStorage) loadFile() error {
 		SetMappedSpaceSize(int(fileHeader.MappedSpaceSize)).
 		SetAllocatedSpaceSize(int(fileHeader.AllocatedSpaceSize)).
 		SetBlockAllocationBitmap(blockAllocationBitmap)
+	numberOfPoolShards := int(fileHeader.NumberOfPoolShards)
+
+	if numberOfPoolShards == 0 {
+		numberOfPoolShards = 1
+	}
+
 	poolBuilder := fs.pool.Build()
-	poolBuilder.LoadPooledBlockList(fileHeader.PooledBlockList[:]).
+	poolBuilder.SetNumberOfShards(numberOfPoolShards).
+		LoadPooledBlockList(0, fileHeader.PooledBlockList[:]).
 		SetDismissedSpaceSize(int(fileHeader.DismissedSpaceSize))
+
+	for i := 1; i < numberOfPoolShards; i++ {
+		poolBuilder.LoadPooledBlockList(i, fileHeader.MorePooledBlockLists[i-1][:])
+	}
+
 	fs.primarySpace = fileHeader.PrimarySpace
+	fs.fileHeaderSlotIndex = fileHeaderSlotIndex
+	fs.fileHeaderSequenceNumber = fileHeader.SequenceNumber
+
+	if err := fs.loadRoots(fileHeader.RootDirectory); err != nil {
+		return err
+	}
+
+	if fs.options.UsePageChecksums && pageChecksums == nil {
+		pageChecksums = makePageChecksums(fs.spaceMapper.AccessSpace(), fs.buddy.UsedSpaceSize())
+	}
+
+	fs.pageChecksums = pageChecksums
 	return nil
 }
 
 func (fs *FileStorage) storeFile() error {
 	fs.buddy.ShrinkSpace()
+	fileHeader := fs.makeFileHeader()
+	fileHeader.Flags &^= fileHeaderDirty
+
+	if fs.wal != nil {
+		if err := fs.commitChangesWithWAL(&fileHeader); err != nil {
+			return err
+		}
 
+		if err := fs.spaceMapper.Close(); err != nil {
+			return err
+		}
+
+		return fs.spaceMapper.File.Truncate(fs.calculateFileSize())
+	}
+
+	if fs.options.SyncPolicy != SyncNever {
+		if err := fs.spaceMapper.Sync(); err != nil {
+			return err
+		}
+	}
+
+	// the page checksums are refreshed from the space on commit
+	if err := fs.commitFileHeader(&fileHeader, true); err != nil {
+		return err
+	}
+
+	return fs.spaceMapper.Close()
+}
+
+func (fs *FileStorage) makeFileHeader() fileHeader {
 	fileHeader := fileHeader{
+		SequenceNumber:            fs.fileHeaderSequenceNumber + 1,
 		SpaceSize:                 int64(fs.buddy.SpaceSize()),
 		UsedSpaceSize:             int64(fs.buddy.UsedSpaceSize()),
 		MappedSpaceSize:           int64(fs.buddy.MappedSpaceSize()),
@@ -198,31 +843,512 @@ func (fs *FileStorage) storeFile() error {
 		BlockAllocationBitmapSize: int64(len(fs.buddy.BlockAllocationBitmap())),
 		DismissedSpaceSize:        int64(fs.pool.DismissedSpaceSize()),
 		PrimarySpace:              fs.primarySpace,
+		Flags:                     fileHeaderDirty,
+
+		BlockAllocationBitmapChecksum: crc32.Checksum(fs.buddy.BlockAllocationBitmap(), crc32cTable),
+		RootDirectory:                 fs.rootDirectory,
+	}
+
+	if fs.wal != nil {
+		fileHeader.Flags |= fileHeaderJournaled
 	}
 
-	fs.pool.StorePooledBlockList(fileHeader.PooledBlockList[:])
+	fileHeader.NumberOfPoolShards = int64(fs.pool.NumberOfShards())
+	fs.pool.StorePooledBlockList(0, fileHeader.PooledBlockList[:])
 
-	if err := fs.spaceMapper.Close(); err != nil {
-		return err
+	for i := 1; i < fs.pool.NumberOfShards(); i++ {
+		fs.pool.StorePooledBlockList(i, fileHeader.MorePooledBlockLists[i-1][:])
 	}
 
-	buffer := [fileHeaderSize]byte{}
+	return fileHeader
+}
+
+// commitFileHeader writes the block allocation bitmap, the page checksums
+// and the given file header, see writeFileHeader, refreshing the page
+// checksums of the pages changed since the last commit first.
+func (fs *FileStorage) commitFileHeader(fileHeader *fileHeader, durably bool) error {
+	if fs.options.UsePageChecksums {
+		fs.refreshPageChecksums(fileHeader, fs.dirtyPages.Take())
+	}
+
+	fs.placeBitmap(fileHeader)
+	return fs.writeFileHeader(fileHeader, fs.buddy.BlockAllocationBitmap(), fs.pageChecksums, durably)
+}
+
+// writeFileHeader writes the given block allocation bitmap, the given page
+// checksums, a copy of the given file header and then the given file header
+// to the inactive header slot, so that a torn write never destroys the file
+// header committed last time, nor the block allocation bitmap and the page
+// checksums it refers to (see placeBitmap). The writes wait for the storage
+// device, see syncFile, if durably is true.
+func (fs *FileStorage) writeFileHeader(fileHeader *fileHeader, blockAllocationBitmap []byte, pageChecksums []byte, durably bool) error {
+	bitmapOffset, bitmapEnd := fileHeader.BlockAllocationBitmapOffset, fileHeader.BitmapEnd()
+	fs.raiseDirtySpaceSize(bitmapEnd)
+	buffer := [fileHeaderSlotSize]byte{}
 	fileHeader.Serialize(buffer[:])
 
-	if _, err := fs.spaceMapper.File.WriteAt(buffer[:], 0); err != nil {
+	if _, err := fs.spaceMapper.File.WriteAt(blockAllocationBitmap, bitmapOffset); err != nil {
 		return err
 	}
 
 	if _, err := fs.spaceMapper.File.WriteAt(
-		fs.buddy.BlockAllocationBitmap(),
-		int64(fileHeaderSize+fs.buddy.UsedSpaceSize()),
+		pageChecksums,
+		bitmapOffset+int64(len(blockAllocationBitmap)),
 	); err != nil {
 		return err
 	}
 
+	if _, err := fs.spaceMapper.File.WriteAt(buffer[:], fileHeader.FileHeaderCopyOffset()); err != nil {
+		return err
+	}
+
+	if durably {
+		if err := fs.syncFile(); err != nil {
+			return err
+		}
+	}
+
+	fileHeaderSlotIndex := (fs.fileHeaderSlotIndex + 1) % numberOfFileHeaderSlots
+
+	if _, err := fs.spaceMapper.File.WriteAt(buffer[:], int64(fileHeaderSlotIndex*fileHeaderSlotSize)); err != nil {
+		return err
+	}
+
+	if durably {
+		if err := fs.syncFile(); err != nil {
+			return err
+		}
+	}
+
+	fs.fileHeaderSlotIndex = fileHeaderSlotIndex
+	fs.fileHeaderSequenceNumber = fileHeader.SequenceNumber
+	fs.setBitmapRange(bitmapOffset, bitmapEnd)
+	return nil
+}
+
+// commitChangesWithWAL commits the pages changed, the block allocation
+// bitmap and the given file header along with its copy to the file
+// atomically through the write-ahead log.
+func (fs *FileStorage) commitChangesWithWAL(fileHeader *fileHeader) error {
+	// the pages changed are kept dirty until committed, in case of failure
+	dirtyPageIndexes := fs.dirtyPages.PageIndexes()
+	sort.Ints(dirtyPageIndexes)
+
+	if fs.options.UsePageChecksums {
+		fs.refreshPageChecksums(fileHeader, dirtyPageIndexes)
+	}
+
+	fs.placeBitmap(fileHeader)
+	bitmapOffset, bitmapEnd := fileHeader.BlockAllocationBitmapOffset, fileHeader.BitmapEnd()
+	fs.raiseDirtySpaceSize(bitmapEnd)
+	spaceAccessor := fs.spaceMapper.AccessSpace()
+	numberOfPages := len(spaceAccessor) / pageSize
+
+	for _, i := range dirtyPageIndexes {
+		// the pages no longer mapped are the same as the ones in the file,
+		// while the free pages mapped are committed too, as they may be
+		// used without getting changed before the next commit
+		if i < numberOfPages {
+			fs.wal.AddRecord(int64(fileHeaderSize+i*pageSize), spaceAccessor[i*pageSize:(i+1)*pageSize])
+		}
+	}
+
+	buffer := [fileHeaderSlotSize]byte{}
+	fileHeader.Serialize(buffer[:])
+	fs.wal.AddRecord(bitmapOffset, fs.buddy.BlockAllocationBitmap())
+	fs.wal.AddRecord(bitmapOffset+int64(len(fs.buddy.BlockAllocationBitmap())), fs.pageChecksums)
+	fs.wal.AddRecord(fileHeader.FileHeaderCopyOffset(), buffer[:])
+	fileHeaderSlotIndex := (fs.fileHeaderSlotIndex + 1) % numberOfFileHeaderSlots
+	fs.wal.AddRecord(int64(fileHeaderSlotIndex*fileHeaderSlotSize), buffer[:])
+
+	if err := fs.wal.Commit(fs.spaceMapper.File); err != nil {
+		return err
+	}
+
+	fs.dirtyPages.ClearChanged()
+	fs.fileHeaderSlotIndex = fileHeaderSlotIndex
+	fs.fileHeaderSequenceNumber = fileHeader.SequenceNumber
+	fs.setBitmapRange(bitmapOffset, bitmapEnd)
 	return nil
 }
 
+// refreshPageChecksums brings the page checksums up to date with the
+// space for the given file header to commit, recomputing the checksums
+// of the given dirty pages and of the pages newly used only.
+func (fs *FileStorage) refreshPageChecksums(fileHeader *fileHeader, dirtyPageIndexes []int) {
+	spaceAccessor := fs.spaceMapper.AccessSpace()
+	oldNumberOfPages := fs.pageChecksums.NumberOfPages()
+	numberOfPages := fs.buddy.UsedSpaceSize() / pageSize
+	fs.pageChecksums = fs.pageChecksums.Resize(numberOfPages)
+
+	for _, i := range dirtyPageIndexes {
+		if i < oldNumberOfPages && i < numberOfPages {
+			fs.pageChecksums.Update(i, spaceAccessor)
+		}
+	}
+
+	for i := oldNumberOfPages; i < numberOfPages; i++ {
+		fs.pageChecksums.Update(i, spaceAccessor)
+	}
+
+	fileHeader.PageChecksumsSize = int64(len(fs.pageChecksums))
+	fileHeader.PageChecksumsChecksum = crc32.Checksum(fs.pageChecksums, crc32cTable)
+}
+
+// placeBitmap sets the offset of the range of the file to write the block
+// allocation bitmap, the page checksums and the copy of the given file
+// header to, which starts right after the mapped space, so that no space
+// in use or about to be used overlaps it (see moveBitmapAhead), unless it
+// overlaps the range committed last time, which must stay intact until
+// the file header referring to it gets replaced, in which case it starts
+// right after the range committed last time instead.
+func (fs *FileStorage) placeBitmap(fileHeader *fileHeader) {
+	fileHeader.BlockAllocationBitmapOffset = int64(fileHeaderSize + fs.buddy.MappedSpaceSize())
+
+	if fileHeader.BlockAllocationBitmapOffset < fs.bitmapEnd && fileHeader.BitmapEnd() > fs.bitmapOffset {
+		fileHeader.BlockAllocationBitmapOffset = fs.bitmapEnd
+	}
+}
+
+// moveBitmapAhead is called before the used space grows to the given size,
+// see buddy.Builder.SetUsedSpaceGuard. If the used space is to overlap the
+// range holding the block allocation bitmap and the page checksums committed
+// last time, which the space handed out would then overwrite before the next
+// commit, the range is copied right after the mapped space and the file
+// header is committed once again to refer to the copy. The write-ahead log
+// needs no moving, as changes to the space never reach the file until
+// committed along with the file header.
+func (fs *FileStorage) moveBitmapAhead(usedSpaceSize int) error {
+	if fs.spaceMapper.Private || int64(fileHeaderSize+usedSpaceSize) <= fs.bitmapOffset {
+		return nil
+	}
+
+	// the file header committed last time is taken from the file, which
+	// may be newer than the one known in shared mode after a rollback
+	buffer := [fileHeaderSize]byte{}
+
+	if _, err := fs.spaceMapper.File.ReadAt(buffer[:], 0); err != nil {
+		return err
+	}
+
+	fileHeader, fileHeaderSlotIndex, err := loadFileHeader(buffer[:])
+
+	if err != nil {
+		return err
+	}
+
+	blockAllocationBitmap := make([]byte, fileHeader.BlockAllocationBitmapSize+fileHeader.PageChecksumsSize)
+
+	if _, err := fs.spaceMapper.File.ReadAt(blockAllocationBitmap, fileHeader.BlockAllocationBitmapOffset); err != nil {
+		return err
+	}
+
+	pageChecksums := blockAllocationBitmap[fileHeader.BlockAllocationBitmapSize:]
+	blockAllocationBitmap = blockAllocationBitmap[:fileHeader.BlockAllocationBitmapSize]
+
+	if fileHeader.Flags&fileHeaderLegacy != 0 {
+		fileHeader.Flags &^= fileHeaderLegacy
+		fileHeader.BlockAllocationBitmapChecksum = crc32.Checksum(blockAllocationBitmap, crc32cTable)
+	}
+
+	bitmapEnd := fileHeader.BitmapEnd()
+	fileHeader.SequenceNumber++
+	fileHeader.BlockAllocationBitmapOffset = int64(fileHeaderSize + fs.buddy.MappedSpaceSize())
+
+	if fileHeader.BlockAllocationBitmapOffset < bitmapEnd {
+		fileHeader.BlockAllocationBitmapOffset = bitmapEnd
+	}
+
+	fs.fileHeaderSlotIndex = fileHeaderSlotIndex
+	return fs.writeFileHeader(&fileHeader, blockAllocationBitmap, pageChecksums, true)
+}
+
+// setBitmapRange sets the range of the file holding the block allocation
+// bitmap and the page checksums committed, which the file never shrinks
+// into.
+func (fs *FileStorage) setBitmapRange(bitmapOffset int64, bitmapEnd int64) {
+	fs.bitmapOffset = bitmapOffset
+	fs.bitmapEnd = bitmapEnd
+	fs.spaceMapper.MinFileSize = bitmapEnd
+}
+
+// syncFile waits for the changes to the file to reach the storage
+// device unless the sync policy is SyncNever.
+func (fs *FileStorage) syncFile() error {
+	if fs.options.SyncPolicy == SyncNever {
+		return nil
+	}
+
+	return fs.spaceMapper.File.Sync()
+}
+
+func (fs *FileStorage) calculateFileSize() int64 {
+	fileSize := fileHeaderSize + fs.buddy.MappedSpaceSize()
+
+	if fileSize2 := int(fs.bitmapEnd); fileSize2 > fileSize {
+		fileSize = fileSize2
+	}
+
+	return int64(fileSize)
+}
+
+// OpenOptions represents the options for opening file storages.
+type OpenOptions struct {
+	// CreateFileIfNotExists indicates whether to create the file
+	// if it does not exist.
+	CreateFileIfNotExists bool
+
+	// UseWAL indicates whether to journal changes through a write-ahead
+	// log file (the file name plus suffix ".wal"). With the write-ahead
+	// log, changes to the space, including allocations, frees and writes
+	// to accessors, never reach the file until Sync or Close commits them
+	// atomically, so that a crash always leaves the file storage as of
+	// the last commit.
+	UseWAL bool
+
+	// AllowUncleanShutdown indicates whether to open the file storage
+	// even if it was not closed cleanly last time (and was not open with
+	// the write-ahead log), trusting the allocation state committed last
+	// time. Otherwise ErrUncleanShutdown is returned for that case.
+	AllowUncleanShutdown bool
+
+	// Recover indicates whether to rebuild the allocation state, for when
+	// the file header or the block allocation bitmap is lost or damaged,
+	// or the file storage was not closed cleanly. The block allocation
+	// bitmap committed last time is used if it is intact, found through
+	// the file header or a copy of it kept after the bitmap, and pooled
+	// blocks allocated since then are taken back, while the other space
+	// allocated since then is lost. Otherwise the space is scanned: pooled
+	// blocks are recognized, while the rest of the space in use is kept
+	// allocated as blocks as large as alignment allows, so freeing these
+	// blocks may release other spaces in them, and the primary space is
+	// lost if no file header is valid. Either way, the chunk lists of
+	// pooled blocks are validated and rebuilt.
+	Recover bool
+
+	// UsePageChecksums indicates whether to maintain a checksum for each
+	// page of the space in use, which is updated on Sync and Close for
+	// the pages changed or accessed since, and verified by Scrub, so that
+	// bit rot of the data in spaces can be detected.
+	UsePageChecksums bool
+
+	// ReadOnly indicates whether to open the file storage in read-only
+	// mode, where the file is never modified: the space is mapped
+	// read-only (writing to accessors crashes the process), allocations,
+	// frees, SetPrimarySpace and Sync fail with ErrReadOnly, and Close
+	// commits nothing. The write-ahead log is not replayed, so opening
+	// fails with ErrUncleanShutdown if there is a committed log left to
+	// replay. The options for creating, changing and recovering the file
+	// storage are not applicable.
+	ReadOnly bool
+
+	// FileMode is the permission bits of the file if created,
+	// 0666 (before umask) if zero.
+	FileMode os.FileMode
+
+	// LockTimeout is how long to wait for the file to be unlocked by
+	// other processes. The file is locked exclusively, or shared in
+	// read-only mode, until the file storage is closed, so that processes
+	// never open the same file storage except in read-only mode or with
+	// shared file storages (see SharedFileStorage). Opening fails with
+	// ErrLocked immediately if zero.
+	LockTimeout time.Duration
+
+	// NoLock indicates whether to skip locking the file, e.g. on file
+	// systems not supporting locks, in which case processes opening the
+	// same file storage must be coordinated by other means.
+	NoLock bool
+
+	// InitialSize is the space size mapped, and the file extended
+	// to, at least, so that no remapping happens until the used
+	// space size exceeds it. It is rounded up to a multiple of 4KiB.
+	InitialSize int
+
+	// MaxSize is the maximum used space size, beyond which allocating
+	// space fails with ErrNoSpace. It is rounded down to a multiple of
+	// 4KiB. Zero means unlimited.
+	MaxSize int
+
+	// MmapAdvice is the advice given to the operating system about the
+	// pattern of accessing the space mapped.
+	MmapAdvice MmapAdvice
+
+	// GrowthPolicy determines how much space to map as the used space
+	// grows, ExponentialGrowth if nil.
+	GrowthPolicy GrowthPolicy
+
+	// SyncPolicy determines whether committing changes waits for them
+	// to reach the storage device.
+	SyncPolicy SyncPolicy
+
+	// StableAccessors indicates whether to reserve an address range of
+	// MaxSize (1TiB if zero) up front and map the space in place within
+	// it, so that accessors are never *INVALIDATED* by allocations or
+	// frees, but only by freeing the spaces they access, rolling back the
+	// transactions they are got in, or closing the file storage. It is not
+	// supported on Windows and 32-bit platforms.
+	StableAccessors bool
+
+	// MinSpaceAlignment is the alignment of space allocated with
+	// AllocateSpace and ReallocateSpace at least, which must be a power
+	// of two no more than 4KiB, 8 if zero, e.g. 16 for SIMD data.
+	MinSpaceAlignment int
+
+	// NumberOfPoolShards is the number of shards small space is pooled
+	// in, each with a pooled block list of its own, which must be no more
+	// than MaxNumberOfPoolShards, the number persisted in the file (one for
+	// new files) if zero. Sync file storages allocate and free small space
+	// in different shards in parallel, see SyncFileStorage.
+	NumberOfPoolShards int
+}
+
+// MaxNumberOfPoolShards is the maximum value of OpenOptions.NumberOfPoolShards.
+const MaxNumberOfPoolShards = pool.MaxNumberOfShards
+
+// maxSpaceSize returns the maximum used space size, zero means unlimited.
+func (oo *OpenOptions) maxSpaceSize() int {
+	if oo.MaxSize < 1 {
+		if oo.StableAccessors {
+			return defaultReservedSpaceSize
+		}
+
+		return 0
+	}
+
+	if maxSpaceSize := oo.MaxSize &^ (buddy.MinBlockSize - 1); maxSpaceSize >= 1 {
+		return maxSpaceSize
+	}
+
+	return buddy.MinBlockSize
+}
+
+const (
+	defaultReservedSpaceSize = 1 << 40
+	maxMinSpaceAlignment     = 4096
+)
+
+// MmapAdvice represents an advice about the pattern of accessing the space mapped.
+type MmapAdvice int
+
+const (
+	// MmapAdviceDefault leaves the advice to the platform default, which
+	// is MmapAdviceRandom on Linux and MmapAdviceNormal elsewhere.
+	MmapAdviceDefault MmapAdvice = iota
+
+	// MmapAdviceNormal indicates no particular pattern.
+	MmapAdviceNormal
+
+	// MmapAdviceRandom indicates random access, so that little read-ahead
+	// is performed.
+	MmapAdviceRandom
+
+	// MmapAdviceSequential indicates sequential access, so that aggressive
+	// read-ahead is performed.
+	MmapAdviceSequential
+
+	// MmapAdviceWillNeed indicates the space will be accessed soon, so that
+	// it is read ahead right away.
+	MmapAdviceWillNeed
+)
+
+// GrowthPolicy returns the space size to map for the given used space size,
+// which is no less than the used space size. The result is rounded up to a
+// multiple of 4KiB.
+type GrowthPolicy func(usedSpaceSize int) (mappedSpaceSize int)
+
+// ExponentialGrowth is the default growth policy which rounds the used
+// space size up to a power of two, so that remapping happens rarely at
+// the cost of up to half of the space mapped being unused.
+func ExponentialGrowth(usedSpaceSize int) int {
+	mappedSpaceSize := 0
+
+	if usedSpaceSize >= 1 {
+		mappedSpaceSize = 1
+
+		for mappedSpaceSize < usedSpaceSize {
+			mappedSpaceSize *= 2
+		}
+	}
+
+	return mappedSpaceSize
+}
+
+// LinearGrowth returns a growth policy which rounds the used space size
+// up to a multiple of the given increment, so that little of the space
+// mapped is unused at the cost of remapping more often.
+func LinearGrowth(increment int) GrowthPolicy {
+	if increment < pageSize {
+		increment = pageSize
+	}
+
+	return func(usedSpaceSize int) int {
+		return (usedSpaceSize + (increment - 1)) / increment * increment
+	}
+}
+
+// SyncPolicy represents the policy of flushing changes to the storage device.
+type SyncPolicy int
+
+const (
+	// SyncOnCommit indicates that Sync, Commit and Close wait for the
+	// changes to reach the storage device, so that they survive a system
+	// crash or a power failure.
+	SyncOnCommit SyncPolicy = iota
+
+	// SyncNever indicates that changes are left for the operating system
+	// to flush, which is faster but a system crash or a power failure may
+	// lose or tear them. A process crash never does.
+	SyncNever
+)
+
+// ErrUncleanShutdown is returned when opening a file storage which
+// was not closed cleanly last time.
+var ErrUncleanShutdown = errors.New("fsm: unclean shutdown")
+
+var (
+	// ErrInvalidSpace is returned when freeing or accessing an invalid space.
+	ErrInvalidSpace = errors.New("fsm: invalid space")
+
+	// ErrBlockTooLarge is returned when allocating space too large
+	// to allocate from file storages.
+	ErrBlockTooLarge = errors.New("fsm: block too large")
+
+	// ErrInvalidAlignment is returned when allocating space, or opening
+	// file storages (see OpenOptions.MinSpaceAlignment), with an alignment
+	// which is not a power of two or too large.
+	ErrInvalidAlignment = errors.New("fsm: invalid alignment")
+
+	// ErrNoSpace is returned when allocating space beyond the
+	// maximum size (see OpenOptions.MaxSize).
+	ErrNoSpace = errors.New("fsm: no space")
+
+	// ErrStableAccessorsNotSupported is returned when opening file storages
+	// with stable accessors (see OpenOptions.StableAccessors) on platforms
+	// not supported.
+	ErrStableAccessorsNotSupported = errors.New("fsm: stable accessors not supported")
+
+	// ErrInvalidNumberOfPoolShards is returned when opening file storages
+	// with an invalid number of pool shards (see OpenOptions.NumberOfPoolShards).
+	ErrInvalidNumberOfPoolShards = errors.New("fsm: invalid number of pool shards")
+)
+
+// convertError converts the errors from the buddy system
+// and the pool to the errors of file storages.
+func convertError(err error) error {
+	switch err {
+	case buddy.ErrInvalidBlock, pool.ErrInvalidSpace:
+		return ErrInvalidSpace
+	case buddy.ErrBlockTooLarge:
+		return ErrBlockTooLarge
+	case buddy.ErrNoSpace:
+		return ErrNoSpace
+	case pool.ErrInvalidAlignment:
+		return ErrInvalidAlignment
+	default:
+		return err
+	}
+}
+
 // Stats represents the stats about file space management.
 type Stats struct {
 	SpaceSize                 int
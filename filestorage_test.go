@@ -1,11 +1,22 @@
 package fsm_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"math/rand"
 	"os"
+	"os/exec"
+	"strings"
 	"testing"
 	"time"
+	"unsafe"
 
 	"github.com/roy2220/fsm"
 	"github.com/stretchr/testify/assert"
@@ -134,3 +145,1956 @@ func HashKey(k []byte) uint64 {
 
 	return kh
 }
+
+func TestFileStorageTornFileHeader(t *testing.T) {
+	const fn = "./test/tornfileheader.tmp"
+	defer func() { t.Log(os.Remove(fn)) }()
+
+	for _, ps := range []int64{100, 200} {
+		fs := new(fsm.FileStorage).Init()
+
+		if !assert.NoError(t, fs.Open(fn, true)) {
+			t.FailNow()
+		}
+
+		fs.SetPrimarySpace(ps)
+
+		if !assert.NoError(t, fs.Close()) {
+			t.FailNow()
+		}
+	}
+
+	f, err := os.OpenFile(fn, os.O_RDWR, 0)
+
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	// tear the latest file header (in the 1st slot)
+	_, err = f.WriteAt(make([]byte, 64), 64)
+	assert.NoError(t, err)
+	f.Close()
+	fs := new(fsm.FileStorage).Init()
+
+	// the previous file header was committed while opening
+	assert.Equal(t, fsm.ErrUncleanShutdown, fs.Open(fn, false))
+
+	if !assert.NoError(t, fs.OpenWithOptions(fn, fsm.OpenOptions{AllowUncleanShutdown: true})) {
+		t.FailNow()
+	}
+
+	assert.Equal(t, int64(100), fs.PrimarySpace())
+	assert.NoError(t, fs.Close())
+}
+
+func TestFileStorageTornCommit(t *testing.T) {
+	const fn = "./test/torncommit.tmp"
+	defer func() { t.Log(os.Remove(fn)) }()
+	fs := new(fsm.FileStorage).Init()
+
+	if !assert.NoError(t, fs.Open(fn, true)) {
+		t.FailNow()
+	}
+
+	b1, _ := fs.AllocateAlignedSpace(4096)
+	b2, _ := fs.AllocateAlignedSpace(4096)
+	fs.FreeAlignedSpace(b1)
+	fs.SetPrimarySpace(b2)
+
+	if !assert.NoError(t, fs.Sync()) {
+		t.FailNow()
+	}
+
+	data1, err := ioutil.ReadFile(fn)
+
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	// the used space stays the same
+	b3, _ := fs.AllocateAlignedSpace(4096)
+	assert.Equal(t, b1, b3)
+
+	if !assert.NoError(t, fs.Close()) {
+		t.FailNow()
+	}
+
+	data2, err := ioutil.ReadFile(fn)
+
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	// "crash" right before the file header gets written
+	copy(data2, data1[:4096])
+
+	if !assert.NoError(t, ioutil.WriteFile(fn, data2, 0666)) {
+		t.FailNow()
+	}
+
+	if !assert.NoError(t, fs.OpenWithOptions(fn, fsm.OpenOptions{AllowUncleanShutdown: true})) {
+		t.FailNow()
+	}
+
+	assert.Equal(t, b2, fs.PrimarySpace())
+	_, err = fs.TryAccessAlignedSpace(b1)
+	assert.Equal(t, fsm.ErrInvalidSpace, err)
+	assert.True(t, fs.Verify().OK())
+	assert.NoError(t, fs.Close())
+}
+
+func TestFileStorageLegacyFileHeader(t *testing.T) {
+	const fn = "./test/legacy_file_header.tmp"
+	defer func() { t.Log(os.Remove(fn)) }()
+	f, err := os.Open("./testdata/baseline.fsm.gz")
+
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	data, err := ioutil.ReadAll(r)
+
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	if !assert.NoError(t, ioutil.WriteFile(fn, data, 0666)) {
+		t.FailNow()
+	}
+
+	// the file was written with a single file header (see testdata),
+	// and gets upgraded on open
+	for i := 0; i < 2; i++ {
+		fs := new(fsm.FileStorage).Init()
+
+		if !assert.NoError(t, fs.Open(fn, false)) {
+			t.FailNow()
+		}
+
+		assert.True(t, fs.Verify().OK())
+		buf := fs.AccessSpace(fs.PrimarySpace())
+
+		if !assert.Len(t, buf, 8*103) {
+			t.FailNow()
+		}
+
+		for j := 0; j < 103; j++ {
+			s := int64(binary.BigEndian.Uint64(buf[8*j:]))
+
+			switch {
+			case j >= 100:
+				assert.True(t, bytes.HasPrefix(fs.AccessAlignedSpace(s), []byte(fmt.Sprintf("aligned space %d", j-100))))
+			case j%3 == 0:
+				assert.Equal(t, int64(-1), s)
+			default:
+				assert.True(t, bytes.HasPrefix(fs.AccessSpace(s), []byte(fmt.Sprintf("space %d", j))))
+			}
+		}
+
+		s, _ := fs.AllocateSpace(100)
+		fs.FreeSpace(s)
+		assert.NoError(t, fs.Close())
+	}
+}
+
+func TestFileStorageSync(t *testing.T) {
+	const fn = "./test/sync.tmp"
+	defer func() { t.Log(os.Remove(fn)) }()
+	fs := new(fsm.FileStorage).Init()
+
+	// the file is opened again while open, as if the process crashed
+	if !assert.NoError(t, fs.OpenWithOptions(fn, fsm.OpenOptions{CreateFileIfNotExists: true, NoLock: true})) {
+		t.FailNow()
+	}
+
+	s, buf := fs.AllocateSpace(100)
+	copy(buf, "hello")
+	fs.SetPrimarySpace(s)
+
+	if !assert.NoError(t, fs.Sync()) {
+		t.FailNow()
+	}
+
+	fs2 := new(fsm.FileStorage).Init()
+	err := fs2.Open(fn, false)
+	assert.Equal(t, fsm.ErrUncleanShutdown, err)
+
+	if !assert.NoError(t, fs2.OpenWithOptions(fn, fsm.OpenOptions{AllowUncleanShutdown: true})) {
+		t.FailNow()
+	}
+
+	assert.Equal(t, s, fs2.PrimarySpace())
+	assert.Equal(t, "hello", string(fs2.AccessSpace(s)[:5]))
+	assert.NoError(t, fs2.Close())
+	s2, _ := fs.AllocateSpace(100)
+	fs.FreeSpace(s2)
+	assert.NoError(t, fs.Close())
+}
+
+func TestFileStorageGrowAfterSync(t *testing.T) {
+	const fn = "./test/grow_after_sync.tmp"
+	defer func() { t.Log(os.Remove(fn)) }()
+	fs := new(fsm.FileStorage).Init()
+
+	// the file is opened again while open, as if the process crashed
+	if !assert.NoError(t, fs.OpenWithOptions(fn, fsm.OpenOptions{CreateFileIfNotExists: true, NoLock: true})) {
+		t.FailNow()
+	}
+
+	s, buf := fs.AllocateSpace(100)
+	copy(buf, "hello")
+	fs.SetPrimarySpace(s)
+
+	if !assert.NoError(t, fs.Sync()) {
+		t.FailNow()
+	}
+
+	// the used space grows over where the block allocation bitmap
+	// would be right after the used space
+	usedSpaceSize := fs.Stats().UsedSpaceSize
+
+	for fs.Stats().UsedSpaceSize < 4*usedSpaceSize {
+		_, buf := fs.AllocateAlignedSpace(4096)
+
+		for i := range buf {
+			buf[i] = 0xFF
+		}
+	}
+
+	fs2 := new(fsm.FileStorage).Init()
+
+	if !assert.NoError(t, fs2.OpenWithOptions(fn, fsm.OpenOptions{AllowUncleanShutdown: true})) {
+		t.FailNow()
+	}
+
+	assert.Equal(t, s, fs2.PrimarySpace())
+	assert.Equal(t, "hello", string(fs2.AccessSpace(s)[:5]))
+	assert.Equal(t, usedSpaceSize, fs2.Stats().UsedSpaceSize)
+	assert.True(t, fs2.Verify().OK())
+	assert.NoError(t, fs2.Close())
+	assert.NoError(t, fs.Close())
+}
+
+func TestFileStorageWAL(t *testing.T) {
+	const fn = "./test/wal.tmp"
+	defer func() { t.Log(os.Remove(fn)) }()
+	opts := fsm.OpenOptions{CreateFileIfNotExists: true, UseWAL: true}
+	fs := new(fsm.FileStorage).Init()
+
+	// the file is opened again while open, as if the process crashed
+	if !assert.NoError(t, fs.OpenWithOptions(fn, fsm.OpenOptions{CreateFileIfNotExists: true, FileMode: 0600, UseWAL: true, NoLock: true})) {
+		t.FailNow()
+	}
+
+	fi, err := os.Stat(fn + ".wal")
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	s, buf := fs.AllocateSpace(100)
+	copy(buf, "hello")
+	fs.SetPrimarySpace(s)
+
+	if !assert.NoError(t, fs.Sync()) {
+		t.FailNow()
+	}
+
+	st := fs.Stats()
+
+	// make changes without committing them and then "crash"
+	copy(fs.AccessSpace(s), "world")
+
+	for i := 0; i < 1000; i++ {
+		fs.AllocateSpace(Rand.Intn(10000))
+	}
+
+	fs.SetPrimarySpace(-1)
+
+	// leave some garbage in the log
+	err = ioutil.WriteFile(fn+".wal", []byte("garbage"), 0666)
+	assert.NoError(t, err)
+	fs2 := new(fsm.FileStorage).Init()
+
+	if !assert.NoError(t, fs2.OpenWithOptions(fn, opts)) {
+		t.FailNow()
+	}
+
+	assert.Equal(t, s, fs2.PrimarySpace())
+	assert.Equal(t, "hello", string(fs2.AccessSpace(s)[:5]))
+	assert.Equal(t, st.AllocatedSpaceSize, fs2.Stats().AllocatedSpaceSize)
+	copy(fs2.AccessSpace(s), "world")
+
+	for i := 0; i < 1000; i++ {
+		fs2.AllocateSpace(Rand.Intn(10000))
+	}
+
+	assert.NoError(t, fs2.Close())
+	fs3 := new(fsm.FileStorage).Init()
+
+	if !assert.NoError(t, fs3.Open(fn, false)) {
+		t.FailNow()
+	}
+
+	assert.Equal(t, "world", string(fs3.AccessSpace(s)[:5]))
+	assert.NoError(t, fs3.Close())
+}
+
+func TestFileStorageTransaction(t *testing.T) {
+	const fn = "./test/transaction.tmp"
+	defer func() { t.Log(os.Remove(fn)) }()
+	fs := new(fsm.FileStorage).Init()
+
+	if !assert.NoError(t, fs.Open(fn, true)) {
+		t.FailNow()
+	}
+
+	assert.Equal(t, fsm.ErrWALRequired, fs.Begin())
+	assert.NoError(t, fs.Close())
+	fs = new(fsm.FileStorage).Init()
+
+	if !assert.NoError(t, fs.OpenWithOptions(fn, fsm.OpenOptions{UseWAL: true})) {
+		t.FailNow()
+	}
+
+	assert.Equal(t, fsm.ErrNoTransaction, fs.Commit())
+	assert.NoError(t, fs.Begin())
+	assert.Equal(t, fsm.ErrTransactionInProgress, fs.Begin())
+	s, buf := fs.AllocateSpace(100)
+	copy(buf, "hello")
+	fs.SetPrimarySpace(s)
+	assert.NoError(t, fs.Commit())
+	st := fs.Stats()
+	assert.NoError(t, fs.Begin())
+	copy(fs.AccessSpace(s), "world")
+	fs.FreeSpace(s)
+
+	for i := 0; i < 1000; i++ {
+		fs.AllocateSpace(Rand.Intn(10000))
+	}
+
+	fs.SetPrimarySpace(-1)
+	assert.NoError(t, fs.Rollback())
+	assert.Equal(t, st, fs.Stats())
+	assert.Equal(t, s, fs.PrimarySpace())
+	assert.Equal(t, "hello", string(fs.AccessSpace(s)[:5]))
+	assert.NoError(t, fs.Close())
+}
+
+func TestFileStorageRecover(t *testing.T) {
+	const fn = "./test/recover.tmp"
+	defer func() { t.Log(os.Remove(fn)) }()
+	fs := new(fsm.FileStorage).Init()
+
+	if !assert.NoError(t, fs.Open(fn, true)) {
+		t.FailNow()
+	}
+
+	es := make([]Entry, 10000)
+
+	for i := range es {
+		es[i] = MakeEntry(fs)
+
+		if i%2 == 1 {
+			j := rand.Intn(i)
+			fs.FreeSpace(es[j].KeyPtr)
+			es[j] = MakeEntry(fs)
+		}
+	}
+
+	as, buf := fs.AllocateAlignedSpace(100000)
+	copy(buf, "hello")
+	st := fs.Stats()
+	assert.NoError(t, fs.Close())
+
+	// lose the file headers
+	f, err := os.OpenFile(fn, os.O_RDWR, 0)
+
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	_, err = f.WriteAt(make([]byte, 4096), 0)
+	assert.NoError(t, err)
+	f.Close()
+	fs = new(fsm.FileStorage).Init()
+	assert.Error(t, fs.Open(fn, false))
+	fs = new(fsm.FileStorage).Init()
+
+	if !assert.NoError(t, fs.OpenWithOptions(fn, fsm.OpenOptions{Recover: true})) {
+		t.FailNow()
+	}
+
+	st2 := fs.Stats()
+	assert.GreaterOrEqual(t, st2.AllocatedSpaceSize, st.AllocatedSpaceSize)
+	assert.Equal(t, int64(-1), fs.PrimarySpace())
+	assert.Equal(t, "hello", string(fs.AccessAlignedSpace(as)[:5]))
+
+	for i := 0; i < 10000; i++ {
+		_, buf := fs.AllocateSpace(Rand.Intn(256))
+
+		for j := range buf {
+			buf[j] = 0xFF
+		}
+	}
+
+	for _, e := range es {
+		buf := fs.AccessSpace(e.KeyPtr)
+		assert.Equal(t, e.KeyHash, HashKey(buf[:e.KeySize]))
+		fs.FreeSpace(e.KeyPtr)
+	}
+
+	assert.Equal(t, "hello", string(fs.AccessAlignedSpace(as)[:5]))
+	assert.NoError(t, fs.Close())
+
+	// keep the boundaries of adjacent blocks
+	assert.NoError(t, os.Remove(fn))
+	fs = new(fsm.FileStorage).Init()
+
+	if !assert.NoError(t, fs.Open(fn, true)) {
+		t.FailNow()
+	}
+
+	as1, _ := fs.AllocateAlignedSpace(4096)
+	as2, _ := fs.AllocateAlignedSpace(4096)
+	assert.Equal(t, int64(0), as1)
+	assert.Equal(t, int64(4096), as2)
+	assert.NoError(t, fs.Close())
+
+	for _, losesFileHeaders := range []bool{false, true} {
+		if losesFileHeaders {
+			f, err := os.OpenFile(fn, os.O_RDWR, 0)
+
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+
+			_, err = f.WriteAt(make([]byte, 4096), 0)
+			assert.NoError(t, err)
+			f.Close()
+		}
+
+		fs = new(fsm.FileStorage).Init()
+
+		if !assert.NoError(t, fs.OpenWithOptions(fn, fsm.OpenOptions{Recover: true})) {
+			t.FailNow()
+		}
+
+		for _, as := range []int64{as1, as2} {
+			buf, err := fs.TryAccessAlignedSpace(as)
+
+			if assert.NoError(t, err) {
+				assert.Len(t, buf, 4096)
+			}
+		}
+
+		assert.NoError(t, fs.Close())
+	}
+
+	// take back the pooled blocks allocated since the last commit
+	assert.NoError(t, os.Remove(fn))
+	fs = new(fsm.FileStorage).Init()
+
+	if !assert.NoError(t, fs.Open(fn, true)) {
+		t.FailNow()
+	}
+
+	as1, _ = fs.AllocateAlignedSpace(1 << 20)
+	fs.AllocateAlignedSpace(1 << 20)
+	fs.FreeAlignedSpace(as1)
+	assert.NoError(t, fs.Sync())
+	fh := make([]byte, 4096)
+	f, err = os.OpenFile(fn, os.O_RDWR, 0)
+
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	_, err = f.ReadAt(fh, 0)
+	assert.NoError(t, err)
+	es = es[:1000]
+
+	for i := range es {
+		es[i] = MakeEntry(fs)
+	}
+
+	assert.NoError(t, fs.Close())
+	_, err = f.WriteAt(fh, 0)
+	assert.NoError(t, err)
+	f.Close()
+	fs = new(fsm.FileStorage).Init()
+
+	if !assert.NoError(t, fs.OpenWithOptions(fn, fsm.OpenOptions{Recover: true})) {
+		t.FailNow()
+	}
+
+	for _, e := range es {
+		buf := fs.AccessSpace(e.KeyPtr)
+		assert.Equal(t, e.KeyHash, HashKey(buf[:e.KeySize]))
+		fs.FreeSpace(e.KeyPtr)
+	}
+
+	assert.NoError(t, fs.Close())
+}
+
+func TestFileStorageCorruption(t *testing.T) {
+	const fn = "./test/corruption.tmp"
+	defer func() { t.Log(os.Remove(fn)) }()
+	fs := new(fsm.FileStorage).Init()
+
+	if !assert.NoError(t, fs.Open(fn, true)) {
+		t.FailNow()
+	}
+
+	fs.AllocateSpace(100)
+	assert.NoError(t, fs.Close())
+	f, err := os.OpenFile(fn, os.O_RDWR, 0)
+
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	// flip the bits of the block allocation bitmap, which lies between
+	// the mapped space and the file header copy at the end of the file
+	fi, err := f.Stat()
+
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	buf := make([]byte, fi.Size()-512-int64(4096+fs.Stats().MappedSpaceSize))
+	_, err = f.ReadAt(buf, int64(4096+fs.Stats().MappedSpaceSize))
+	assert.NoError(t, err)
+
+	for i := range buf {
+		buf[i] ^= 0xFF
+	}
+
+	_, err = f.WriteAt(buf, int64(4096+fs.Stats().MappedSpaceSize))
+	assert.NoError(t, err)
+	buf = buf[:1]
+	fs = new(fsm.FileStorage).Init()
+	err = fs.Open(fn, false)
+	assert.True(t, errors.Is(err, fsm.ErrCorrupted))
+
+	if ce, ok := err.(*fsm.CorruptionError); assert.True(t, ok) {
+		assert.Equal(t, "block allocation bitmap", ce.Part)
+	}
+
+	// flip a bit in the file headers
+	for _, o := range []int64{100, 512 + 100} {
+		_, err = f.ReadAt(buf, o)
+		assert.NoError(t, err)
+		buf[0] ^= 1
+		_, err = f.WriteAt(buf, o)
+		assert.NoError(t, err)
+	}
+
+	f.Close()
+	fs = new(fsm.FileStorage).Init()
+	err = fs.Open(fn, false)
+	assert.True(t, errors.Is(err, fsm.ErrCorrupted))
+
+	if ce, ok := err.(*fsm.CorruptionError); assert.True(t, ok) {
+		assert.Equal(t, "file header", ce.Part)
+	}
+}
+
+func TestFileStorageScrub(t *testing.T) {
+	const fn = "./test/scrub.tmp"
+	defer func() { t.Log(os.Remove(fn)) }()
+	fs := new(fsm.FileStorage).Init()
+
+	if !assert.NoError(t, fs.Open(fn, true)) {
+		t.FailNow()
+	}
+
+	_, err := fs.Scrub(context.Background())
+	assert.Equal(t, fsm.ErrNoPageChecksums, err)
+	assert.NoError(t, fs.Close())
+	fs = new(fsm.FileStorage).Init()
+
+	if !assert.NoError(t, fs.OpenWithOptions(fn, fsm.OpenOptions{UsePageChecksums: true})) {
+		t.FailNow()
+	}
+
+	var s int64
+
+	for i := 0; i < 1000; i++ {
+		s, _ = fs.AllocateSpace(1000)
+	}
+
+	as, _ := fs.AllocateAlignedSpace(10000)
+	assert.NoError(t, fs.Sync())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = fs.Scrub(ctx)
+	assert.Equal(t, context.Canceled, err)
+	pcms, err := fs.Scrub(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, pcms, 0)
+	f, err := os.OpenFile(fn, os.O_RDWR, 0)
+
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	// rot the data of spaces
+	for _, o := range []int64{s, as + 5000} {
+		_, err = f.WriteAt([]byte{1, 2, 3}, 4096+o)
+		assert.NoError(t, err)
+	}
+
+	f.Close()
+	pcms, err = fs.Scrub(context.Background())
+	assert.NoError(t, err)
+
+	if assert.Len(t, pcms, 2) {
+		assert.Equal(t, s&^4095, pcms[0].Page)
+		assert.Contains(t, pcms[0].Spaces, s)
+		assert.Equal(t, []int64{as}, pcms[1].Spaces)
+	}
+
+	assert.NoError(t, fs.Close())
+}
+
+func TestFileStorageScrubAfterChanges(t *testing.T) {
+	const fn = "./test/scrub_after_changes.tmp"
+	defer func() { t.Log(os.Remove(fn)) }()
+
+	for _, opts := range []fsm.OpenOptions{
+		{UsePageChecksums: true},
+		{UsePageChecksums: true, StableAccessors: true, MaxSize: 1 << 30},
+		{UsePageChecksums: true, UseWAL: true},
+		{UsePageChecksums: true, NumberOfPoolShards: 4},
+	} {
+		opts.CreateFileIfNotExists = true
+		fs := new(fsm.FileStorage).Init()
+
+		if !assert.NoError(t, fs.OpenWithOptions(fn, opts)) {
+			t.FailNow()
+		}
+
+		var ss []int64
+		var buf []byte
+
+		for i := 0; i < 20; i++ {
+			for j := 0; j < 200; j++ {
+				switch k := Rand.Intn(10); {
+				case k < 4 || len(ss) == 0:
+					var s int64
+					s, buf = fs.AllocateSpace(1 + Rand.Intn(5000))
+					ss = append(ss, s)
+				case k < 5:
+					var s int64
+					s, buf = fs.AllocateAlignedSpace(4096 << uint(Rand.Intn(6)))
+					ss = append(ss, s)
+				case k < 7:
+					n := Rand.Intn(len(ss))
+
+					if err := fs.TryFreeSpace(ss[n]); err != nil {
+						fs.FreeAlignedSpace(ss[n])
+					}
+
+					ss = append(ss[:n], ss[n+1:]...)
+					buf = nil
+				case k < 8:
+					n := Rand.Intn(len(ss))
+
+					if s, buf2, err := fs.TryReallocateSpace(ss[n], 1+Rand.Intn(5000)); err == nil {
+						ss[n], buf = s, buf2
+					}
+				default:
+					n := Rand.Intn(len(ss))
+
+					if buf2, err := fs.TryAccessSpace(ss[n]); err == nil {
+						buf = buf2
+					} else {
+						buf = fs.AccessAlignedSpace(ss[n])
+					}
+				}
+
+				if buf != nil {
+					Rand.Read(buf[Rand.Intn(len(buf)):])
+				}
+			}
+
+			assert.NoError(t, fs.Sync())
+
+			// write through the accessor still valid after the commit
+			if buf != nil {
+				Rand.Read(buf)
+				assert.NoError(t, fs.Sync())
+			}
+
+			pcms, err := fs.Scrub(context.Background())
+			assert.NoError(t, err)
+			assert.Len(t, pcms, 0)
+		}
+
+		assert.NoError(t, fs.Close())
+		fs = new(fsm.FileStorage).Init()
+
+		if !assert.NoError(t, fs.OpenWithOptions(fn, opts)) {
+			t.FailNow()
+		}
+
+		pcms, err := fs.Scrub(context.Background())
+		assert.NoError(t, err)
+		assert.Len(t, pcms, 0)
+		assert.NoError(t, fs.Close())
+		assert.NoError(t, os.Remove(fn))
+	}
+}
+
+func TestFileStorageVerify(t *testing.T) {
+	const fn = "./test/verify.tmp"
+	defer func() { t.Log(os.Remove(fn)) }()
+	fs := new(fsm.FileStorage).Init()
+
+	if !assert.NoError(t, fs.Open(fn, true)) {
+		t.FailNow()
+	}
+
+	var ss []int64
+
+	for i := 0; i < 10000; i++ {
+		s, _ := fs.AllocateSpace(rand.Intn(2000))
+		ss = append(ss, s)
+	}
+
+	as, _ := fs.AllocateAlignedSpace(100000)
+	fs.SetPrimarySpace(as)
+
+	for i := 0; i < len(ss); i += 3 {
+		fs.FreeSpace(ss[i])
+	}
+
+	vr := fs.Verify()
+	assert.True(t, vr.OK(), "%v", vr.Violations)
+	assert.Equal(t, fs.Stats().AllocatedSpaceSize, vr.AllocatedSpaceSize)
+	assert.Equal(t, fs.Stats().DismissedSpaceSize, vr.DismissedSpaceSize)
+	fs.FreeAlignedSpace(as)
+	vr = fs.Verify()
+
+	if assert.Len(t, vr.Violations, 1) {
+		assert.Equal(t, "primary space", vr.Violations[0].Component)
+	}
+
+	// the spaces freed are in pooled blocks still allocated
+	fs.SetPrimarySpace(ss[0])
+	fs.SetRoot("foo", ss[3])
+	fs.SetRoot("bar", ss[1])
+	vr = fs.Verify()
+
+	if assert.Len(t, vr.Violations, 2) {
+		assert.Equal(t, "primary space", vr.Violations[0].Component)
+		assert.Equal(t, "root", vr.Violations[1].Component)
+		assert.Contains(t, vr.Violations[1].Description, `"foo"`)
+	}
+
+	fs.DeleteRoot("foo")
+	fs.DeleteRoot("bar")
+	fs.SetPrimarySpace(-1)
+	assert.NoError(t, fs.Close())
+}
+
+func TestFileStorageTryAPIs(t *testing.T) {
+	const fn = "./test/try_apis.tmp"
+	defer func() { t.Log(os.Remove(fn)) }()
+	fs := new(fsm.FileStorage).Init()
+
+	if !assert.NoError(t, fs.Open(fn, true)) {
+		t.FailNow()
+	}
+
+	s, buf, err := fs.TryAllocateSpace(100)
+	assert.NoError(t, err)
+	assert.Len(t, buf, 104)
+	as, buf, err := fs.TryAllocateAlignedSpace(10000)
+	assert.NoError(t, err)
+	assert.Len(t, buf, 16384)
+	_, _, err = fs.TryAllocateAlignedSpace(1 << 41)
+	assert.Equal(t, fsm.ErrBlockTooLarge, err)
+	assert.Panics(t, func() { fs.AllocateAlignedSpace(1 << 41) })
+
+	for _, s2 := range []int64{-1, s + 1, as + 4096, 1 << 40} {
+		_, err = fs.TryAccessSpace(s2)
+		assert.Equal(t, fsm.ErrInvalidSpace, err)
+		assert.Equal(t, fsm.ErrInvalidSpace, fs.TryFreeSpace(s2))
+		_, err = fs.TryAccessAlignedSpace(s2)
+		assert.Equal(t, fsm.ErrInvalidSpace, err)
+		assert.Equal(t, fsm.ErrInvalidSpace, fs.TryFreeAlignedSpace(s2))
+	}
+
+	assert.NoError(t, fs.TryFreeSpace(s))
+	assert.Equal(t, fsm.ErrInvalidSpace, fs.TryFreeSpace(s))
+	assert.Panics(t, func() { fs.FreeSpace(s) })
+	assert.NoError(t, fs.TryFreeAlignedSpace(as))
+	assert.Equal(t, fsm.ErrInvalidSpace, fs.TryFreeAlignedSpace(as))
+	assert.True(t, fs.Verify().OK())
+	assert.NoError(t, fs.Close())
+}
+
+func TestFileStorageOpenOptions(t *testing.T) {
+	const fn = "./test/open_options.tmp"
+	defer func() { t.Log(os.Remove(fn)) }()
+	fs := new(fsm.FileStorage).Init()
+
+	if !assert.NoError(t, fs.OpenWithOptions(fn, fsm.OpenOptions{
+		CreateFileIfNotExists: true,
+		FileMode:              0600,
+		InitialSize:           10000,
+		MaxSize:               4 << 20,
+		MmapAdvice:            fsm.MmapAdviceSequential,
+		GrowthPolicy:          fsm.LinearGrowth(1 << 20),
+		SyncPolicy:            fsm.SyncNever,
+	})) {
+		t.FailNow()
+	}
+
+	fi, err := os.Stat(fn)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	assert.Equal(t, 12288, fs.Stats().MappedSpaceSize)
+	fs.AllocateSpace(100)
+	assert.Equal(t, 1<<20, fs.Stats().MappedSpaceSize)
+	as, _ := fs.AllocateAlignedSpace(2 << 20)
+	assert.Equal(t, 4<<20, fs.Stats().MappedSpaceSize)
+	_, _, err = fs.TryAllocateAlignedSpace(2 << 20)
+	assert.Equal(t, fsm.ErrNoSpace, err)
+	assert.True(t, fs.Verify().OK())
+	fs.FreeAlignedSpace(as)
+	assert.Equal(t, 1<<20, fs.Stats().MappedSpaceSize)
+	assert.NoError(t, fs.Close())
+	fs = new(fsm.FileStorage).Init()
+
+	if !assert.NoError(t, fs.OpenWithOptions(fn, fsm.OpenOptions{InitialSize: 8 << 20})) {
+		t.FailNow()
+	}
+
+	assert.Equal(t, 8<<20, fs.Stats().MappedSpaceSize)
+	assert.Equal(t, 1<<20, fs.Stats().UsedSpaceSize)
+	assert.NoError(t, fs.Close())
+}
+
+func TestFileStorageReadOnly(t *testing.T) {
+	const fn = "./test/read_only.tmp"
+	defer func() { t.Log(os.Remove(fn)) }()
+	fs := new(fsm.FileStorage).Init()
+	err := fs.OpenWithOptions(fn, fsm.OpenOptions{CreateFileIfNotExists: true, ReadOnly: true})
+	assert.True(t, os.IsNotExist(err))
+
+	if !assert.NoError(t, fs.Open(fn, true)) {
+		t.FailNow()
+	}
+
+	s, buf := fs.AllocateSpace(5)
+	copy(buf, "hello")
+	fs.SetPrimarySpace(s)
+	assert.NoError(t, fs.Close())
+	fi, err := os.Stat(fn)
+	assert.NoError(t, err)
+	fs = new(fsm.FileStorage).Init()
+
+	if !assert.NoError(t, fs.OpenWithOptions(fn, fsm.OpenOptions{ReadOnly: true})) {
+		t.FailNow()
+	}
+
+	assert.Equal(t, s, fs.PrimarySpace())
+	assert.Equal(t, "hello", string(fs.AccessSpace(s)[:5]))
+	_, _, err = fs.TryAllocateSpace(100)
+	assert.Equal(t, fsm.ErrReadOnly, err)
+	_, _, err = fs.TryAllocateAlignedSpace(100)
+	assert.Equal(t, fsm.ErrReadOnly, err)
+	assert.Equal(t, fsm.ErrReadOnly, fs.TryFreeSpace(s))
+	assert.Equal(t, fsm.ErrReadOnly, fs.TryFreeAlignedSpace(0))
+	assert.Equal(t, fsm.ErrReadOnly, fs.TrySetPrimarySpace(-1))
+	assert.Panics(t, func() { fs.SetPrimarySpace(-1) })
+	assert.Equal(t, fsm.ErrReadOnly, fs.Sync())
+	assert.Equal(t, fsm.ErrReadOnly, fs.Begin())
+	assert.True(t, fs.Verify().OK())
+	assert.NoError(t, fs.Close())
+	fi2, err := os.Stat(fn)
+	assert.NoError(t, err)
+	assert.Equal(t, fi.Size(), fi2.Size())
+	assert.Equal(t, fi.ModTime(), fi2.ModTime())
+	fs = new(fsm.FileStorage).Init()
+	assert.Equal(t, fsm.ErrReadOnly, fs.OpenWithOptions(fn, fsm.OpenOptions{ReadOnly: true, Recover: true}))
+}
+
+func TestFileStorageStableAccessors(t *testing.T) {
+	const fn = "./test/stable_accessors.tmp"
+	defer func() { t.Log(os.Remove(fn)) }()
+
+	for _, useWAL := range []bool{false, true} {
+		fs := new(fsm.FileStorage).Init()
+
+		if !assert.NoError(t, fs.OpenWithOptions(fn, fsm.OpenOptions{
+			CreateFileIfNotExists: true,
+			UseWAL:                useWAL,
+			MaxSize:               1 << 30,
+			StableAccessors:       true,
+		})) {
+			t.FailNow()
+		}
+
+		s, buf := fs.AllocateSpace(5)
+		copy(buf, "hello")
+		var ss []int64
+
+		for i := 0; i < 100; i++ {
+			s2, _ := fs.AllocateAlignedSpace(1 << 20)
+			ss = append(ss, s2)
+		}
+
+		assert.Equal(t, 128<<20, fs.Stats().MappedSpaceSize)
+		copy(buf, "world")
+		assert.Equal(t, "world", string(fs.AccessSpace(s)[:5]))
+
+		for _, s2 := range ss {
+			fs.FreeAlignedSpace(s2)
+		}
+
+		assert.Equal(t, 1<<20, fs.Stats().MappedSpaceSize)
+		copy(buf, "hello")
+		_, _, err := fs.TryAllocateAlignedSpace(1 << 30)
+		assert.Equal(t, fsm.ErrNoSpace, err)
+
+		if useWAL {
+			assert.NoError(t, fs.Begin())
+			copy(buf, "world")
+			fs.AllocateAlignedSpace(64 << 20)
+			assert.NoError(t, fs.Rollback())
+			assert.Equal(t, "hello", string(buf[:5]))
+		}
+
+		fs.FreeSpace(s)
+		assert.True(t, fs.Verify().OK())
+		assert.NoError(t, fs.Close())
+	}
+}
+
+func TestFileStorageReallocateSpace(t *testing.T) {
+	const fn = "./test/reallocate_space.tmp"
+	defer func() { t.Log(os.Remove(fn)) }()
+	fs := new(fsm.FileStorage).Init()
+
+	if !assert.NoError(t, fs.Open(fn, true)) {
+		t.FailNow()
+	}
+
+	s, buf := fs.AllocateSpace(5)
+	copy(buf, "hello")
+	s2, buf := fs.ReallocateSpace(s, 10)
+	assert.Equal(t, s, s2)
+	assert.Equal(t, "hello", string(buf[:5]))
+	fs.AllocateSpace(100)
+
+	for _, ss := range []int{200, 100000, 1000000, 100000, 300, 1} {
+		s2, buf = fs.ReallocateSpace(s2, ss)
+		assert.GreaterOrEqual(t, len(buf), ss)
+
+		if ss >= 5 {
+			assert.Equal(t, "hello", string(buf[:5]))
+		}
+	}
+
+	assert.Equal(t, "h", string(buf[:1]))
+	_, _, err := fs.TryReallocateSpace(s2+1, 100)
+	assert.Equal(t, fsm.ErrInvalidSpace, err)
+	_, _, err = fs.TryReallocateSpace(s2, 1<<41)
+	assert.Equal(t, fsm.ErrBlockTooLarge, err)
+	fs.FreeSpace(s2)
+	assert.True(t, fs.Verify().OK())
+	assert.NoError(t, fs.Close())
+}
+
+func TestFileStorageHugeSpace(t *testing.T) {
+	const fn = "./test/huge_space.tmp"
+	defer func() { t.Log(os.Remove(fn)) }()
+	fs := new(fsm.FileStorage).Init()
+
+	if !assert.NoError(t, fs.Open(fn, true)) {
+		t.FailNow()
+	}
+
+	s0, _ := fs.AllocateSpace(100)
+	const ss = 1<<32 + 1<<30
+	s, buf := fs.AllocateSpace(ss)
+
+	if !assert.Len(t, buf, 2<<32) {
+		t.FailNow()
+	}
+
+	copy(buf, "hello")
+	copy(buf[ss-5:], "world")
+	fs.SetPrimarySpace(s)
+	assert.True(t, fs.Verify().OK())
+	assert.NoError(t, fs.Close())
+
+	fs = new(fsm.FileStorage).Init()
+
+	if !assert.NoError(t, fs.Open(fn, false)) {
+		t.FailNow()
+	}
+
+	buf = fs.AccessSpace(fs.PrimarySpace())
+
+	if assert.Len(t, buf, 2<<32) {
+		assert.Equal(t, "hello", string(buf[:5]))
+		assert.Equal(t, "world", string(buf[ss-5:ss]))
+	}
+
+	_, err := fs.TryAccessSpace(s + 1<<32)
+	assert.Equal(t, fsm.ErrInvalidSpace, err)
+	s2, buf := fs.ReallocateSpace(s, 1<<33+1)
+	assert.Equal(t, s, s2)
+
+	if assert.Len(t, buf, 3<<32) {
+		assert.Equal(t, "world", string(buf[ss-5:ss]))
+	}
+
+	fs.SetPrimarySpace(-1)
+	fs.FreeSpace(s2)
+	fs.FreeSpace(s0)
+	assert.True(t, fs.Verify().OK())
+	assert.Equal(t, 0, fs.Stats().UsedSpaceSize)
+	assert.NoError(t, fs.Close())
+}
+
+func TestFileStorageAllocateSpaceAligned(t *testing.T) {
+	const fn = "./test/allocate_space_aligned.tmp"
+	defer func() { t.Log(os.Remove(fn)) }()
+	fs := new(fsm.FileStorage).Init()
+
+	if !assert.NoError(t, fs.Open(fn, true)) {
+		t.FailNow()
+	}
+
+	var ss []int64
+
+	for _, a := range []int{16, 32, 64, 512, 4096, 1 << 20} {
+		for i := 0; i < 10; i++ {
+			s, buf := fs.AllocateSpaceAligned(100*i, a)
+			assert.Equal(t, int64(0), s%int64(a))
+			assert.GreaterOrEqual(t, len(buf), 100*i)
+			assert.Len(t, fs.AccessSpace(s), len(buf))
+			ss = append(ss, s)
+
+			if a < 4096 {
+				assert.Equal(t, 1<<20, fs.Stats().AllocatedSpaceSize)
+			}
+		}
+	}
+
+	_, _, err := fs.TryAllocateSpaceAligned(100, 24)
+	assert.Equal(t, fsm.ErrInvalidAlignment, err)
+	assert.Panics(t, func() { fs.AllocateSpaceAligned(100, 0) })
+	assert.True(t, fs.Verify().OK())
+
+	for _, s := range ss {
+		fs.FreeSpace(s)
+	}
+
+	assert.Equal(t, 0, fs.Stats().AllocatedSpaceSize)
+	assert.NoError(t, fs.Close())
+}
+
+func TestFileStorageMinSpaceAlignment(t *testing.T) {
+	const fn = "./test/min_space_alignment.tmp"
+	defer func() { t.Log(os.Remove(fn)) }()
+	fs := new(fsm.FileStorage).Init()
+	err := fs.OpenWithOptions(fn, fsm.OpenOptions{CreateFileIfNotExists: true, MinSpaceAlignment: 24})
+	assert.Equal(t, fsm.ErrInvalidAlignment, err)
+
+	for _, a := range []int{0, 16} {
+		fs = new(fsm.FileStorage).Init()
+
+		if !assert.NoError(t, fs.OpenWithOptions(fn, fsm.OpenOptions{CreateFileIfNotExists: true, UseWAL: true, MinSpaceAlignment: a})) {
+			t.FailNow()
+		}
+
+		assert.NoError(t, fs.Begin())
+		fs.AllocateSpace(1)
+		assert.NoError(t, fs.Rollback())
+
+		if a == 0 {
+			a = 8
+		}
+
+		var ss []int64
+
+		for i := 0; i < 1000; i++ {
+			s, buf := fs.AllocateSpace(rand.Intn(100))
+
+			if i%3 == 0 {
+				s, buf = fs.ReallocateSpace(s, rand.Intn(200))
+			}
+
+			assert.Equal(t, int64(0), s%int64(a))
+			assert.Equal(t, uintptr(0), uintptr(unsafe.Pointer(&buf[0]))%uintptr(a))
+			ss = append(ss, s)
+		}
+
+		assert.True(t, fs.Verify().OK())
+
+		for _, s := range ss {
+			fs.FreeSpace(s)
+		}
+
+		assert.NoError(t, fs.Close())
+	}
+}
+
+func TestFileStorageAllocateSpaces(t *testing.T) {
+	const fn = "./test/allocate_spaces.tmp"
+	defer func() { t.Log(os.Remove(fn)) }()
+	fs := new(fsm.FileStorage).Init()
+
+	if !assert.NoError(t, fs.Open(fn, true)) {
+		t.FailNow()
+	}
+
+	sss := make([]int, 100000)
+
+	for i := range sss {
+		sss[i] = 10 + rand.Intn(100)
+	}
+
+	ss := fs.AllocateSpaces(sss)
+
+	for i, s := range ss {
+		buf := fs.AccessSpace(s)
+		assert.GreaterOrEqual(t, len(buf), sss[i])
+		binary.BigEndian.PutUint64(buf, uint64(i))
+	}
+
+	_, err := fs.TryAllocateSpaces([]int{100, 1 << 41})
+	assert.Equal(t, fsm.ErrBlockTooLarge, err)
+	assert.Equal(t, fsm.ErrInvalidSpace, fs.TryFreeSpaces([]int64{ss[0], ss[0]}))
+
+	for i, s := range ss {
+		assert.Equal(t, uint64(i), binary.BigEndian.Uint64(fs.AccessSpace(s)))
+	}
+
+	assert.True(t, fs.Verify().OK())
+	fs.FreeSpaces(ss)
+	assert.Equal(t, 0, fs.Stats().AllocatedSpaceSize)
+	assert.NoError(t, fs.Close())
+}
+
+func TestFileStorageAllocateZeroedSpace(t *testing.T) {
+	const fn = "./test/allocate_zeroed_space.tmp"
+	defer func() { t.Log(os.Remove(fn)) }()
+	fs := new(fsm.FileStorage).Init()
+
+	if !assert.NoError(t, fs.Open(fn, true)) {
+		t.FailNow()
+	}
+
+	_, buf := fs.AllocateZeroedAlignedSpace(1 << 20)
+	assert.Equal(t, make([]byte, len(buf)), buf)
+	_, buf = fs.AllocateZeroedAlignedSpace(1 << 19)
+	assert.Equal(t, make([]byte, len(buf)), buf)
+	b, buf := fs.AllocateZeroedAlignedSpace(1 << 19)
+	assert.Equal(t, make([]byte, len(buf)), buf)
+
+	for i := range buf {
+		buf[i] = 0xFF
+	}
+
+	// the block freed is beyond the used space but remains in the file
+	fs.FreeAlignedSpace(b)
+	assert.NoError(t, fs.Close())
+	fs = new(fsm.FileStorage).Init()
+
+	if !assert.NoError(t, fs.Open(fn, false)) {
+		t.FailNow()
+	}
+
+	b2, buf := fs.AllocateZeroedAlignedSpace(1 << 19)
+	assert.Equal(t, b, b2)
+	assert.Equal(t, make([]byte, len(buf)), buf)
+	ss := make([]int64, 1000)
+
+	for i := range ss {
+		ss[i], buf = fs.AllocateZeroedSpace(1 + rand.Intn(1000))
+		assert.Equal(t, make([]byte, len(buf)), buf)
+
+		for j := range buf {
+			buf[j] = 0xFF
+		}
+	}
+
+	rand.Shuffle(len(ss), func(i, j int) { ss[i], ss[j] = ss[j], ss[i] })
+
+	for i := range ss {
+		fs.FreeSpace(ss[i])
+		ss[i], buf = fs.AllocateZeroedSpace(1 + rand.Intn(1000))
+		assert.Equal(t, make([]byte, len(buf)), buf)
+	}
+
+	assert.True(t, fs.Verify().OK())
+	assert.NoError(t, fs.Close())
+}
+
+func TestFileStorageOpenSpace(t *testing.T) {
+	const fn = "./test/open_space.tmp"
+	defer func() { t.Log(os.Remove(fn)) }()
+	fs := new(fsm.FileStorage).Init()
+
+	if !assert.NoError(t, fs.Open(fn, true)) {
+		t.FailNow()
+	}
+
+	m := map[string]int{"foo": 1, "bar": 2}
+	s, _ := fs.AllocateSpace(1000)
+	sf := fs.OpenSpace(s)
+	assert.Equal(t, s, sf.Space())
+	assert.NoError(t, gob.NewEncoder(sf).Encode(m))
+
+	// the space file stays valid across remaps
+	for i := 0; i < 1000; i++ {
+		fs.AllocateSpace(10000)
+	}
+
+	n, err := sf.Seek(0, io.SeekStart)
+	assert.Equal(t, int64(0), n)
+	assert.NoError(t, err)
+	var m2 map[string]int
+	assert.NoError(t, gob.NewDecoder(sf).Decode(&m2))
+	assert.Equal(t, m, m2)
+
+	s2, _ := fs.AllocateSpace(1000)
+	sf2 := fs.OpenSpace(s2)
+	sf.Seek(0, io.SeekStart)
+	n, err = io.Copy(sf2, sf)
+	assert.Equal(t, int64(len(fs.AccessSpace(s))), n)
+	assert.NoError(t, err)
+	assert.Equal(t, fs.AccessSpace(s), fs.AccessSpace(s2))
+
+	size, err := sf.Size()
+	assert.Equal(t, int64(len(fs.AccessSpace(s))), size)
+	assert.NoError(t, err)
+	n, err = sf.Seek(-10, io.SeekEnd)
+	assert.Equal(t, size-10, n)
+	assert.NoError(t, err)
+	n2, err := sf.Write(make([]byte, 20))
+	assert.Equal(t, 10, n2)
+	assert.Equal(t, io.ErrShortWrite, err)
+	n2, err = sf.Read(make([]byte, 10))
+	assert.Equal(t, 0, n2)
+	assert.Equal(t, io.EOF, err)
+	_, err = sf.Seek(-1, io.SeekStart)
+	assert.Equal(t, fsm.ErrInvalidOffset, err)
+
+	buf := make([]byte, 20)
+	n2, err = sf.ReadAt(buf, size-10)
+	assert.Equal(t, 10, n2)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, make([]byte, 20), buf)
+	n2, err = sf.WriteAt([]byte("hello"), 5)
+	assert.Equal(t, 5, n2)
+	assert.NoError(t, err)
+	var w bytes.Buffer
+	sf.Seek(5, io.SeekStart)
+	n, err = sf.WriteTo(&w)
+	assert.Equal(t, size-5, n)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", w.String()[:5])
+
+	fs.FreeSpace(s)
+	_, err = sf.ReadAt(buf, 0)
+	assert.Equal(t, fsm.ErrInvalidSpace, err)
+	_, err = fs.TryOpenSpace(s)
+	assert.Equal(t, fsm.ErrInvalidSpace, err)
+	assert.NoError(t, fs.Close())
+}
+
+func TestFileStorageRoots(t *testing.T) {
+	const fn = "./test/roots.tmp"
+	defer func() { t.Log(os.Remove(fn)) }()
+	fs := new(fsm.FileStorage).Init()
+
+	if !assert.NoError(t, fs.OpenWithOptions(fn, fsm.OpenOptions{CreateFileIfNotExists: true, UseWAL: true})) {
+		t.FailNow()
+	}
+
+	roots := map[string]int64{}
+
+	for i := 0; i < 1000; i++ {
+		s, _ := fs.AllocateSpace(100)
+		name := string(rune('a'+i%26)) + string(rune('a'+i/26))
+		fs.SetRoot(name, s)
+		roots[name] = s
+	}
+
+	fs.SetPrimarySpace(roots["aa"])
+	s, ok := fs.Root("")
+	assert.True(t, ok)
+	assert.Equal(t, roots["aa"], s)
+	fs.DeleteRoot("")
+	assert.Equal(t, int64(-1), fs.PrimarySpace())
+	fs.SetRoot("", roots["ab"])
+	assert.Equal(t, roots["ab"], fs.PrimarySpace())
+	roots[""] = roots["ab"]
+	assert.Equal(t, fsm.ErrInvalidSpace, fs.TrySetRoot("foo", -1))
+	assert.Equal(t, roots, fs.Roots())
+	assert.True(t, fs.Verify().OK())
+
+	assert.NoError(t, fs.Begin())
+	fs.DeleteRoot("ba")
+	fs.SetRoot("bb", roots["aa"])
+	fs.SetRoot("foo", roots["aa"])
+	_, ok = fs.Root("ba")
+	assert.False(t, ok)
+	assert.NoError(t, fs.Rollback())
+	assert.Equal(t, roots, fs.Roots())
+	assert.True(t, fs.Verify().OK())
+	assert.NoError(t, fs.Close())
+
+	fs = new(fsm.FileStorage).Init()
+
+	if !assert.NoError(t, fs.OpenWithOptions(fn, fsm.OpenOptions{ReadOnly: true})) {
+		t.FailNow()
+	}
+
+	assert.Equal(t, roots, fs.Roots())
+	assert.Equal(t, fsm.ErrReadOnly, fs.TrySetRoot("foo", roots["aa"]))
+	assert.Equal(t, fsm.ErrReadOnly, fs.TryDeleteRoot("aa"))
+	assert.NoError(t, fs.Close())
+
+	fs = new(fsm.FileStorage).Init()
+
+	if !assert.NoError(t, fs.OpenWithOptions(fn, fsm.OpenOptions{Recover: true})) {
+		t.FailNow()
+	}
+
+	assert.Equal(t, roots, fs.Roots())
+	assert.True(t, fs.Verify().OK())
+
+	for name := range roots {
+		fs.DeleteRoot(name)
+		delete(roots, name)
+
+		if len(roots)%100 == 0 {
+			assert.Equal(t, roots, fs.Roots())
+		}
+	}
+
+	allocatedSpaceSize := fs.Stats().AllocatedSpaceSize
+	assert.NoError(t, fs.Close())
+
+	fs = new(fsm.FileStorage).Init()
+
+	if !assert.NoError(t, fs.Open(fn, false)) {
+		t.FailNow()
+	}
+
+	assert.Len(t, fs.Roots(), 0)
+	assert.Equal(t, allocatedSpaceSize, fs.Stats().AllocatedSpaceSize)
+	assert.NoError(t, fs.Close())
+}
+
+func TestSyncFileStorage(t *testing.T) {
+	const fn = "./test/sync_file_storage.tmp"
+	defer func() { t.Log(os.Remove(fn)) }()
+	sfs := new(fsm.SyncFileStorage).Init()
+
+	if !assert.NoError(t, sfs.Open(fn, true)) {
+		t.FailNow()
+	}
+
+	const numberOfGoroutines = 8
+	const numberOfSpaces = 10000
+	sss := make([][]int64, numberOfGoroutines)
+	errs := make(chan error, numberOfGoroutines)
+
+	for i := range sss {
+		i := i
+
+		go func() {
+			ss := make([]int64, numberOfSpaces)
+
+			for j := range ss {
+				if j%2 == 0 {
+					ss[j] = sfs.AllocateSpace(8 + rand.Intn(100))
+					l := sfs.AcquireLease()
+					binary.BigEndian.PutUint64(l.AccessSpace(ss[j]), uint64(i*numberOfSpaces+j))
+					l.Release()
+				} else {
+					err := sfs.Update(func(fs *fsm.FileStorage) error {
+						s, buf, err := fs.TryAllocateSpace(8 + rand.Intn(100))
+
+						if err != nil {
+							return err
+						}
+
+						binary.BigEndian.PutUint64(buf, uint64(i*numberOfSpaces+j))
+						ss[j] = s
+						return nil
+					})
+
+					if err != nil {
+						errs <- err
+						return
+					}
+				}
+
+				if j%100 == 99 {
+					l := sfs.AcquireLease()
+
+					for k, s := range ss[:j+1] {
+						if v := binary.BigEndian.Uint64(l.AccessSpace(s)); v != uint64(i*numberOfSpaces+k) {
+							l.Release()
+							errs <- fmt.Errorf("value mismatch: %d != %d", v, i*numberOfSpaces+k)
+							return
+						}
+					}
+
+					l.Release()
+				}
+			}
+
+			sss[i] = ss
+			errs <- nil
+		}()
+	}
+
+	for range sss {
+		assert.NoError(t, <-errs)
+	}
+
+	assert.NoError(t, sfs.Update(func(fs *fsm.FileStorage) error {
+		assert.True(t, fs.Verify().OK())
+		return nil
+	}))
+
+	for _, ss := range sss {
+		for _, s := range ss {
+			sfs.FreeSpace(s)
+		}
+	}
+
+	assert.Equal(t, 0, sfs.Stats().AllocatedSpaceSize)
+	assert.NoError(t, sfs.Close())
+}
+
+func TestFileStoragePoolShards(t *testing.T) {
+	const fn = "./test/pool_shards.tmp"
+	defer func() { t.Log(os.Remove(fn)) }()
+
+	for _, n := range []int{-1, fsm.MaxNumberOfPoolShards + 1} {
+		err := new(fsm.FileStorage).Init().OpenWithOptions(fn, fsm.OpenOptions{CreateFileIfNotExists: true, NumberOfPoolShards: n})
+		assert.Equal(t, fsm.ErrInvalidNumberOfPoolShards, err)
+	}
+
+	fs := new(fsm.FileStorage).Init()
+
+	if !assert.NoError(t, fs.OpenWithOptions(fn, fsm.OpenOptions{CreateFileIfNotExists: true, NumberOfPoolShards: 4})) {
+		t.FailNow()
+	}
+
+	ss := make([]int64, 20000)
+
+	for i := range ss {
+		s, buf := fs.AllocateSpace(8 + rand.Intn(100))
+		binary.BigEndian.PutUint64(buf, uint64(i))
+		ss[i] = s
+	}
+
+	for i := range ss {
+		if i%3 == 0 {
+			fs.FreeSpace(ss[i])
+			ss[i] = -1
+		}
+	}
+
+	assert.True(t, fs.Verify().OK())
+	assert.NoError(t, fs.Close())
+
+	for _, options := range []fsm.OpenOptions{
+		{},
+		{UseWAL: true, NumberOfPoolShards: 2},
+		{ReadOnly: true, NumberOfPoolShards: 16},
+		{NumberOfPoolShards: 1},
+		{UseWAL: true},
+	} {
+		fs = new(fsm.FileStorage).Init()
+
+		if !assert.NoError(t, fs.OpenWithOptions(fn, options)) {
+			t.FailNow()
+		}
+
+		if !assert.True(t, fs.Verify().OK(), "%+v", fs.Verify().Violations) {
+			t.FailNow()
+		}
+
+		for i, s := range ss {
+			if s >= 0 {
+				assert.Equal(t, uint64(i), binary.BigEndian.Uint64(fs.AccessSpace(s)))
+			}
+		}
+
+		if !options.ReadOnly {
+			for i := range ss {
+				if rand.Intn(4) != 0 {
+					continue
+				}
+
+				if ss[i] >= 0 {
+					fs.FreeSpace(ss[i])
+					ss[i] = -1
+				} else {
+					s, buf := fs.AllocateSpace(8 + rand.Intn(100))
+					binary.BigEndian.PutUint64(buf, uint64(i))
+					ss[i] = s
+				}
+			}
+
+			assert.True(t, fs.Verify().OK())
+		}
+
+		assert.NoError(t, fs.Close())
+	}
+}
+
+func TestSyncFileStorageArenas(t *testing.T) {
+	const fn = "./test/sync_file_storage_arenas.tmp"
+	defer func() { t.Log(os.Remove(fn)) }()
+	sfs := new(fsm.SyncFileStorage).Init()
+
+	if !assert.NoError(t, sfs.OpenWithOptions(fn, fsm.OpenOptions{CreateFileIfNotExists: true, NumberOfPoolShards: 8})) {
+		t.FailNow()
+	}
+
+	const numberOfGoroutines = 8
+	const numberOfSpaces = 10000
+	errs := make(chan error, numberOfGoroutines)
+
+	for i := 0; i < numberOfGoroutines; i++ {
+		i := i
+
+		go func() {
+			a := sfs.NewArena()
+			ss := make([]int64, numberOfSpaces)
+
+			for j := range ss {
+				ss[j] = a.AllocateSpace(8 + rand.Intn(100))
+				l := sfs.AcquireLease()
+				binary.BigEndian.PutUint64(l.AccessSpace(ss[j]), uint64(i*numberOfSpaces+j))
+				l.Release()
+
+				if j%3 == 2 {
+					k := rand.Intn(j)
+
+					if ss[k] >= 0 {
+						sfs.FreeSpace(ss[k])
+						ss[k] = -1
+					}
+				}
+			}
+
+			l := sfs.AcquireLease()
+
+			for j, s := range ss {
+				if s < 0 {
+					continue
+				}
+
+				if v := binary.BigEndian.Uint64(l.AccessSpace(s)); v != uint64(i*numberOfSpaces+j) {
+					l.Release()
+					errs <- fmt.Errorf("value mismatch: %d != %d", v, i*numberOfSpaces+j)
+					return
+				}
+			}
+
+			l.Release()
+
+			for _, s := range ss {
+				if s >= 0 {
+					sfs.FreeSpace(s)
+				}
+			}
+
+			errs <- nil
+		}()
+	}
+
+	for i := 0; i < numberOfGoroutines; i++ {
+		assert.NoError(t, <-errs)
+	}
+
+	ss := sfs.NewArena().AllocateSpaces([]int{100, 200, 100000, 300})
+	_, err := sfs.NewArena().TryAllocateSpaces([]int{100, 1 << 41})
+	assert.Equal(t, fsm.ErrBlockTooLarge, err)
+	assert.NoError(t, sfs.Update(func(fs *fsm.FileStorage) error {
+		assert.True(t, fs.Verify().OK())
+		fs.FreeSpaces(ss)
+		return nil
+	}))
+
+	assert.Equal(t, 0, sfs.Stats().AllocatedSpaceSize)
+	assert.NoError(t, sfs.Close())
+}
+
+func TestFileStorageLock(t *testing.T) {
+	const fn = "./test/lock.tmp"
+	defer func() { t.Log(os.Remove(fn)) }()
+	fs := new(fsm.FileStorage).Init()
+
+	if !assert.NoError(t, fs.Open(fn, true)) {
+		t.FailNow()
+	}
+
+	fs2 := new(fsm.FileStorage).Init()
+	assert.Equal(t, fsm.ErrLocked, fs2.Open(fn, false))
+	assert.Equal(t, fsm.ErrLocked, fs2.OpenWithOptions(fn, fsm.OpenOptions{ReadOnly: true}))
+	t0 := time.Now()
+	assert.Equal(t, fsm.ErrLocked, fs2.OpenWithOptions(fn, fsm.OpenOptions{LockTimeout: 50 * time.Millisecond}))
+	assert.GreaterOrEqual(t, int64(time.Since(t0)), int64(50*time.Millisecond))
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		assert.NoError(t, fs.Close())
+	}()
+
+	if !assert.NoError(t, fs2.OpenWithOptions(fn, fsm.OpenOptions{LockTimeout: 10 * time.Second})) {
+		t.FailNow()
+	}
+
+	assert.NoError(t, fs2.Close())
+	fs3 := new(fsm.FileStorage).Init()
+
+	for _, fs := range []*fsm.FileStorage{fs, fs2} {
+		if !assert.NoError(t, fs.OpenWithOptions(fn, fsm.OpenOptions{ReadOnly: true})) {
+			t.FailNow()
+		}
+	}
+
+	assert.Equal(t, fsm.ErrLocked, fs3.Open(fn, false))
+
+	for _, fs := range []*fsm.FileStorage{fs, fs2} {
+		assert.NoError(t, fs.Close())
+	}
+
+	if !assert.NoError(t, fs3.Open(fn, false)) {
+		t.FailNow()
+	}
+
+	assert.NoError(t, fs3.Close())
+	// a file created but not yet initialized by another process
+	assert.NoError(t, os.Truncate(fn, 0))
+	assert.Equal(t, fsm.ErrLocked, fs3.OpenWithOptions(fn, fsm.OpenOptions{ReadOnly: true, LockTimeout: 10 * time.Millisecond}))
+
+	if !assert.NoError(t, fs3.Open(fn, false)) {
+		t.FailNow()
+	}
+
+	assert.Equal(t, 0, fs3.Stats().UsedSpaceSize)
+	assert.NoError(t, fs3.Close())
+
+	if !assert.NoError(t, fs3.OpenWithOptions(fn, fsm.OpenOptions{ReadOnly: true})) {
+		t.FailNow()
+	}
+
+	assert.NoError(t, fs3.Close())
+}
+
+func TestSharedFileStorage(t *testing.T) {
+	const fn = "./test/shared_file_storage.tmp"
+	defer func() { t.Log(os.Remove(fn)) }()
+	err := new(fsm.SharedFileStorage).Init().OpenWithOptions(fn, fsm.OpenOptions{CreateFileIfNotExists: true, UseWAL: true})
+	assert.Equal(t, fsm.ErrSharedNotSupported, err)
+	sfss := []*fsm.SharedFileStorage{new(fsm.SharedFileStorage).Init(), new(fsm.SharedFileStorage).Init()}
+
+	for _, sfs := range sfss {
+		if !assert.NoError(t, sfs.Open(fn, true)) {
+			t.FailNow()
+		}
+	}
+
+	assert.Equal(t, fsm.ErrLocked, new(fsm.FileStorage).Init().Open(fn, false))
+	assert.Equal(t, fsm.ErrUncleanShutdown, new(fsm.FileStorage).Init().OpenWithOptions(fn, fsm.OpenOptions{ReadOnly: true}))
+	ss := map[int64]uint64{}
+
+	for i := 0; i < 10000; i++ {
+		sfs := sfss[rand.Intn(len(sfss))]
+
+		if len(ss) >= 1 && rand.Intn(3) == 0 {
+			for s, v := range ss {
+				if !assert.Equal(t, v, binary.BigEndian.Uint64(sfs.AccessSpace(s))) {
+					t.FailNow()
+				}
+
+				sfs.FreeSpace(s)
+				delete(ss, s)
+				break
+			}
+
+			continue
+		}
+
+		spaceSize := 8 + rand.Intn(100)
+
+		if i%100 == 0 {
+			spaceSize = 100000 + rand.Intn(100000)
+		}
+
+		s, buf := sfs.AllocateSpace(spaceSize)
+		binary.BigEndian.PutUint64(buf, uint64(i))
+		ss[s] = uint64(i)
+	}
+
+	var stats []fsm.Stats
+
+	for _, sfs := range sfss {
+		assert.NoError(t, sfs.View(func(fs *fsm.FileStorage) error {
+			assert.True(t, fs.Verify().OK())
+			stats = append(stats, fs.Stats())
+			_, _, err := fs.TryAllocateSpace(100)
+			assert.Equal(t, fsm.ErrReadOnly, err)
+			return nil
+		}))
+	}
+
+	assert.Equal(t, stats[0], stats[1])
+
+	err = sfss[0].Update(func(fs *fsm.FileStorage) error {
+		spaceSizes := make([]int, 100000)
+
+		for i := range spaceSizes {
+			spaceSizes[i] = 8 + rand.Intn(100)
+		}
+
+		_, err := fs.TryAllocateSpaces(spaceSizes)
+		return err
+	})
+
+	assert.Equal(t, fsm.ErrChangeTooLarge, err)
+
+	assert.NoError(t, sfss[1].View(func(fs *fsm.FileStorage) error {
+		assert.True(t, fs.Verify().OK())
+		assert.Equal(t, stats[1], fs.Stats())
+		return nil
+	}))
+
+	s, buf := sfss[0].AllocateSpace(100)
+	copy(buf, "hello")
+
+	assert.NoError(t, sfss[0].Update(func(fs *fsm.FileStorage) error {
+		return fs.TrySetRoot("greeting", s)
+	}))
+
+	assert.NoError(t, sfss[0].Close())
+
+	assert.NoError(t, sfss[1].View(func(fs *fsm.FileStorage) error {
+		s2, ok := fs.Root("greeting")
+		assert.True(t, ok)
+		assert.Equal(t, s, s2)
+		assert.Equal(t, "hello", string(fs.AccessSpace(s2)[:5]))
+		return nil
+	}))
+
+	// the file storage gets reopened and joins the other one
+	if !assert.NoError(t, sfss[0].Open(fn, false)) {
+		t.FailNow()
+	}
+
+	assert.NoError(t, sfss[1].Close())
+
+	assert.NoError(t, sfss[0].View(func(fs *fsm.FileStorage) error {
+		assert.True(t, fs.Verify().OK())
+		s2, _ := fs.Root("greeting")
+		assert.Equal(t, s, s2)
+		return nil
+	}))
+
+	assert.NoError(t, sfss[0].Close())
+	fs := new(fsm.FileStorage).Init()
+
+	if !assert.NoError(t, fs.Open(fn, false)) {
+		t.FailNow()
+	}
+
+	assert.True(t, fs.Verify().OK())
+
+	for s, v := range ss {
+		assert.Equal(t, v, binary.BigEndian.Uint64(fs.AccessSpace(s)))
+	}
+
+	assert.NoError(t, fs.Close())
+}
+
+func TestSharedFileStorageProcesses(t *testing.T) {
+	const fn = "./test/shared_file_storage_processes.tmp"
+	defer func() { t.Log(os.Remove(fn)) }()
+	sfs := new(fsm.SharedFileStorage).Init()
+
+	if !assert.NoError(t, sfs.Open(fn, true)) {
+		t.FailNow()
+	}
+
+	const numberOfChildren = 4
+	cmds := make([]*exec.Cmd, numberOfChildren)
+
+	for i := range cmds {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestSharedFileStorageChild$")
+		cmd.Env = append(os.Environ(), fmt.Sprintf("FSM_SHARED_CHILD=%s:%d", fn, i))
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+
+		if !assert.NoError(t, cmd.Start()) {
+			t.FailNow()
+		}
+
+		cmds[i] = cmd
+	}
+
+	ss := make([]int64, 1000)
+
+	for i := range ss {
+		s, buf := sfs.AllocateSpace(8 + rand.Intn(100))
+		binary.BigEndian.PutUint64(buf, uint64(i))
+		ss[i] = s
+	}
+
+	// the first child gets killed, often in the middle of a change,
+	// once it's busy allocating and freeing space
+	for {
+		var ok bool
+
+		assert.NoError(t, sfs.View(func(fs *fsm.FileStorage) error {
+			_, ok = fs.Root("child0")
+			return nil
+		}))
+
+		if ok {
+			break
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	assert.NoError(t, cmds[0].Process.Kill())
+
+	for i, cmd := range cmds {
+		err := cmd.Wait()
+
+		if i == 0 {
+			assert.Error(t, err)
+		} else {
+			assert.NoError(t, err)
+		}
+	}
+
+	assert.NoError(t, sfs.View(func(fs *fsm.FileStorage) error {
+		assert.True(t, fs.Verify().OK())
+
+		for i, s := range ss {
+			assert.Equal(t, uint64(i), binary.BigEndian.Uint64(fs.AccessSpace(s)))
+		}
+
+		for i := 1; i < numberOfChildren; i++ {
+			r, ok := fs.Root(fmt.Sprintf("child%d", i))
+
+			if !assert.True(t, ok) {
+				continue
+			}
+
+			buf := fs.AccessSpace(r)
+
+			for j := 0; j < int(binary.BigEndian.Uint32(buf)); j++ {
+				s := int64(binary.BigEndian.Uint64(buf[4+j*8:]))
+				assert.Equal(t, uint64(i<<32|j), binary.BigEndian.Uint64(fs.AccessSpace(s)))
+			}
+		}
+
+		return nil
+	}))
+
+	assert.NoError(t, sfs.Close())
+}
+
+func TestSharedFileStorageChild(t *testing.T) {
+	env := os.Getenv("FSM_SHARED_CHILD")
+
+	if env == "" {
+		t.Skip("run by TestSharedFileStorageProcesses")
+	}
+
+	var fn string
+	var i int
+	_, err := fmt.Sscanf(strings.Replace(env, ":", " ", -1), "%s %d", &fn, &i)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sfs := new(fsm.SharedFileStorage).Init()
+
+	if err := sfs.Open(fn, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if i == 0 {
+		if err := sfs.Update(func(fs *fsm.FileStorage) error {
+			return fs.TrySetRoot("child0", 0)
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		// allocate and free space until killed
+		for {
+			var ss []int64
+
+			for j := 0; j < 100; j++ {
+				s, _ := sfs.AllocateSpace(8 + rand.Intn(100000))
+				ss = append(ss, s)
+			}
+
+			for _, s := range ss {
+				sfs.FreeSpace(s)
+			}
+		}
+	}
+
+	var ss []int64
+
+	for j := 0; j < 2000; j++ {
+		if len(ss) >= 1 && rand.Intn(3) == 0 {
+			k := rand.Intn(len(ss))
+			sfs.FreeSpace(ss[k])
+			ss[k] = ss[len(ss)-1]
+			ss = ss[:len(ss)-1]
+			continue
+		}
+
+		s, _ := sfs.AllocateSpace(8 + rand.Intn(1000))
+		ss = append(ss, s)
+	}
+
+	r, buf := sfs.AllocateSpace(4 + len(ss)*8)
+	binary.BigEndian.PutUint32(buf, uint32(len(ss)))
+
+	for j, s := range ss {
+		binary.BigEndian.PutUint64(buf[4+j*8:], uint64(s))
+		binary.BigEndian.PutUint64(sfs.AccessSpace(s), uint64(i<<32|j))
+		buf = sfs.AccessSpace(r)
+	}
+
+	if err := sfs.Update(func(fs *fsm.FileStorage) error {
+		return fs.TrySetRoot(fmt.Sprintf("child%d", i), r)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sfs.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
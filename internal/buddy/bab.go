@@ -2,6 +2,10 @@ package buddy
 
 const blockAllocationSubBitmapSize = (((1 << (maxBlockSizeShift - minBlockSizeShift + 1)) - 1) + 7) >> 3
 
+// continuationBitPos is the position of the spare last bit of sub-bitmaps,
+// which is set if the max block of the sub-bitmap continues a huge block.
+const continuationBitPos = blockAllocationSubBitmapSize<<3 - 1
+
 type blockAllocationBitmap []uint8
 
 func (bab *blockAllocationBitmap) Expand() {
@@ -27,6 +31,26 @@ func (bab blockAllocationBitmap) GetBlockSize(block int64) (int, bool) {
 	return sub.GetBlockSize(subBlock)
 }
 
+func (bab blockAllocationBitmap) IsFreeBlock(block int64, blockSizeShift int) bool {
+	sub, subBlock := bab.getSub(block)
+	return sub.IsFreeBlock(subBlock, blockSizeShift)
+}
+
+func (bab blockAllocationBitmap) SetContinued(block int64, continued bool) {
+	sub, _ := bab.getSub(block)
+
+	if continued {
+		sub.setBit(continuationBitPos)
+	} else {
+		sub.clearBit(continuationBitPos)
+	}
+}
+
+func (bab blockAllocationBitmap) IsContinued(block int64) bool {
+	sub, _ := bab.getSub(block)
+	return sub.testBit(continuationBitPos)
+}
+
 func (bab blockAllocationBitmap) GetFreeBlocks(callback func(int64, int)) {
 	block := int64(0)
 
@@ -41,6 +65,20 @@ func (bab blockAllocationBitmap) GetFreeBlocks(callback func(int64, int)) {
 	}
 }
 
+func (bab blockAllocationBitmap) GetAllocatedBlocks(callback func(int64, int)) {
+	block := int64(0)
+
+	for i := 0; i < len(bab); i += blockAllocationSubBitmapSize {
+		sub := blockAllocationSubBitmap(bab[i : i+blockAllocationSubBitmapSize])
+
+		sub.GetAllocatedBlocks(func(subBlock int64, blockSizeShift int) {
+			callback(block|subBlock, blockSizeShift)
+		})
+
+		block += MaxBlockSize
+	}
+}
+
 func (bab blockAllocationBitmap) getSub(block int64) (blockAllocationSubBitmap, int64) {
 	i := (block >> maxBlockSizeShift) * blockAllocationSubBitmapSize
 	sub := blockAllocationSubBitmap(bab[i : i+blockAllocationSubBitmapSize])
@@ -89,10 +127,27 @@ func (basb blockAllocationSubBitmap) GetBlockSize(block int64) (int, bool) {
 	return blockSizeShift, ok
 }
 
+// IsFreeBlock reports whether the given block with the given size is free
+// but it's buddy is not, i.e. the block is one of the free blocks.
+func (basb blockAllocationSubBitmap) IsFreeBlock(block int64, blockSizeShift int) bool {
+	bitPos := locateBit(block, blockSizeShift)
+
+	if basb.testBit(bitPos) {
+		return false
+	}
+
+	siblingBitPos := locateSiblingBit(bitPos)
+	return siblingBitPos < 0 || basb.testBit(siblingBitPos)
+}
+
 func (basb blockAllocationSubBitmap) GetFreeBlocks(callback func(int64, int)) {
 	basb.doGetFreeBlocks(0, maxBlockSizeShift, callback)
 }
 
+func (basb blockAllocationSubBitmap) GetAllocatedBlocks(callback func(int64, int)) {
+	basb.doGetAllocatedBlocks(0, maxBlockSizeShift, callback)
+}
+
 func (basb blockAllocationSubBitmap) doGetBlockSize(block int64) (int, int, bool) {
 	blockSizeShift := minBlockSizeShift
 	bitPos := locateBit(block, blockSizeShift)
@@ -137,6 +192,28 @@ func (basb blockAllocationSubBitmap) doGetFreeBlocks(bitPos int, blockSizeShift
 	basb.doGetFreeBlocks(rightChildBitPos, blockSizeShift-1, callback)
 }
 
+func (basb blockAllocationSubBitmap) doGetAllocatedBlocks(bitPos int, blockSizeShift int, callback func(int64, int)) {
+	if !basb.testBit(bitPos) {
+		return
+	}
+
+	if blockSizeShift == minBlockSizeShift {
+		callback(convertBitPosToBlock(bitPos, blockSizeShift), blockSizeShift)
+		return
+	}
+
+	leftChildBitPos := locateLeftChildBit(bitPos)
+	rightChildBitPos := locateRightSiblingBit(leftChildBitPos)
+
+	if !basb.testBit(leftChildBitPos) && !basb.testBit(rightChildBitPos) {
+		callback(convertBitPosToBlock(bitPos, blockSizeShift), blockSizeShift)
+		return
+	}
+
+	basb.doGetAllocatedBlocks(leftChildBitPos, blockSizeShift-1, callback)
+	basb.doGetAllocatedBlocks(rightChildBitPos, blockSizeShift-1, callback)
+}
+
 func (basb blockAllocationSubBitmap) setBit(bitPos int) {
 	basb[bitPos>>3] |= 1 << (bitPos & 7)
 }
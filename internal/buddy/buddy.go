@@ -3,7 +3,9 @@ package buddy
 
 import (
 	"errors"
+	"math/bits"
 
+	"github.com/roy2220/fsm/internal/list"
 	"github.com/roy2220/fsm/internal/rbtree"
 	"github.com/roy2220/fsm/internal/spacemapper"
 )
@@ -14,6 +16,10 @@ const (
 
 	// MaxBlockSize is the maximum block size of buddy systems.
 	MaxBlockSize = 1 << maxBlockSizeShift
+
+	// MaxHugeBlockSize is the maximum size of huge blocks of buddy systems.
+	// A huge block is a run of contiguous blocks of MaxBlockSize.
+	MaxHugeBlockSize = 1 << 40
 )
 
 // Buddy represents a buddy system.
@@ -21,10 +27,22 @@ type Buddy struct {
 	spaceMapper           spacemapper.SpaceMapper
 	spaceSize             int
 	usedSpaceSize         int
+	dirtySpaceSize        int
 	mappedSpaceSize       int
 	allocatedSpaceSize    int
 	blockAllocationBitmap blockAllocationBitmap
 	rbTreesOfFreeBlocks   [numberOfFreeBlockLists]rbtree.RBTree
+
+	stateIsInSpace  bool
+	freeBlockLists  [numberOfFreeBlockLists - 1]list.List64
+	bitmapBlock     int64
+	bitmapBlockSize int
+	changeListener  func(int64, int)
+
+	minMappedSpaceSize        int
+	maxUsedSpaceSize          int
+	mappedSpaceSizeCalculator func(int) int
+	usedSpaceGuard            func(int) error
 }
 
 // Init initializes the buddy system with the given space mapper and returns it.
@@ -35,6 +53,7 @@ func (b *Buddy) Init(spaceMapper spacemapper.SpaceMapper) *Buddy {
 		b.rbTreesOfFreeBlocks[i].Init()
 	}
 
+	b.stateIsInSpace = false
 	return b
 }
 
@@ -45,35 +64,83 @@ func (b *Buddy) Build() Builder {
 
 // AllocateBlock allocates a block with the given size
 // from the buddy system and returns it and it's actual size.
+// A block larger than MaxBlockSize is allocated as a huge block,
+// whose size is rounded up to a multiple of MaxBlockSize.
 func (b *Buddy) AllocateBlock(blockSize int) (int64, int, error) {
-	if blockSize > MaxBlockSize {
+	if blockSize > MaxHugeBlockSize {
 		return 0, 0, ErrBlockTooLarge
 	}
 
+	numberOfMaxBlocks := 1
+
+	if blockSize > MaxBlockSize {
+		numberOfMaxBlocks = (blockSize + MaxBlockSize - 1) / MaxBlockSize
+	}
+
+	if err := b.reserveBitmapSpace(numberOfMaxBlocks); err != nil {
+		return 0, 0, err
+	}
+
+	return b.allocateBlock(blockSize)
+}
+
+// MustAllocateBlock calls AllocateBlock and panics when an error occurs.
+func (b *Buddy) MustAllocateBlock(blockSize int) (int64, int) {
+	block, blockSize, err := b.AllocateBlock(blockSize)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return block, blockSize
+}
+
+func (b *Buddy) allocateBlock(blockSize int) (int64, int, error) {
+	if blockSize > MaxBlockSize {
+		return b.allocateHugeBlock((blockSize + MaxBlockSize - 1) / MaxBlockSize)
+	}
+
 	freeBlockListIndex := locateFreeBlockList(blockSize)
 	block := b.doAllocateBlock(freeBlockListIndex)
 	blockSizeShift := calculateBlockSizeShift(freeBlockListIndex)
 	blockSize = 1 << blockSizeShift
 	b.allocatedSpaceSize += blockSize
+	b.recordBitmapChange(block, blockSizeShift)
 	b.blockAllocationBitmap.AllocateBlock(block, blockSizeShift)
 
-	if usedSpaceSize := int(block) + blockSize; usedSpaceSize > b.usedSpaceSize {
-		if usedSpaceSize > b.mappedSpaceSize {
-			if err := b.mapSpace(usedSpaceSize); err != nil {
-				b.FreeBlock(block)
-				return 0, 0, err
-			}
+	if err := b.growUsedSpace(int(block) + blockSize); err != nil {
+		b.FreeBlock(block)
+		return 0, 0, err
+	}
+
+	return block, blockSize, nil
+}
+
+// AllocateZeroedBlock is like AllocateBlock but guarantees the block
+// allocated is zeroed. Only the part of the block within the dirty space
+// size is cleared, as the rest has never been used and is already zero.
+func (b *Buddy) AllocateZeroedBlock(blockSize int) (int64, int, error) {
+	dirtySpaceSize := b.dirtySpaceSize
+	block, blockSize, err := b.AllocateBlock(blockSize)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if n := dirtySpaceSize - int(block); n >= 1 {
+		if n > blockSize {
+			n = blockSize
 		}
 
-		b.usedSpaceSize = usedSpaceSize
+		clearBytes(b.spaceMapper.AccessSpace()[block : int(block)+n])
 	}
 
 	return block, blockSize, nil
 }
 
-// MustAllocateBlock calls AllocateBlock and panics when an error occurs.
-func (b *Buddy) MustAllocateBlock(blockSize int) (int64, int) {
-	block, blockSize, err := b.AllocateBlock(blockSize)
+// MustAllocateZeroedBlock calls AllocateZeroedBlock and panics when an error occurs.
+func (b *Buddy) MustAllocateZeroedBlock(blockSize int) (int64, int) {
+	block, blockSize, err := b.AllocateZeroedBlock(blockSize)
 
 	if err != nil {
 		panic(err)
@@ -84,30 +151,46 @@ func (b *Buddy) MustAllocateBlock(blockSize int) (int64, int) {
 
 // FreeBlock releases the given block back to the buddy system.
 func (b *Buddy) FreeBlock(block int64) error {
-	if int(block) >= b.spaceSize {
+	if block < 0 || block&(MinBlockSize-1) != 0 || int(block) >= b.spaceSize {
 		return ErrInvalidBlock
 	}
 
-	blockSizeShift, ok := b.blockAllocationBitmap.FreeBlock(block)
+	blockSizeShift, ok := b.blockAllocationBitmap.GetBlockSize(block)
 
 	if !ok {
 		return ErrInvalidBlock
 	}
 
+	if blockSizeShift == maxBlockSizeShift {
+		numberOfMaxBlocks, ok := b.countMaxBlocks(block)
+
+		if !ok {
+			return ErrInvalidBlock
+		}
+
+		if numberOfMaxBlocks >= 2 {
+			return b.freeMaxBlocks(block, 0, numberOfMaxBlocks)
+		}
+	}
+
 	blockSize := 1 << blockSizeShift
 	shrinkUsedSpace := int(block)+blockSize == b.usedSpaceSize
+	freeBlock := block
 	freeBlockListIndex := calculateFreeBlockListIndex(blockSizeShift)
-	b.doFreeBlock(&block, &freeBlockListIndex)
+	// merge the block before clearing it in the block allocation bitmap,
+	// which tells the free blocks when the state is in the space
+	b.doFreeBlock(&freeBlock, &freeBlockListIndex)
+	b.recordBitmapChange(block, blockSizeShift)
+	b.blockAllocationBitmap.FreeBlock(block)
 	b.allocatedSpaceSize -= blockSize
+	block = freeBlock
 
 	if shrinkUsedSpace {
 		if freeBlockListIndex == numberOfFreeBlockLists-1 {
-			rbTreeOfFreeBlocks := &b.rbTreesOfFreeBlocks[numberOfFreeBlockLists-1]
-
 			for {
 				blockPrev := block - int64(MaxBlockSize)
 
-				if !rbTreeOfFreeBlocks.FindKey(blockPrev) {
+				if !b.findFreeBlock(numberOfFreeBlockLists-1, blockPrev) {
 					break
 				}
 
@@ -118,12 +201,12 @@ func (b *Buddy) FreeBlock(block int64) error {
 		for freeBlockListIndex--; freeBlockListIndex >= 0; freeBlockListIndex-- {
 			blockPrev := block - int64(calculateBlockSize(freeBlockListIndex))
 
-			if b.rbTreesOfFreeBlocks[freeBlockListIndex].FindKey(blockPrev) {
+			if b.findFreeBlock(freeBlockListIndex, blockPrev) {
 				block = blockPrev
 			}
 		}
 
-		b.usedSpaceSize = int(block)
+		b.setUsedSpaceSize(int(block))
 
 		if b.usedSpaceSize < b.mappedSpaceSize/2 {
 			return b.mapSpace(b.usedSpaceSize)
@@ -140,9 +223,86 @@ func (b *Buddy) MustFreeBlock(block int64) {
 	}
 }
 
+// ResizeBlock resizes the given block of the buddy system in place to the
+// given size, returns it's actual size and true, or false if the block
+// can not grow in place, i.e. it's buddies are not free. A huge block
+// grows or shrinks by blocks of MaxBlockSize, and a block smaller than
+// MaxBlockSize never grows into a huge block in place.
+func (b *Buddy) ResizeBlock(block int64, blockSize int) (int, bool, error) {
+	oldBlockSize, err := b.GetBlockSize(block)
+
+	if err != nil {
+		return 0, false, err
+	}
+
+	if blockSize > MaxHugeBlockSize {
+		return 0, false, ErrBlockTooLarge
+	}
+
+	if blockSize > MaxBlockSize || oldBlockSize > MaxBlockSize {
+		if err := b.reserveBitmapSpace((blockSize + MaxBlockSize - 1) / MaxBlockSize); err != nil {
+			return 0, false, err
+		}
+
+		return b.resizeHugeBlock(block, oldBlockSize, blockSize)
+	}
+
+	blockSizeShift := calculateBlockSizeShift(locateFreeBlockList(blockSize))
+	blockSize = 1 << blockSizeShift
+	oldBlockSizeShift := bits.TrailingZeros(uint(oldBlockSize))
+
+	if blockSize == oldBlockSize {
+		return blockSize, true, nil
+	}
+
+	if blockSize > oldBlockSize {
+		if block&int64(blockSize-1) != 0 {
+			return 0, false, nil
+		}
+
+		for blockSizeShift2 := oldBlockSizeShift; blockSizeShift2 < blockSizeShift; blockSizeShift2++ {
+			freeBlockListIndex := calculateFreeBlockListIndex(blockSizeShift2)
+
+			if !b.findFreeBlock(freeBlockListIndex, block+1<<blockSizeShift2) {
+				return 0, false, nil
+			}
+		}
+
+		if err := b.growUsedSpace(int(block) + blockSize); err != nil {
+			return 0, false, err
+		}
+
+		for blockSizeShift2 := oldBlockSizeShift; blockSizeShift2 < blockSizeShift; blockSizeShift2++ {
+			freeBlockListIndex := calculateFreeBlockListIndex(blockSizeShift2)
+			b.deleteFreeBlock(freeBlockListIndex, block+1<<blockSizeShift2)
+		}
+	} else {
+		for blockSizeShift2 := blockSizeShift; blockSizeShift2 < oldBlockSizeShift; blockSizeShift2++ {
+			freeBlockListIndex := calculateFreeBlockListIndex(blockSizeShift2)
+			b.addFreeBlock(freeBlockListIndex, block+1<<blockSizeShift2)
+		}
+	}
+
+	b.recordBitmapChange(block, oldBlockSizeShift)
+	b.blockAllocationBitmap.FreeBlock(block)
+	b.recordBitmapChange(block, blockSizeShift)
+	b.blockAllocationBitmap.AllocateBlock(block, blockSizeShift)
+	b.allocatedSpaceSize += blockSize - oldBlockSize
+
+	if blockSize < oldBlockSize && int(block)+oldBlockSize == b.usedSpaceSize {
+		b.setUsedSpaceSize(int(block) + blockSize)
+
+		if b.usedSpaceSize < b.mappedSpaceSize/2 {
+			return blockSize, true, b.mapSpace(b.usedSpaceSize)
+		}
+	}
+
+	return blockSize, true, nil
+}
+
 // GetBlockSize returns the size of the given block of the buddy system.
 func (b *Buddy) GetBlockSize(block int64) (int, error) {
-	if int(block) >= b.spaceSize {
+	if block < 0 || block&(MinBlockSize-1) != 0 || int(block) >= b.spaceSize {
 		return 0, ErrInvalidBlock
 	}
 
@@ -152,6 +312,16 @@ func (b *Buddy) GetBlockSize(block int64) (int, error) {
 		return 0, ErrInvalidBlock
 	}
 
+	if blockSizeShift == maxBlockSizeShift {
+		numberOfMaxBlocks, ok := b.countMaxBlocks(block)
+
+		if !ok {
+			return 0, ErrInvalidBlock
+		}
+
+		return numberOfMaxBlocks * MaxBlockSize, nil
+	}
+
 	return 1 << blockSizeShift, nil
 }
 
@@ -166,14 +336,81 @@ func (b *Buddy) MustGetBlockSize(block int64) int {
 	return blockSize
 }
 
+// LocateBlock returns the allocated block, and it's size, of the buddy
+// system which covers the given offset in the space.
+func (b *Buddy) LocateBlock(offset int64) (int64, int, bool) {
+	if offset < 0 || int(offset) >= b.spaceSize {
+		return 0, 0, false
+	}
+
+	for blockSizeShift := minBlockSizeShift; blockSizeShift <= maxBlockSizeShift; blockSizeShift++ {
+		block := offset &^ (1<<blockSizeShift - 1)
+
+		if blockSizeShift2, ok := b.blockAllocationBitmap.GetBlockSize(block); ok && blockSizeShift2 == blockSizeShift {
+			if blockSizeShift < maxBlockSizeShift {
+				return block, 1 << blockSizeShift, true
+			}
+
+			for b.blockAllocationBitmap.IsContinued(block) {
+				block -= MaxBlockSize
+			}
+
+			numberOfMaxBlocks, _ := b.countMaxBlocks(block)
+			return block, numberOfMaxBlocks * MaxBlockSize, true
+		}
+	}
+
+	return 0, 0, false
+}
+
+// ClaimBlock allocates the given block with the given size, a power of two
+// between MinBlockSize and MaxBlockSize to which the block is aligned, if
+// the block lies entirely in free space within the used space, and reports
+// whether it does. It serves to take back blocks found in use, e.g. when
+// recovering space allocated since the block allocation bitmap was saved.
+func (b *Buddy) ClaimBlock(block int64, blockSize int) bool {
+	if block < 0 || int(block)+blockSize > b.usedSpaceSize {
+		return false
+	}
+
+	freeBlockListIndex := locateFreeBlockList(blockSize)
+	i := freeBlockListIndex
+
+	for !b.deleteFreeBlock(i, block&^int64(calculateBlockSize(i)-1)) {
+		if i++; i == numberOfFreeBlockLists {
+			return false
+		}
+	}
+
+	// split the free block covering the block down to the block
+	for ; i > freeBlockListIndex; i-- {
+		halfBlockSize := int64(calculateBlockSize(i - 1))
+		b.addFreeBlock(i-1, block&^(halfBlockSize-1)^halfBlockSize)
+	}
+
+	b.allocatedSpaceSize += blockSize
+	b.recordBitmapChange(block, calculateBlockSizeShift(freeBlockListIndex))
+	b.blockAllocationBitmap.AllocateBlock(block, calculateBlockSizeShift(freeBlockListIndex))
+	return true
+}
+
+// RemapSpace remaps the space of the buddy system if the mapped space
+// size differs from the one calculated from the used space size, e.g.
+// after changing the minimum mapped space size.
+func (b *Buddy) RemapSpace() error {
+	if b.calculateMappedSpaceSize(b.usedSpaceSize) == b.mappedSpaceSize {
+		return nil
+	}
+
+	return b.mapSpace(b.usedSpaceSize)
+}
+
 // ShrinkSpace shrink the space of the buddy system.
 func (b *Buddy) ShrinkSpace() {
-	rbTreeOfFreeBlocks := &b.rbTreesOfFreeBlocks[numberOfFreeBlockLists-1]
-
 	for {
 		block := int64(b.spaceSize - MaxBlockSize)
 
-		if !rbTreeOfFreeBlocks.DeleteKey(block) {
+		if !b.deleteFreeBlock(numberOfFreeBlockLists-1, block) {
 			return
 		}
 
@@ -197,6 +434,12 @@ func (b *Buddy) UsedSpaceSize() int {
 	return b.usedSpaceSize
 }
 
+// DirtySpaceSize returns the dirty space size of the buddy system, beyond
+// which the space has never been used and is known to be zero.
+func (b *Buddy) DirtySpaceSize() int {
+	return b.dirtySpaceSize
+}
+
 // MappedSpaceSize returns the mapped space size of the buddy system.
 func (b *Buddy) MappedSpaceSize() int {
 	return b.mappedSpaceSize
@@ -213,8 +456,7 @@ func (b *Buddy) BlockAllocationBitmap() []byte {
 }
 
 func (b *Buddy) doAllocateBlock(freeBlockListIndex int) int64 {
-	rbTreeOfFreeBlocks := &b.rbTreesOfFreeBlocks[freeBlockListIndex]
-	block, ok := rbTreeOfFreeBlocks.DeleteMinKey()
+	block, ok := b.deleteMinFreeBlock(freeBlockListIndex)
 
 	if ok {
 		return block
@@ -226,22 +468,20 @@ func (b *Buddy) doAllocateBlock(freeBlockListIndex int) int64 {
 
 	block = b.doAllocateBlock(freeBlockListIndex + 1)
 	blockSibling := block + int64(calculateBlockSize(freeBlockListIndex))
-	rbTreeOfFreeBlocks.AddKey(blockSibling)
+	b.addFreeBlock(freeBlockListIndex, blockSibling)
 	return block
 }
 
 func (b *Buddy) doFreeBlock(block *int64, freeBlockListIndex *int) {
-	rbTreeOfFreeBlocks := &b.rbTreesOfFreeBlocks[*freeBlockListIndex]
-
 	if *freeBlockListIndex == numberOfFreeBlockLists-1 {
-		rbTreeOfFreeBlocks.AddKey(*block)
+		b.addFreeBlock(*freeBlockListIndex, *block)
 		return
 	}
 
 	blockSibling := *block ^ int64(calculateBlockSize(*freeBlockListIndex))
 
-	if ok := rbTreeOfFreeBlocks.DeleteKey(blockSibling); !ok {
-		rbTreeOfFreeBlocks.AddKey(*block)
+	if ok := b.deleteFreeBlock(*freeBlockListIndex, blockSibling); !ok {
+		b.addFreeBlock(*freeBlockListIndex, *block)
 		return
 	}
 
@@ -253,6 +493,164 @@ func (b *Buddy) doFreeBlock(block *int64, freeBlockListIndex *int) {
 	b.doFreeBlock(block, freeBlockListIndex)
 }
 
+func (b *Buddy) allocateHugeBlock(numberOfMaxBlocks int) (int64, int, error) {
+	block := b.findFreeMaxBlocks(numberOfMaxBlocks)
+	blockSize := numberOfMaxBlocks * MaxBlockSize
+
+	if err := b.growUsedSpace(int(block) + blockSize); err != nil {
+		return 0, 0, err
+	}
+
+	b.allocateMaxBlocks(block, 0, numberOfMaxBlocks)
+	return block, blockSize, nil
+}
+
+func (b *Buddy) resizeHugeBlock(block int64, oldBlockSize int, blockSize int) (int, bool, error) {
+	if oldBlockSize < MaxBlockSize {
+		return 0, false, nil
+	}
+
+	oldNumberOfMaxBlocks := oldBlockSize / MaxBlockSize
+	numberOfMaxBlocks := (blockSize + MaxBlockSize - 1) / MaxBlockSize
+
+	if numberOfMaxBlocks < 1 {
+		numberOfMaxBlocks = 1
+	}
+
+	if numberOfMaxBlocks > oldNumberOfMaxBlocks {
+		for i := oldNumberOfMaxBlocks; i < numberOfMaxBlocks; i++ {
+			if block2 := block + int64(i)*MaxBlockSize; int(block2) < b.spaceSize && !b.findFreeBlock(numberOfFreeBlockLists-1, block2) {
+				return 0, false, nil
+			}
+		}
+
+		if err := b.growUsedSpace(int(block) + numberOfMaxBlocks*MaxBlockSize); err != nil {
+			return 0, false, err
+		}
+
+		b.allocateMaxBlocks(block, oldNumberOfMaxBlocks, numberOfMaxBlocks)
+	} else if numberOfMaxBlocks < oldNumberOfMaxBlocks {
+		if err := b.freeMaxBlocks(block, numberOfMaxBlocks, oldNumberOfMaxBlocks); err != nil {
+			return numberOfMaxBlocks * MaxBlockSize, true, err
+		}
+	}
+
+	if blockSize <= MaxBlockSize {
+		return b.ResizeBlock(block, blockSize)
+	}
+
+	return numberOfMaxBlocks * MaxBlockSize, true, nil
+}
+
+// findFreeMaxBlocks returns the first run of the given number of free max
+// blocks, which may extend beyond the end of the space.
+func (b *Buddy) findFreeMaxBlocks(numberOfMaxBlocks int) int64 {
+	runStart, runEnd := int64(0), int64(0)
+	getFreeBlock := b.getFreeBlocks(numberOfFreeBlockLists - 1)
+
+	for block, ok := getFreeBlock(); ok; block, ok = getFreeBlock() {
+		if block == runEnd {
+			runEnd += MaxBlockSize
+		} else {
+			runStart, runEnd = block, block+MaxBlockSize
+		}
+
+		if int(runEnd-runStart) >= numberOfMaxBlocks*MaxBlockSize {
+			return runStart
+		}
+	}
+
+	if int(runEnd) != b.spaceSize {
+		return int64(b.spaceSize)
+	}
+
+	return runStart
+}
+
+// allocateMaxBlocks allocates the i-th max blocks, for i in [start, end),
+// of the huge block, which are either free or beyond the end of the space.
+func (b *Buddy) allocateMaxBlocks(block int64, start int, end int) {
+	for i := start; i < end; i++ {
+		block2 := block + int64(i)*MaxBlockSize
+
+		if int(block2) == b.spaceSize {
+			b.expandSpace()
+		} else {
+			b.deleteFreeBlock(numberOfFreeBlockLists-1, block2)
+		}
+
+		b.recordBitmapChange(block2, maxBlockSizeShift)
+		b.blockAllocationBitmap.AllocateBlock(block2, maxBlockSizeShift)
+		b.recordContinuationChange(block2)
+		b.blockAllocationBitmap.SetContinued(block2, i >= 1)
+		b.allocatedSpaceSize += MaxBlockSize
+	}
+}
+
+// freeMaxBlocks releases the i-th max blocks, for i in [start, end),
+// of the huge block, where the end is the number of max blocks of it.
+func (b *Buddy) freeMaxBlocks(block int64, start int, end int) error {
+	for i := start; i < end; i++ {
+		b.recordContinuationChange(block + int64(i)*MaxBlockSize)
+		b.blockAllocationBitmap.SetContinued(block+int64(i)*MaxBlockSize, false)
+	}
+
+	var err error
+
+	for i := start; i < end; i++ {
+		err = b.FreeBlock(block + int64(i)*MaxBlockSize)
+	}
+
+	return err
+}
+
+// countMaxBlocks returns the number of max blocks of the allocated max
+// block, which is more than one for a huge block, or false if the max
+// block is not the first one.
+func (b *Buddy) countMaxBlocks(block int64) (int, bool) {
+	if b.blockAllocationBitmap.IsContinued(block) {
+		return 0, false
+	}
+
+	numberOfMaxBlocks := 1
+
+	for block += MaxBlockSize; int(block) < b.spaceSize && b.blockAllocationBitmap.IsContinued(block); block += MaxBlockSize {
+		numberOfMaxBlocks++
+	}
+
+	return numberOfMaxBlocks, true
+}
+
+func (b *Buddy) growUsedSpace(usedSpaceSize int) error {
+	if usedSpaceSize <= b.usedSpaceSize {
+		return nil
+	}
+
+	if b.maxUsedSpaceSize >= 1 && usedSpaceSize > b.maxUsedSpaceSize {
+		return ErrNoSpace
+	}
+
+	if usedSpaceSize > b.mappedSpaceSize {
+		if err := b.mapSpace(usedSpaceSize); err != nil {
+			return err
+		}
+	}
+
+	if b.usedSpaceGuard != nil {
+		if err := b.usedSpaceGuard(usedSpaceSize); err != nil {
+			return err
+		}
+	}
+
+	b.setUsedSpaceSize(usedSpaceSize)
+
+	if usedSpaceSize > b.dirtySpaceSize {
+		b.dirtySpaceSize = usedSpaceSize
+	}
+
+	return nil
+}
+
 func (b *Buddy) expandSpace() int64 {
 	block := int64(b.spaceSize)
 	b.spaceSize += MaxBlockSize
@@ -261,16 +659,45 @@ func (b *Buddy) expandSpace() int64 {
 }
 
 func (b *Buddy) mapSpace(usedSpaceSize int) error {
-	mappedSpaceSize := int(nextPowerOfTwo(int64(usedSpaceSize)))
+	mappedSpaceSize := b.calculateMappedSpaceSize(usedSpaceSize)
 
 	if err := b.spaceMapper.MapSpace(mappedSpaceSize); err != nil {
 		return err
 	}
 
 	b.mappedSpaceSize = mappedSpaceSize
+
+	if b.stateIsInSpace {
+		b.accessBitmap()
+	}
+
 	return nil
 }
 
+func (b *Buddy) calculateMappedSpaceSize(usedSpaceSize int) int {
+	var mappedSpaceSize int
+
+	if b.mappedSpaceSizeCalculator == nil {
+		mappedSpaceSize = int(nextPowerOfTwo(int64(usedSpaceSize)))
+	} else {
+		mappedSpaceSize = b.mappedSpaceSizeCalculator(usedSpaceSize)
+	}
+
+	if b.maxUsedSpaceSize >= 1 && b.maxUsedSpaceSize >= usedSpaceSize && mappedSpaceSize > b.maxUsedSpaceSize {
+		mappedSpaceSize = b.maxUsedSpaceSize
+	}
+
+	if mappedSpaceSize < b.minMappedSpaceSize {
+		mappedSpaceSize = b.minMappedSpaceSize
+	}
+
+	if mappedSpaceSize < usedSpaceSize {
+		mappedSpaceSize = usedSpaceSize
+	}
+
+	return mappedSpaceSize
+}
+
 // Builder represents a builder of buddy systems.
 type Builder struct {
 	b *Buddy
@@ -288,6 +715,13 @@ func (b Builder) SetUsedSpaceSize(usedSpaceSize int) Builder {
 	return b
 }
 
+// SetDirtySpaceSize sets the dirty space size of buddy systems to the given value.
+// The dirty space size only grows with the used space size afterwards.
+func (b Builder) SetDirtySpaceSize(dirtySpaceSize int) Builder {
+	b.b.dirtySpaceSize = dirtySpaceSize
+	return b
+}
+
 // SetMappedSpaceSize sets the mapped space size of buddy systems to the given value.
 func (b Builder) SetMappedSpaceSize(mappedSpaceSize int) Builder {
 	b.b.mappedSpaceSize = mappedSpaceSize
@@ -300,10 +734,46 @@ func (b Builder) SetAllocatedSpaceSize(allocatedSpaceSize int) Builder {
 	return b
 }
 
+// SetMinMappedSpaceSize sets the minimum mapped space size of buddy systems
+// to the given value, so that the space is mapped no less than that.
+func (b Builder) SetMinMappedSpaceSize(minMappedSpaceSize int) Builder {
+	b.b.minMappedSpaceSize = minMappedSpaceSize
+	return b
+}
+
+// SetMaxUsedSpaceSize sets the maximum used space size of buddy systems to
+// the given value, beyond which allocating blocks fails with ErrNoSpace.
+// Zero means unlimited.
+func (b Builder) SetMaxUsedSpaceSize(maxUsedSpaceSize int) Builder {
+	b.b.maxUsedSpaceSize = maxUsedSpaceSize
+	return b
+}
+
+// SetMappedSpaceSizeCalculator sets the function of buddy systems which
+// calculates the mapped space size from the used space size. Nil means
+// rounding the used space size up to a power of two.
+func (b Builder) SetMappedSpaceSizeCalculator(mappedSpaceSizeCalculator func(int) int) Builder {
+	b.b.mappedSpaceSizeCalculator = mappedSpaceSizeCalculator
+	return b
+}
+
+// SetUsedSpaceGuard sets the function of buddy systems called with the
+// used space size before the used space grows to it, once the space is
+// mapped for it, which fails the growth by returning an error, e.g. to
+// move data in the file out of the way of the space to use. Nil means none.
+func (b Builder) SetUsedSpaceGuard(usedSpaceGuard func(int) error) Builder {
+	b.b.usedSpaceGuard = usedSpaceGuard
+	return b
+}
+
 // SetBlockAllocationBitmap sets the block allocation bitmap of buddy systems to the given value.
 func (b Builder) SetBlockAllocationBitmap(blockAllocationBitmap []byte) Builder {
 	b.b.blockAllocationBitmap = blockAllocationBitmap
 
+	for i := range b.b.rbTreesOfFreeBlocks {
+		b.b.rbTreesOfFreeBlocks[i].Init()
+	}
+
 	b.b.blockAllocationBitmap.GetFreeBlocks(func(block int64, blockSizeShift int) {
 		freeBlockListIndex := calculateFreeBlockListIndex(blockSizeShift)
 		b.b.rbTreesOfFreeBlocks[freeBlockListIndex].AddKey(block)
@@ -312,6 +782,35 @@ func (b Builder) SetBlockAllocationBitmap(blockAllocationBitmap []byte) Builder
 	return b
 }
 
+// SetAllocatedBlocks rebuilds the block allocation bitmap of buddy systems
+// from the given allocated blocks, which are iterated by calling the given
+// function with a callback, and sets the space size, the used space size
+// and the allocated space size accordingly. Each block must be aligned to
+// its size, which is a power of two between MinBlockSize and MaxBlockSize.
+func (b Builder) SetAllocatedBlocks(getAllocatedBlocks func(func(int64, int))) Builder {
+	b.b.spaceSize = 0
+	b.b.usedSpaceSize = 0
+	b.b.allocatedSpaceSize = 0
+	b.b.blockAllocationBitmap = nil
+
+	getAllocatedBlocks(func(block int64, blockSize int) {
+		blockEnd := int(block) + blockSize
+
+		for blockEnd > b.b.spaceSize {
+			b.b.expandSpace()
+		}
+
+		b.b.blockAllocationBitmap.AllocateBlock(block, bits.TrailingZeros(uint(blockSize)))
+		b.b.allocatedSpaceSize += blockSize
+
+		if blockEnd > b.b.usedSpaceSize {
+			b.b.usedSpaceSize = blockEnd
+		}
+	})
+
+	return b.SetBlockAllocationBitmap(b.b.blockAllocationBitmap)
+}
+
 var (
 	// ErrBlockTooLarge is returned when allocating a block too large
 	// to allocate from buddy systems.
@@ -319,6 +818,10 @@ var (
 
 	// ErrInvalidBlock is returned when freeing or getting size of an invalid block.
 	ErrInvalidBlock = errors.New("buddy: invalid block")
+
+	// ErrNoSpace is returned when allocating a block beyond the
+	// maximum used space size of buddy systems.
+	ErrNoSpace = errors.New("buddy: no space")
 )
 
 const (
@@ -347,6 +850,12 @@ func calculateFreeBlockListIndex(blockSizeShift int) int {
 	return blockSizeShift - minBlockSizeShift
 }
 
+func clearBytes(bytes []byte) {
+	for i := range bytes {
+		bytes[i] = 0
+	}
+}
+
 func nextPowerOfTwo(x int64) int64 {
 	x--
 	x |= x >> 1
@@ -1,6 +1,7 @@
 package buddy_test
 
 import (
+	"errors"
 	"math/rand"
 	"sort"
 	"testing"
@@ -83,6 +84,8 @@ func TestBuddyShrinkSpace(t *testing.T) {
 
 func TestBuddyUsedAndAllocatedSpaceSize(t *testing.T) {
 	b, bis := MakeBuddy(t)
+	dirtySpaceSize := b.UsedSpaceSize()
+	assert.Equal(t, dirtySpaceSize, b.DirtySpaceSize())
 
 	sort.Slice(bis, func(i, j int) bool {
 		return bis[i].Ptr < bis[j].Ptr
@@ -107,6 +110,7 @@ func TestBuddyUsedAndAllocatedSpaceSize(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, 0, b.UsedSpaceSize())
 	assert.Equal(t, 0, b.AllocatedSpaceSize())
+	assert.Equal(t, dirtySpaceSize, b.DirtySpaceSize())
 }
 
 func MakeBuddy(t *testing.T) (*buddy.Buddy, []*BlockInfo) {
@@ -140,3 +144,330 @@ func MakeBuddy(t *testing.T) (*buddy.Buddy, []*BlockInfo) {
 	t.Logf("allocated/used: %f", float64(b.AllocatedSpaceSize())/float64(b.UsedSpaceSize()))
 	return b, bis
 }
+
+func TestBuddySetAllocatedBlocks(t *testing.T) {
+	b, bis := MakeBuddy(t)
+	b2 := new(buddy.Buddy).Init(SpaceMapper{t})
+
+	b2.Build().SetAllocatedBlocks(func(callback func(int64, int)) {
+		for _, bi := range bis {
+			callback(bi.Ptr, bi.Size)
+		}
+	})
+
+	assert.Equal(t, b.UsedSpaceSize(), b2.UsedSpaceSize())
+	assert.Equal(t, b.AllocatedSpaceSize(), b2.AllocatedSpaceSize())
+	b.ShrinkSpace()
+	b2.ShrinkSpace()
+	assert.Equal(t, b.BlockAllocationBitmap(), b2.BlockAllocationBitmap())
+
+	for _, bi := range bis {
+		err := b2.FreeBlock(bi.Ptr)
+		assert.NoError(t, err)
+	}
+
+	b2.ShrinkSpace()
+	assert.Equal(t, 0, b2.SpaceSize())
+}
+
+func TestBuddyVerify(t *testing.T) {
+	b, bis := MakeBuddy(t)
+	ass, vs := b.Verify()
+	assert.Len(t, vs, 0)
+	assert.Equal(t, b.AllocatedSpaceSize(), ass)
+
+	for i, bi := range bis {
+		if i%2 == 0 {
+			b.MustFreeBlock(bi.Ptr)
+		}
+	}
+
+	ass, vs = b.Verify()
+	assert.Len(t, vs, 0)
+	assert.Equal(t, b.AllocatedSpaceSize(), ass)
+	bab := b.BlockAllocationBitmap()
+	bab[0] ^= 1
+	_, vs = b.Verify()
+	assert.NotEmpty(t, vs)
+}
+
+func TestBuddyClaimBlock(t *testing.T) {
+	b, bis := MakeBuddy(t)
+	ass := b.AllocatedSpaceSize()
+
+	for i, bi := range bis {
+		if i%2 == 0 {
+			b.MustFreeBlock(bi.Ptr)
+		}
+	}
+
+	claimed := make([]bool, len(bis))
+
+	for i, bi := range bis {
+		if i%2 == 1 {
+			assert.False(t, b.ClaimBlock(bi.Ptr, bi.Size))
+		} else if i%4 == 0 {
+			// free blocks at the end are out of the used space
+			claimed[i] = bi.Ptr+int64(bi.Size) <= int64(b.UsedSpaceSize())
+			assert.Equal(t, claimed[i], b.ClaimBlock(bi.Ptr, bi.Size))
+			assert.False(t, b.ClaimBlock(bi.Ptr, bi.Size))
+		}
+	}
+
+	ass2, vs := b.Verify()
+	assert.Len(t, vs, 0)
+	assert.Equal(t, b.AllocatedSpaceSize(), ass2)
+
+	for i, bi := range bis {
+		if claimed[i] {
+			bs, err := b.GetBlockSize(bi.Ptr)
+
+			if assert.NoError(t, err) {
+				assert.Equal(t, bi.Size, bs)
+			}
+		} else if i%2 == 0 {
+			b.MustAllocateBlock(bi.Size)
+		}
+	}
+
+	assert.Equal(t, ass, b.AllocatedSpaceSize())
+}
+
+func TestBuddyResizeBlock(t *testing.T) {
+	b := new(buddy.Buddy).Init(SpaceMapper{t})
+	b1, _ := b.MustAllocateBlock(4096)
+	b2, _ := b.MustAllocateBlock(4096)
+	bs, ok, err := b.ResizeBlock(b2, 8192)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	bs, ok, err = b.ResizeBlock(b1, 20000)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	b.MustFreeBlock(b2)
+	bs, ok, err = b.ResizeBlock(b1, 20000)
+	assert.NoError(t, err)
+
+	if assert.True(t, ok) {
+		assert.Equal(t, 32768, bs)
+		assert.Equal(t, 32768, b.MustGetBlockSize(b1))
+		assert.Equal(t, 32768, b.AllocatedSpaceSize())
+		assert.Equal(t, 32768, b.UsedSpaceSize())
+	}
+
+	_, vs := b.Verify()
+	assert.Len(t, vs, 0)
+	bs, ok, err = b.ResizeBlock(b1, 100)
+	assert.NoError(t, err)
+
+	if assert.True(t, ok) {
+		assert.Equal(t, 4096, bs)
+		assert.Equal(t, 4096, b.MustGetBlockSize(b1))
+		assert.Equal(t, 4096, b.AllocatedSpaceSize())
+		assert.Equal(t, 4096, b.UsedSpaceSize())
+	}
+
+	_, vs = b.Verify()
+	assert.Len(t, vs, 0)
+	_, _, err = b.ResizeBlock(b1+4096, 100)
+	assert.Equal(t, buddy.ErrInvalidBlock, err)
+	_, _, err = b.ResizeBlock(b1, buddy.MaxHugeBlockSize+1)
+	assert.Equal(t, buddy.ErrBlockTooLarge, err)
+	b.MustFreeBlock(b1)
+	b.ShrinkSpace()
+	assert.Equal(t, 0, b.SpaceSize())
+}
+
+func TestBuddyHugeBlock(t *testing.T) {
+	b := new(buddy.Buddy).Init(SpaceMapper{t})
+	b1, _ := b.MustAllocateBlock(4096)
+	b2, bs := b.MustAllocateBlock(buddy.MaxBlockSize + 1)
+	assert.Equal(t, int64(buddy.MaxBlockSize), b2)
+	assert.Equal(t, 2*buddy.MaxBlockSize, bs)
+	assert.Equal(t, 2*buddy.MaxBlockSize, b.MustGetBlockSize(b2))
+	assert.Equal(t, 3*buddy.MaxBlockSize, b.UsedSpaceSize())
+	_, err := b.GetBlockSize(b2 + buddy.MaxBlockSize)
+	assert.Equal(t, buddy.ErrInvalidBlock, err)
+	assert.Equal(t, buddy.ErrInvalidBlock, b.FreeBlock(b2+buddy.MaxBlockSize))
+	block, bs, ok := b.LocateBlock(b2 + buddy.MaxBlockSize + 100)
+
+	if assert.True(t, ok) {
+		assert.Equal(t, b2, block)
+		assert.Equal(t, 2*buddy.MaxBlockSize, bs)
+	}
+
+	var abs []BlockInfo
+
+	b.GetAllocatedBlocks(func(block int64, blockSize int) {
+		abs = append(abs, BlockInfo{block, blockSize})
+	})
+
+	assert.Equal(t, []BlockInfo{{b1, 4096}, {b2, 2 * buddy.MaxBlockSize}}, abs)
+	_, vs := b.Verify()
+	assert.Len(t, vs, 0)
+
+	bs, ok, err = b.ResizeBlock(b2, 3*buddy.MaxBlockSize)
+	assert.NoError(t, err)
+
+	if assert.True(t, ok) {
+		assert.Equal(t, 3*buddy.MaxBlockSize, bs)
+		assert.Equal(t, 4*buddy.MaxBlockSize, b.UsedSpaceSize())
+	}
+
+	b3, _ := b.MustAllocateBlock(buddy.MaxBlockSize)
+	assert.Equal(t, int64(4*buddy.MaxBlockSize), b3)
+	_, ok, err = b.ResizeBlock(b2, 4*buddy.MaxBlockSize)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	bs, ok, err = b.ResizeBlock(b2, 8192)
+	assert.NoError(t, err)
+
+	if assert.True(t, ok) {
+		assert.Equal(t, 8192, bs)
+		assert.Equal(t, 8192, b.MustGetBlockSize(b2))
+	}
+
+	_, vs = b.Verify()
+	assert.Len(t, vs, 0)
+	b.MustFreeBlock(b2)
+	b2, _ = b.MustAllocateBlock(2 * buddy.MaxBlockSize)
+	assert.Equal(t, int64(buddy.MaxBlockSize), b2)
+	assert.Equal(t, 2*buddy.MaxBlockSize+b.MustGetBlockSize(b3), b.AllocatedSpaceSize()-b.MustGetBlockSize(b1))
+	b.MustFreeBlock(b3)
+	assert.Equal(t, 3*buddy.MaxBlockSize, b.UsedSpaceSize())
+	b.MustFreeBlock(b2)
+	assert.Equal(t, 4096, b.UsedSpaceSize())
+	b.MustFreeBlock(b1)
+	_, vs = b.Verify()
+	assert.Len(t, vs, 0)
+	b.ShrinkSpace()
+	assert.Equal(t, 0, b.SpaceSize())
+	_, _, err = b.AllocateBlock(buddy.MaxHugeBlockSize + 1)
+	assert.Equal(t, buddy.ErrBlockTooLarge, err)
+}
+
+type BufferSpaceMapper struct {
+	Buffer []byte
+}
+
+func (sm *BufferSpaceMapper) MapSpace(spaceSize int) error {
+	if spaceSize > 1<<28 {
+		return errors.New("space too large")
+	}
+
+	buffer := make([]byte, spaceSize)
+	copy(buffer, sm.Buffer)
+	sm.Buffer = buffer
+	return nil
+}
+
+func (sm *BufferSpaceMapper) AccessSpace() []byte {
+	return sm.Buffer
+}
+
+func TestBuddyStateInSpace(t *testing.T) {
+	sm := &BufferSpaceMapper{}
+	b := new(buddy.Buddy).Init(sm)
+	type Change struct {
+		Offset   int64
+		PreImage []byte
+	}
+	var changes []Change
+
+	b.Build().SetChangeListener(func(offset int64, size int) {
+		changes = append(changes, Change{offset, append([]byte(nil), sm.Buffer[offset:offset+int64(size)]...)})
+	})
+
+	var bis []BlockInfo
+
+	allocateBlock := func() {
+		bs := 1 + rand.Intn(256<<10)
+
+		if rand.Intn(2) == 0 {
+			bs = 1 + rand.Intn(16<<10)
+		}
+
+		if bptr, bs2, err := b.AllocateBlock(bs); assert.NoError(t, err) {
+			bis = append(bis, BlockInfo{bptr, bs2})
+		}
+	}
+
+	for i := 0; i < 300; i++ {
+		allocateBlock()
+	}
+
+	assert.NoError(t, b.MoveStateIntoSpace())
+	assert.True(t, b.StateIsInSpace())
+	_, vs := b.Verify()
+	assert.Len(t, vs, 0)
+	state := make([]byte, buddy.StateSize)
+
+	for i := 0; i < 1000; i++ {
+		undoes := i%7 == 0
+		var oldSpace []byte
+		var oldBIs []BlockInfo
+
+		if undoes {
+			b.StoreState(state)
+			oldSpace = append(oldSpace, sm.Buffer[:b.UsedSpaceSize()]...)
+			oldBIs = append(oldBIs, bis...)
+		}
+
+		changes = changes[:0]
+
+		switch k := rand.Intn(10); {
+		case k < 4 || len(bis) == 0:
+			allocateBlock()
+		case k < 8:
+			n := rand.Intn(len(bis))
+			assert.NoError(t, b.FreeBlock(bis[n].Ptr))
+			bis = append(bis[:n], bis[n+1:]...)
+		case k < 9:
+			n := rand.Intn(len(bis))
+
+			if bs, ok, err := b.ResizeBlock(bis[n].Ptr, 1+rand.Intn(256<<10)); assert.NoError(t, err) && ok {
+				bis[n].Size = bs
+			}
+		default:
+			// fails after making room in the bitmap for the huge block
+			_, _, err := b.AllocateBlock((2 + rand.Intn(4)) * buddy.MaxBlockSize)
+			assert.Error(t, err)
+		}
+
+		if undoes {
+			for j := len(changes) - 1; j >= 0; j-- {
+				copy(sm.Buffer[changes[j].Offset:], changes[j].PreImage)
+			}
+
+			if !assert.NoError(t, b.LoadState(state)) {
+				t.FailNow()
+			}
+
+			if !assert.Equal(t, oldSpace, sm.Buffer[:len(oldSpace)]) {
+				t.FailNow()
+			}
+
+			bis = oldBIs
+		}
+
+		if i%100 == 0 {
+			_, vs := b.Verify()
+
+			if !assert.Len(t, vs, 0) {
+				t.FailNow()
+			}
+		}
+	}
+
+	_, vs = b.Verify()
+	assert.Len(t, vs, 0)
+	assert.NoError(t, b.MoveStateOutOfSpace())
+	_, vs = b.Verify()
+	assert.Len(t, vs, 0)
+
+	for _, bi := range bis {
+		b.MustFreeBlock(bi.Ptr)
+	}
+
+	assert.Equal(t, 0, b.AllocatedSpaceSize())
+	assert.Equal(t, 0, b.UsedSpaceSize())
+}
@@ -0,0 +1,394 @@
+package buddy
+
+import (
+	"encoding/binary"
+
+	"github.com/roy2220/fsm/internal/list"
+)
+
+// StateSize is the size of the state of buddy systems, see StoreState.
+const StateSize = 6*8 + (numberOfFreeBlockLists-1)*list.Size64
+
+// MoveStateIntoSpace moves the block allocation bitmap and the free block
+// lists of the buddy system into the space, i.e. into a block allocated
+// for the bitmap and into the free blocks themselves, so that along with
+// the space, the state stored by StoreState is all processes sharing the
+// space need to take turns using the buddy system. Free blocks beyond the
+// used space are left out of the free block lists, as they are found from
+// the used space size and the bitmap, so that the lists never reach beyond
+// the used space. It does nothing if the state is in the space already.
+func (b *Buddy) MoveStateIntoSpace() error {
+	if b.stateIsInSpace {
+		return nil
+	}
+
+	// leave room for the bitmap to expand by one sub-bitmap, see reserveBitmapSpace
+	block, blockSize, err := b.AllocateBlock(len(b.blockAllocationBitmap) + 2*blockAllocationSubBitmapSize)
+
+	if err != nil {
+		return err
+	}
+
+	blockAllocationBitmap := b.blockAllocationBitmap
+	b.stateIsInSpace = true
+	b.bitmapBlock = block
+	b.bitmapBlockSize = blockSize
+	b.accessBitmap()
+	copy(b.blockAllocationBitmap, blockAllocationBitmap)
+
+	for i := range b.freeBlockLists {
+		b.freeBlockLists[i].Init()
+		getKey := b.rbTreesOfFreeBlocks[i].GetKeys()
+
+		for block, ok := getKey(); ok; block, ok = getKey() {
+			if int(block) < b.usedSpaceSize {
+				b.listFreeBlock(i, block)
+			}
+		}
+	}
+
+	for i := range b.rbTreesOfFreeBlocks {
+		b.rbTreesOfFreeBlocks[i].Init()
+	}
+
+	return nil
+}
+
+// MoveStateOutOfSpace moves the block allocation bitmap and the free block
+// lists of the buddy system back out of the space and releases the block
+// which held the bitmap, undoing MoveStateIntoSpace. It does nothing if
+// the state is not in the space.
+func (b *Buddy) MoveStateOutOfSpace() error {
+	if !b.stateIsInSpace {
+		return nil
+	}
+
+	blockAllocationBitmap := append([]byte(nil), b.blockAllocationBitmap...)
+	b.stateIsInSpace = false
+
+	for i := range b.freeBlockLists {
+		b.freeBlockLists[i].Init()
+	}
+
+	b.Build().SetBlockAllocationBitmap(blockAllocationBitmap)
+	return b.FreeBlock(b.bitmapBlock)
+}
+
+// StateIsInSpace reports whether the state of the buddy system is in
+// the space, see MoveStateIntoSpace.
+func (b *Buddy) StateIsInSpace() bool {
+	return b.stateIsInSpace
+}
+
+// StoreState stores the state of the buddy system, whose block allocation
+// bitmap and free block lists are in the space, i.e. the space size, the
+// used space size, the dirty space size, the allocated space size, the
+// location of the bitmap and the heads of the free block lists, to the
+// given buffer, which must have a size of StateSize at least.
+func (b *Buddy) StoreState(buffer []byte) {
+	_ = buffer[StateSize-1]
+	binary.BigEndian.PutUint64(buffer[0:], uint64(b.spaceSize))
+	binary.BigEndian.PutUint64(buffer[8:], uint64(b.usedSpaceSize))
+	binary.BigEndian.PutUint64(buffer[16:], uint64(b.dirtySpaceSize))
+	binary.BigEndian.PutUint64(buffer[24:], uint64(b.allocatedSpaceSize))
+	binary.BigEndian.PutUint64(buffer[32:], uint64(b.bitmapBlock))
+	binary.BigEndian.PutUint64(buffer[40:], uint64(b.bitmapBlockSize))
+	i := 48
+
+	for j := range b.freeBlockLists {
+		b.freeBlockLists[j].Store(buffer[i:])
+		i += list.Size64
+	}
+}
+
+// LoadState loads the state of the buddy system from the given data stored
+// by StoreState, then remaps the space as needed, see RemapSpace. The buddy
+// system must either have it's state in the space or be newly initialized.
+func (b *Buddy) LoadState(data []byte) error {
+	_ = data[StateSize-1]
+	b.spaceSize = int(binary.BigEndian.Uint64(data[0:]))
+	b.usedSpaceSize = int(binary.BigEndian.Uint64(data[8:]))
+	b.dirtySpaceSize = int(binary.BigEndian.Uint64(data[16:]))
+	b.allocatedSpaceSize = int(binary.BigEndian.Uint64(data[24:]))
+	b.bitmapBlock = int64(binary.BigEndian.Uint64(data[32:]))
+	b.bitmapBlockSize = int(binary.BigEndian.Uint64(data[40:]))
+	i := 48
+
+	for j := range b.freeBlockLists {
+		b.freeBlockLists[j].Load(data[i:])
+		i += list.Size64
+	}
+
+	b.stateIsInSpace = true
+
+	if err := b.RemapSpace(); err != nil {
+		return err
+	}
+
+	b.accessBitmap()
+	return nil
+}
+
+// SetChangeListener sets the function called with the offset and size of
+// each range of the space holding the state of the buddy system, i.e. the
+// block allocation bitmap and the free block list items, before changing
+// it, or nil for none. Only the state in the space gets reported, see
+// MoveStateIntoSpace, and the content of blocks allocated never does.
+func (b Builder) SetChangeListener(changeListener func(int64, int)) Builder {
+	b.b.changeListener = changeListener
+	return b
+}
+
+// addFreeBlock adds the given free block to the free block list with
+// the given index.
+func (b *Buddy) addFreeBlock(freeBlockListIndex int, block int64) {
+	if !b.stateIsInSpace {
+		b.rbTreesOfFreeBlocks[freeBlockListIndex].AddKey(block)
+		return
+	}
+
+	if b.freeBlockIsListed(freeBlockListIndex, block) {
+		b.listFreeBlock(freeBlockListIndex, block)
+	}
+}
+
+// deleteFreeBlock deletes the given block from the free block list with
+// the given index, and reports whether the block was there. When the state
+// is in the space, the free blocks are told by the block allocation bitmap,
+// which must not yet have the change of the free block applied.
+func (b *Buddy) deleteFreeBlock(freeBlockListIndex int, block int64) bool {
+	if !b.stateIsInSpace {
+		return b.rbTreesOfFreeBlocks[freeBlockListIndex].DeleteKey(block)
+	}
+
+	if !b.blockIsFree(freeBlockListIndex, block) {
+		return false
+	}
+
+	if b.freeBlockIsListed(freeBlockListIndex, block) {
+		b.unlistFreeBlock(freeBlockListIndex, block)
+	}
+
+	return true
+}
+
+// findFreeBlock reports whether the given block is in the free block list
+// with the given index.
+func (b *Buddy) findFreeBlock(freeBlockListIndex int, block int64) bool {
+	if !b.stateIsInSpace {
+		return b.rbTreesOfFreeBlocks[freeBlockListIndex].FindKey(block)
+	}
+
+	return b.blockIsFree(freeBlockListIndex, block)
+}
+
+// deleteMinFreeBlock deletes a free block from the free block list with
+// the given index and returns it, which is the lowest one unless the state
+// is in the space, or false if the list is empty.
+func (b *Buddy) deleteMinFreeBlock(freeBlockListIndex int) (int64, bool) {
+	if !b.stateIsInSpace {
+		return b.rbTreesOfFreeBlocks[freeBlockListIndex].DeleteMinKey()
+	}
+
+	if freeBlockListIndex == numberOfFreeBlockLists-1 {
+		return b.getFreeBlocks(freeBlockListIndex)()
+	}
+
+	if freeBlockList := &b.freeBlockLists[freeBlockListIndex]; !freeBlockList.IsEmpty() {
+		block := freeBlockList.Head()
+		b.unlistFreeBlock(freeBlockListIndex, block)
+		return block, true
+	}
+
+	// the only free block of the size beyond the used space, if any
+	blockSize := int64(calculateBlockSize(freeBlockListIndex))
+	block := (int64(b.usedSpaceSize) + blockSize - 1) &^ (blockSize - 1)
+
+	if !b.blockIsFree(freeBlockListIndex, block) {
+		return 0, false
+	}
+
+	return block, true
+}
+
+// getFreeBlocks returns an iteration function to iterate over all blocks
+// in the free block list with the given index, which are in ascending
+// order for the free block list of max blocks.
+func (b *Buddy) getFreeBlocks(freeBlockListIndex int) func() (int64, bool) {
+	if !b.stateIsInSpace {
+		return b.rbTreesOfFreeBlocks[freeBlockListIndex].GetKeys()
+	}
+
+	if freeBlockListIndex == numberOfFreeBlockLists-1 {
+		block := int64(0)
+
+		return func() (int64, bool) {
+			for ; int(block) < b.spaceSize; block += MaxBlockSize {
+				if b.blockIsFree(freeBlockListIndex, block) {
+					block += MaxBlockSize
+					return block - MaxBlockSize, true
+				}
+			}
+
+			return 0, false
+		}
+	}
+
+	getItem := b.freeBlockLists[freeBlockListIndex].GetItems()
+
+	return func() (int64, bool) {
+		return getItem(b.spaceMapper.AccessSpace())
+	}
+}
+
+// setUsedSpaceSize sets the used space size to the given value. When the
+// state is in the space, the free blocks which the used space grows over
+// get listed, and those which it shrinks off get unlisted, which are the
+// first free blocks of each size at or after the lower used space size.
+// The space must be mapped for the higher used space size.
+func (b *Buddy) setUsedSpaceSize(usedSpaceSize int) {
+	if b.stateIsInSpace {
+		low, high := b.usedSpaceSize, usedSpaceSize
+
+		if low > high {
+			low, high = high, low
+		}
+
+		for i := range b.freeBlockLists {
+			blockSize := int64(calculateBlockSize(i))
+			block := (int64(low) + blockSize - 1) &^ (blockSize - 1)
+
+			if int(block) >= high || !b.blockIsFree(i, block) {
+				continue
+			}
+
+			if usedSpaceSize > b.usedSpaceSize {
+				b.listFreeBlock(i, block)
+			} else {
+				b.unlistFreeBlock(i, block)
+			}
+		}
+	}
+
+	b.usedSpaceSize = usedSpaceSize
+}
+
+// reserveBitmapSpace makes room in the block for the block allocation
+// bitmap in the space to expand the space by the given number of max
+// blocks, by moving the bitmap into a larger block if need be. Room for
+// one more sub-bitmap is always kept, as moving the bitmap may expand the
+// space by one max block itself.
+func (b *Buddy) reserveBitmapSpace(numberOfMaxBlocks int) error {
+	if !b.stateIsInSpace {
+		return nil
+	}
+
+	blockAllocationBitmapSize := len(b.blockAllocationBitmap) + (numberOfMaxBlocks+1)*blockAllocationSubBitmapSize
+
+	if blockAllocationBitmapSize <= b.bitmapBlockSize {
+		return nil
+	}
+
+	block, blockSize, err := b.allocateBlock(blockAllocationBitmapSize + blockAllocationSubBitmapSize)
+
+	if err != nil {
+		return err
+	}
+
+	oldBitmapBlock := b.bitmapBlock
+	blockAllocationBitmap := b.blockAllocationBitmap
+	b.bitmapBlock = block
+	b.bitmapBlockSize = blockSize
+	b.accessBitmap()
+	copy(b.blockAllocationBitmap, blockAllocationBitmap)
+	return b.FreeBlock(oldBitmapBlock)
+}
+
+// accessBitmap points the block allocation bitmap to the block for it in
+// the space, which is needed whenever the space gets remapped.
+func (b *Buddy) accessBitmap() {
+	blockAllocationBitmapSize := int64(b.spaceSize / MaxBlockSize * blockAllocationSubBitmapSize)
+	spaceAccessor := b.spaceMapper.AccessSpace()
+	b.blockAllocationBitmap = spaceAccessor[b.bitmapBlock : b.bitmapBlock+blockAllocationBitmapSize : b.bitmapBlock+int64(b.bitmapBlockSize)]
+}
+
+// blockIsFree reports whether the given block is a free block, not split
+// or merged, of the free block list with the given index according to the
+// block allocation bitmap.
+func (b *Buddy) blockIsFree(freeBlockListIndex int, block int64) bool {
+	if block < 0 || int(block) >= b.spaceSize || block&int64(calculateBlockSize(freeBlockListIndex)-1) != 0 {
+		return false
+	}
+
+	return b.blockAllocationBitmap.IsFreeBlock(block, calculateBlockSizeShift(freeBlockListIndex))
+}
+
+// freeBlockIsListed reports whether the given free block is kept in the
+// free block list with the given index, which is always the case unless
+// the state is in the space, see MoveStateIntoSpace.
+func (b *Buddy) freeBlockIsListed(freeBlockListIndex int, block int64) bool {
+	return !b.stateIsInSpace || (freeBlockListIndex < numberOfFreeBlockLists-1 && int(block) < b.usedSpaceSize)
+}
+
+func (b *Buddy) listFreeBlock(freeBlockListIndex int, block int64) {
+	freeBlockList := &b.freeBlockLists[freeBlockListIndex]
+	b.recordChange(block, list.ItemSize64)
+
+	if !freeBlockList.IsEmpty() {
+		b.recordChange(freeBlockList.Tail(), list.ItemSize64)
+		b.recordChange(freeBlockList.Head(), list.ItemSize64)
+	}
+
+	freeBlockList.PrependItem(b.spaceMapper.AccessSpace(), block)
+}
+
+func (b *Buddy) unlistFreeBlock(freeBlockListIndex int, block int64) {
+	spaceAccessor := b.spaceMapper.AccessSpace()
+
+	if b.changeListener != nil {
+		// the list item of the block is free to be overwritten then
+		b.recordChange(block, list.ItemSize64)
+		b.recordChange(list.Item64Prev(spaceAccessor, block), list.ItemSize64)
+		b.recordChange(list.Item64Next(spaceAccessor, block), list.ItemSize64)
+	}
+
+	b.freeBlockLists[freeBlockListIndex].RemoveItem(spaceAccessor, block)
+}
+
+// recordBitmapChange records the bytes of the block allocation bitmap in
+// the space about to change on allocating or freeing the given block with
+// the given size, which hold the bits of the block and it's ancestors.
+func (b *Buddy) recordBitmapChange(block int64, blockSizeShift int) {
+	if !b.stateIsInSpace || b.changeListener == nil {
+		return
+	}
+
+	sub := b.bitmapBlock + (block>>maxBlockSizeShift)*blockAllocationSubBitmapSize
+	lastBytePos := -1
+
+	for bitPos := locateBit(block&(MaxBlockSize-1), blockSizeShift); bitPos >= 0; bitPos = locateParentBit(bitPos) {
+		if bytePos := bitPos >> 3; bytePos != lastBytePos {
+			b.recordChange(sub+int64(bytePos), 1)
+			lastBytePos = bytePos
+		}
+	}
+}
+
+// recordContinuationChange records the byte of the block allocation bitmap
+// in the space holding the continuation bit of the given max block.
+func (b *Buddy) recordContinuationChange(block int64) {
+	if !b.stateIsInSpace || b.changeListener == nil {
+		return
+	}
+
+	sub := b.bitmapBlock + (block>>maxBlockSizeShift)*blockAllocationSubBitmapSize
+	b.recordChange(sub+continuationBitPos>>3, 1)
+}
+
+// recordChange reports the given range of the space about to be changed
+// by the buddy system to the change listener, if any.
+func (b *Buddy) recordChange(offset int64, size int) {
+	if b.changeListener != nil {
+		b.changeListener(offset, size)
+	}
+}
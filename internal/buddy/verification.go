@@ -0,0 +1,159 @@
+package buddy
+
+import "fmt"
+
+// GetAllocatedBlocks calls the given callback with each allocated
+// block, and it's size, of the buddy system in ascending order.
+func (b *Buddy) GetAllocatedBlocks(callback func(int64, int)) {
+	hugeBlock, hugeBlockSize := int64(-1), 0
+
+	b.blockAllocationBitmap.GetAllocatedBlocks(func(block int64, blockSizeShift int) {
+		if blockSizeShift == maxBlockSizeShift && b.blockAllocationBitmap.IsContinued(block) {
+			hugeBlockSize += MaxBlockSize
+			return
+		}
+
+		if hugeBlock >= 0 {
+			callback(hugeBlock, hugeBlockSize)
+			hugeBlock = -1
+		}
+
+		if blockSizeShift == maxBlockSizeShift {
+			hugeBlock, hugeBlockSize = block, MaxBlockSize
+			return
+		}
+
+		callback(block, 1<<blockSizeShift)
+	})
+
+	if hugeBlock >= 0 {
+		callback(hugeBlock, hugeBlockSize)
+	}
+}
+
+// Verify cross-checks the block allocation bitmap of the buddy system
+// against the free block lists and the stats, returns the allocated space
+// size recomputed and the descriptions of the violations found. The free
+// block lists are expected to leave out the free blocks beyond the used
+// space when the state is in the space, see MoveStateIntoSpace.
+func (b *Buddy) Verify() (int, []string) {
+	var violations []string
+
+	if blockAllocationBitmapSize := b.spaceSize / MaxBlockSize * blockAllocationSubBitmapSize; len(b.blockAllocationBitmap) != blockAllocationBitmapSize {
+		violations = append(violations, fmt.Sprintf("block allocation bitmap size %d, expected %d",
+			len(b.blockAllocationBitmap), blockAllocationBitmapSize))
+		return 0, violations
+	}
+
+	for block := int64(0); int(block) < b.spaceSize; block += MaxBlockSize {
+		if !b.blockAllocationBitmap.IsContinued(block) {
+			continue
+		}
+
+		if blockSizeShift, ok := b.blockAllocationBitmap.GetBlockSize(block); !ok || blockSizeShift != maxBlockSizeShift {
+			violations = append(violations, fmt.Sprintf("block %d continuing a huge block not allocated", block))
+			continue
+		}
+
+		if block == 0 {
+			violations = append(violations, fmt.Sprintf("block %d continuing no huge block", block))
+			continue
+		}
+
+		if blockSizeShift, ok := b.blockAllocationBitmap.GetBlockSize(block - MaxBlockSize); !ok || blockSizeShift != maxBlockSizeShift {
+			violations = append(violations, fmt.Sprintf("block %d continuing no huge block", block))
+		}
+	}
+
+	listedFreeBlocks := [numberOfFreeBlockLists]map[int64]struct{}{}
+
+	for freeBlockListIndex := range listedFreeBlocks {
+		listedFreeBlocks[freeBlockListIndex] = map[int64]struct{}{}
+		getFreeBlock := b.getFreeBlocks(freeBlockListIndex)
+
+		for block, ok := getFreeBlock(); ok; block, ok = getFreeBlock() {
+			if _, ok := listedFreeBlocks[freeBlockListIndex][block]; ok {
+				violations = append(violations, fmt.Sprintf("free block list of size %d looped at block %d",
+					calculateBlockSize(freeBlockListIndex), block))
+				break
+			}
+
+			listedFreeBlocks[freeBlockListIndex][block] = struct{}{}
+		}
+	}
+
+	freeBlocks := [numberOfFreeBlockLists]map[int64]struct{}{}
+	freeBlockStarts := map[int64]int64{}
+	freeSpaceSize := 0
+
+	b.blockAllocationBitmap.GetFreeBlocks(func(block int64, blockSizeShift int) {
+		freeBlockListIndex := calculateFreeBlockListIndex(blockSizeShift)
+
+		if freeBlocks[freeBlockListIndex] == nil {
+			freeBlocks[freeBlockListIndex] = map[int64]struct{}{}
+		}
+
+		freeBlocks[freeBlockListIndex][block] = struct{}{}
+		blockSize := 1 << blockSizeShift
+		freeBlockStarts[block+int64(blockSize)] = block
+		freeSpaceSize += blockSize
+
+		if _, ok := listedFreeBlocks[freeBlockListIndex][block]; !ok && b.freeBlockIsListed(freeBlockListIndex, block) {
+			violations = append(violations, fmt.Sprintf("free block %d of size %d missing from free block list",
+				block, blockSize))
+		}
+	})
+
+	for freeBlockListIndex := range listedFreeBlocks {
+		for block := range listedFreeBlocks[freeBlockListIndex] {
+			if _, ok := freeBlocks[freeBlockListIndex][block]; !ok {
+				violations = append(violations, fmt.Sprintf("block %d in free block list of size %d not free",
+					block, calculateBlockSize(freeBlockListIndex)))
+			} else if !b.freeBlockIsListed(freeBlockListIndex, block) {
+				violations = append(violations, fmt.Sprintf("block %d in free block list of size %d beyond used space",
+					block, calculateBlockSize(freeBlockListIndex)))
+			}
+		}
+	}
+
+	if b.stateIsInSpace {
+		if blockSize, err := b.GetBlockSize(b.bitmapBlock); err != nil || blockSize != b.bitmapBlockSize {
+			violations = append(violations, fmt.Sprintf("block %d of size %d for block allocation bitmap not allocated",
+				b.bitmapBlock, b.bitmapBlockSize))
+		} else if len(b.blockAllocationBitmap)+blockAllocationSubBitmapSize > b.bitmapBlockSize {
+			violations = append(violations, fmt.Sprintf("block allocation bitmap size %d leaving no room in block of size %d",
+				len(b.blockAllocationBitmap), b.bitmapBlockSize))
+		}
+	}
+
+	allocatedSpaceSize := b.spaceSize - freeSpaceSize
+
+	if allocatedSpaceSize != b.allocatedSpaceSize {
+		violations = append(violations, fmt.Sprintf("allocated space size %d, expected %d",
+			b.allocatedSpaceSize, allocatedSpaceSize))
+	}
+
+	usedSpaceSize := int64(b.spaceSize)
+
+	for {
+		block, ok := freeBlockStarts[usedSpaceSize]
+
+		if !ok {
+			break
+		}
+
+		usedSpaceSize = block
+	}
+
+	if int(usedSpaceSize) != b.usedSpaceSize {
+		violations = append(violations, fmt.Sprintf("used space size %d, expected %d",
+			b.usedSpaceSize, usedSpaceSize))
+	}
+
+	if b.mappedSpaceSize < b.usedSpaceSize {
+		violations = append(violations, fmt.Sprintf("mapped space size %d less than used space size %d",
+			b.mappedSpaceSize, b.usedSpaceSize))
+	}
+
+	return allocatedSpaceSize, violations
+}
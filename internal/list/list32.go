@@ -134,6 +134,18 @@ func (l *List32) Load(data []byte) {
 	l.head = item32(^binary.BigEndian.Uint32(data[32/8:]))
 }
 
+// Tail returns the tail of the doubly-linked list,
+// which is meaningless if the doubly-linked list is empty.
+func (l *List32) Tail() int32 {
+	return int32(l.tail)
+}
+
+// Head returns the head of the doubly-linked list,
+// which is meaningless if the doubly-linked list is empty.
+func (l *List32) Head() int32 {
+	return int32(l.head)
+}
+
 // Clear clears the doubly-linked list to empty.
 func (l *List32) Clear() {
 	l.tail = noItem32
@@ -134,6 +134,18 @@ func (l *List64) Load(data []byte) {
 	l.head = item64(^binary.BigEndian.Uint64(data[64/8:]))
 }
 
+// Tail returns the tail of the doubly-linked list,
+// which is meaningless if the doubly-linked list is empty.
+func (l *List64) Tail() int64 {
+	return int64(l.tail)
+}
+
+// Head returns the head of the doubly-linked list,
+// which is meaningless if the doubly-linked list is empty.
+func (l *List64) Head() int64 {
+	return int64(l.head)
+}
+
 // Clear clears the doubly-linked list to empty.
 func (l *List64) Clear() {
 	l.tail = noItem64
@@ -0,0 +1,122 @@
+package pool
+
+import "sort"
+
+// AllocateSpaces allocates space with each of the given sizes from the
+// pool and returns them. Small space is allocated from the pooled blocks
+// which the previous space is allocated from as long as possible, the
+// latest first, so that space allocated together is consecutive in general.
+// If an error occurs, the space allocated so far is released.
+func (p *Pool) AllocateSpaces(spaceSizes []int) ([]int64, error) {
+	return p.AllocateSpacesInShard(0, spaceSizes)
+}
+
+// AllocateSpacesInShard is like AllocateSpaces but small space which can't
+// be allocated from the pooled blocks used before is allocated from the
+// pooled blocks of the given shard in preference to those of the other
+// shards, like AllocateSpaceInShard.
+func (p *Pool) AllocateSpacesInShard(shardIndex int, spaceSizes []int) ([]int64, error) {
+	spaces := make([]int64, len(spaceSizes))
+	var blocks []int64
+
+	for i, spaceSize := range spaceSizes {
+		space, ok := int64(0), false
+
+		if chunkSize := p.calculateChunkSize(spaceSize); chunkSize <= maxChunkSize {
+			space, ok = p.allocateSpaceFromBlocks(blocks, chunkSize)
+		}
+
+		if !ok {
+			var err error
+
+			if space, _, err = p.allocateSpace(shardIndex, spaceSize, int(p.minAlignment)); err != nil {
+				for _, space := range spaces[:i] {
+					p.FreeSpace(space)
+				}
+
+				return nil, err
+			}
+
+			if block, _, ok := parseChunkSpace(space); ok {
+				blocks = append(blocks, block)
+			}
+		}
+
+		spaces[i] = space
+	}
+
+	return spaces, nil
+}
+
+// allocateSpaceFromBlocks allocates space for a chunk with the given size
+// from the given pooled blocks, the last first, returns it and true, or
+// false if it can't. No misses are counted for the free chunks too small,
+// as the blocks are tried for every space of a batch whatever it's size,
+// which would dismiss free chunks normal allocation makes use of.
+func (p *Pool) allocateSpaceFromBlocks(blocks []int64, chunkSize int) (int64, bool) {
+	spaceAccessor := p.accessSpace()
+
+	for i := len(blocks) - 1; i >= 0; i-- {
+		block := blocks[i]
+		listOfFreeChunks := blockHeader(accessBlock(spaceAccessor, block)).ListOfFreeChunks()
+
+		// the block is not listed any more if it has no free chunks
+		if listOfFreeChunks.IsEmpty() {
+			continue
+		}
+
+		if chunk, _, ok := p.splitChunk(spaceAccessor, block, chunkSize, p.minAlignment, false); ok {
+			return makeChunkSpace(block, chunk), true
+		}
+	}
+
+	return 0, false
+}
+
+// MustAllocateSpaces calls AllocateSpaces and panics when an error occurs.
+func (p *Pool) MustAllocateSpaces(spaceSizes []int) []int64 {
+	spaces, err := p.AllocateSpaces(spaceSizes)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return spaces
+}
+
+// FreeSpaces releases the given spaces back to the pool, in ascending
+// order so that space of the same pooled block is released together.
+// If any of the spaces is invalid or duplicate, ErrInvalidSpace is
+// returned and no space is released.
+func (p *Pool) FreeSpaces(spaces []int64) error {
+	sortedSpaces := make([]int64, len(spaces))
+	copy(sortedSpaces, spaces)
+	sort.Slice(sortedSpaces, func(i, j int) bool { return sortedSpaces[i] < sortedSpaces[j] })
+
+	for i, space := range sortedSpaces {
+		if i >= 1 && space == sortedSpaces[i-1] {
+			return ErrInvalidSpace
+		}
+
+		if _, err := p.GetSpaceSize(space); err != nil {
+			return err
+		}
+	}
+
+	var err error
+
+	for _, space := range sortedSpaces {
+		if err2 := p.FreeSpace(space); err2 != nil {
+			err = err2
+		}
+	}
+
+	return err
+}
+
+// MustFreeSpaces calls FreeSpaces and panics when an error occurs.
+func (p *Pool) MustFreeSpaces(spaces []int64) {
+	if err := p.FreeSpaces(spaces); err != nil {
+		panic(err)
+	}
+}
@@ -2,6 +2,7 @@
 package pool
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -12,15 +13,23 @@ import (
 
 // Pool represents a pool of space.
 type Pool struct {
-	buddy              *buddy.Buddy
-	listOfPooledBlocks list.List64
-	dismissedSpaceSize int
+	buddy          *buddy.Buddy
+	shards         [MaxNumberOfShards]shard
+	numberOfShards int
+	minAlignment   int32
+	changeListener func(int64, int)
 }
 
 // Init initializes the pool with the given buddy system and returns it.
 func (p *Pool) Init(buddy *buddy.Buddy) *Pool {
 	p.buddy = buddy
-	p.listOfPooledBlocks.Init()
+
+	for i := range p.shards {
+		p.shards[i].Init()
+	}
+
+	p.numberOfShards = 1
+	p.minAlignment = DefaultMinAlignment
 	return p
 }
 
@@ -29,141 +38,453 @@ func (p *Pool) Build() Builder {
 	return Builder{p}
 }
 
-// AllocateSpace allocates space with the given size
-// from the pool and returns it and it's actual size.
-func (p *Pool) AllocateSpace(spaceSize int) (int64, int) {
-	if chunkSize := chunkHeaderSize + spaceSize; chunkSize <= maxChunkSize {
-		if chunkSize < minChunkSize {
-			chunkSize = minChunkSize
+// AllocateSpace allocates space with the given size from the pool and
+// returns it and it's actual size. The space is aligned to the minimum
+// alignment of the pool.
+func (p *Pool) AllocateSpace(spaceSize int) (int64, int, error) {
+	return p.AllocateSpaceAligned(spaceSize, int(p.minAlignment))
+}
+
+// MustAllocateSpace calls AllocateSpace and panics when an error occurs.
+func (p *Pool) MustAllocateSpace(spaceSize int) (int64, int) {
+	space, spaceSize, err := p.AllocateSpace(spaceSize)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return space, spaceSize
+}
+
+// AllocateSpaceAligned is like AllocateSpace but the space allocated is
+// aligned to the given alignment, which must be a power of two no more
+// than buddy.MaxBlockSize. Small space with an alignment less than 64 KiB
+// is allocated from chunks of pooled blocks as well.
+func (p *Pool) AllocateSpaceAligned(spaceSize int, alignment int) (int64, int, error) {
+	return p.allocateSpace(0, spaceSize, alignment)
+}
+
+// MustAllocateSpaceAligned calls AllocateSpaceAligned and panics when an error occurs.
+func (p *Pool) MustAllocateSpaceAligned(spaceSize int, alignment int) (int64, int) {
+	space, spaceSize, err := p.AllocateSpaceAligned(spaceSize, alignment)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return space, spaceSize
+}
+
+func (p *Pool) allocateSpace(shardIndex int, spaceSize int, alignment int) (int64, int, error) {
+	if alignment < 1 || alignment&(alignment-1) != 0 || alignment > buddy.MaxBlockSize {
+		return 0, 0, ErrInvalidAlignment
+	}
+
+	if alignment < int(p.minAlignment) {
+		alignment = int(p.minAlignment)
+	}
+
+	if chunkSize := p.calculateChunkSize(spaceSize); chunkSize <= maxChunkSize && alignment < minUnmanagedBlockSize {
+		block, chunk, chunkSize, err := p.allocateChunk(shardIndex, chunkSize, int32(alignment))
+
+		if err != nil {
+			return 0, 0, err
 		}
 
-		block, chunk, chunkSize := p.allocateChunk(chunkSize)
-		return makeChunkSpace(block, chunk), calculateChunkSpaceSize(chunkSize)
+		return makeChunkSpace(block, chunk), calculateChunkSpaceSize(chunkSize), nil
+	}
+
+	if spaceSize < alignment {
+		spaceSize = alignment
+	}
+
+	return p.buddy.AllocateBlock(spaceSize)
+}
+
+// AllocateZeroedSpace is like AllocateSpace but guarantees the space
+// allocated is zeroed. Only the part of the space within the dirty space
+// size of the buddy system is cleared, as the rest has never been used
+// and is already zero, except the leading bytes of a chunk, which may
+// have held the free list item of the chunk.
+func (p *Pool) AllocateZeroedSpace(spaceSize int) (int64, int, error) {
+	dirtySpaceSize := p.buddy.DirtySpaceSize()
+	space, spaceSize, err := p.AllocateSpace(spaceSize)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	n := dirtySpaceSize - int(space)
+
+	if _, _, ok := parseChunkSpace(space); ok && n < freeChunkHeaderSize-chunkHeaderSize {
+		n = freeChunkHeaderSize - chunkHeaderSize
+	}
+
+	if n > spaceSize {
+		n = spaceSize
+	}
+
+	spaceAccessor := p.accessSpace()
+
+	for i := 0; i < n; i++ {
+		spaceAccessor[int(space)+i] = 0
 	}
 
-	return p.buddy.MustAllocateBlock(spaceSize)
+	return space, spaceSize, nil
+}
+
+// MustAllocateZeroedSpace calls AllocateZeroedSpace and panics when an error occurs.
+func (p *Pool) MustAllocateZeroedSpace(spaceSize int) (int64, int) {
+	space, spaceSize, err := p.AllocateZeroedSpace(spaceSize)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return space, spaceSize
 }
 
 // FreeSpace releases the given space back to the pool.
-func (p *Pool) FreeSpace(space int64) {
+func (p *Pool) FreeSpace(space int64) error {
 	if block, chunk, ok := parseChunkSpace(space); ok {
-		p.freeChunk(block, chunk)
-		return
+		if err := p.checkChunk(block, chunk); err != nil {
+			return err
+		}
+
+		return p.freeChunk(block, chunk)
 	}
 
-	p.buddy.MustFreeBlock(space)
+	return p.buddy.FreeBlock(space)
+}
+
+// MustFreeSpace calls FreeSpace and panics when an error occurs.
+func (p *Pool) MustFreeSpace(space int64) {
+	if err := p.FreeSpace(space); err != nil {
+		panic(err)
+	}
+}
+
+// ReallocateSpace resizes the given space of the pool to the given size,
+// in place if possible, otherwise by moving the content of the space to
+// new space, returns the space resized and it's actual size. Space moves
+// between chunks of pooled blocks and blocks of the buddy system as the
+// size crosses the maximum chunk size.
+// If an error occurs in releasing the old space, the new space is still
+// returned along with the error.
+func (p *Pool) ReallocateSpace(space int64, spaceSize int) (int64, int, error) {
+	oldSpaceSize, err := p.GetSpaceSize(space)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if block, chunk, ok := parseChunkSpace(space); ok {
+		if chunkSize := p.calculateChunkSize(spaceSize); chunkSize <= maxChunkSize {
+			if chunkSize, ok := p.resizeChunk(block, chunk, chunkSize); ok {
+				return space, calculateChunkSpaceSize(chunkSize), nil
+			}
+		}
+	} else if chunkHeaderSize+spaceSize > maxChunkSize {
+		blockSize, ok, err := p.buddy.ResizeBlock(space, spaceSize)
+
+		if err != nil {
+			return 0, 0, err
+		}
+
+		if ok {
+			return space, blockSize, nil
+		}
+	}
+
+	newSpace, newSpaceSize, err := p.AllocateSpace(spaceSize)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	spaceAccessor := p.accessSpace()
+	copy(spaceAccessor[newSpace:newSpace+int64(newSpaceSize)], spaceAccessor[space:space+int64(oldSpaceSize)])
+	return newSpace, newSpaceSize, p.FreeSpace(space)
 }
 
 // GetSpaceSize returns the size of the given space of the pool.
-func (p *Pool) GetSpaceSize(space int64) int {
+func (p *Pool) GetSpaceSize(space int64) (int, error) {
 	if block, chunk, ok := parseChunkSpace(space); ok {
-		return calculateChunkSpaceSize(p.getChunkSize(block, chunk))
+		if err := p.checkChunk(block, chunk); err != nil {
+			return 0, err
+		}
+
+		return calculateChunkSpaceSize(p.getChunkSize(block, chunk)), nil
 	}
 
-	return p.buddy.MustGetBlockSize(space)
+	return p.buddy.GetBlockSize(space)
 }
 
-// StorePooledBlockList stores the pooled block list of the pool to the given buffer.
-func (p *Pool) StorePooledBlockList(buffer []byte) {
-	p.listOfPooledBlocks.Store(buffer)
+// MustGetSpaceSize calls GetSpaceSize and panics when an error occurs.
+func (p *Pool) MustGetSpaceSize(space int64) int {
+	spaceSize, err := p.GetSpaceSize(space)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return spaceSize
+}
+
+// StorePooledBlockList stores the pooled block list of the given shard
+// of the pool to the given buffer.
+func (p *Pool) StorePooledBlockList(shardIndex int, buffer []byte) {
+	p.shards[shardIndex].listOfPooledBlocks.Store(buffer)
 }
 
 // DismissedSpaceSize returns the dismissed space size of the pool.
 func (p *Pool) DismissedSpaceSize() int {
-	return p.dismissedSpaceSize
+	dismissedSpaceSize := 0
+
+	for i := 0; i < p.numberOfShards; i++ {
+		dismissedSpaceSize += p.shards[i].dismissedSpaceSize
+	}
+
+	return dismissedSpaceSize
 }
 
 // Fprint dumps the pool tree as plain text for debugging purposes
 func (p *Pool) Fprint(writer io.Writer) error {
-	getBlock := p.listOfPooledBlocks.GetItems()
 	spaceAccessor := p.buddy.SpaceMapper().AccessSpace()
 
-	for block, ok := getBlock(spaceAccessor); ok; block, ok = getBlock(spaceAccessor) {
-		p.doFprint(writer, spaceAccessor, block)
+	for i := 0; i < p.numberOfShards; i++ {
+		getBlock := p.shards[i].listOfPooledBlocks.GetItems()
+
+		for block, ok := getBlock(spaceAccessor); ok; block, ok = getBlock(spaceAccessor) {
+			p.doFprint(writer, spaceAccessor, block)
+		}
 	}
 
 	return nil
 }
 
-func (p *Pool) allocateChunk(chunkSize int) (int64, int32, int) {
-	getBlock := p.listOfPooledBlocks.GetItems()
+// allocateChunk allocates a chunk from the pooled blocks of the given
+// shard, or of the other shards, before allocating a new pooled block.
+func (p *Pool) allocateChunk(shardIndex int, chunkSize int, alignment int32) (int64, int32, int, error) {
 	spaceAccessor := p.buddy.SpaceMapper().AccessSpace()
 
-	for block, ok := getBlock(spaceAccessor); ok; block, ok = getBlock(spaceAccessor) {
-		if chunk, chunkSize, ok := p.splitChunk(spaceAccessor, block, chunkSize); ok {
-			return block, chunk, chunkSize
+	for i := 0; i < p.numberOfShards; i++ {
+		if block, chunk, chunkSize, ok := p.splitChunkOfShard((shardIndex+i)%p.numberOfShards, spaceAccessor, chunkSize, alignment); ok {
+			return block, chunk, chunkSize, nil
 		}
 	}
 
-	block, chunk := p.allocateBlock(chunkSize)
-	return block, chunk, chunkSize
+	block, err := p.allocateBlock()
+
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	chunk, chunkSize, _ := p.splitChunk(p.accessSpace(), block, chunkSize, alignment, true)
+	return block, chunk, chunkSize, nil
 }
 
-func (p *Pool) freeChunk(block int64, chunk int32) {
+func (p *Pool) freeChunk(block int64, chunk int32) error {
 	spaceAccessor := p.accessSpace()
 
 	if chunkSize := p.mergeChunk(spaceAccessor, block, chunk); chunkSize == blockPayloadSize {
-		p.freeBlock(spaceAccessor, block)
+		return p.freeBlock(spaceAccessor, block)
 	}
+
+	return nil
 }
 
-func (p *Pool) getChunkSize(block int64, chunk int32) int {
-	chunkController := chunkController{accessBlock(p.accessSpace(), block), chunk}
+// resizeChunk resizes the given used chunk in place to the given size, at
+// least, by taking over the free chunk following it and/or releasing the
+// tail of it, returns the actual chunk size and true, or false if there is
+// no enough free space following the chunk.
+func (p *Pool) resizeChunk(block int64, chunk int32, chunkSize int) (int, bool) {
+	spaceAccessor := p.accessSpace()
+	blockAccessor := accessBlock(spaceAccessor, block)
+	itemRecorder := itemRecorder{p, block}
+	chunkController1 := chunkController{blockAccessor, chunk, itemRecorder}
+	oldChunkSize := int(chunkController1.Size())
+	p.recordBlockHeader(block)
+
+	if chunkSize > oldChunkSize {
+		chunkNext := chunkController1.Next()
+
+		if chunkNext < chunk {
+			return 0, false
+		}
+
+		chunkNextController := chunkController{blockAccessor, chunkNext, itemRecorder}
+
+		if chunkNextController.IsUsed() || oldChunkSize+int(chunkNextController.Size()) < chunkSize {
+			return 0, false
+		}
+
+		blockHeader := blockHeader(blockAccessor)
+		listOfChunks := blockHeader.ListOfChunks()
+		listOfFreeChunks := blockHeader.ListOfFreeChunks()
+
+		if chunkNextController.MissCount() == maxMissCount {
+			p.shardOf(block).dismissedSpaceSize -= int(chunkNextController.Size())
+		} else {
+			chunkNextController.RemoveFree(&listOfFreeChunks)
+
+			if listOfFreeChunks.IsEmpty() {
+				p.removePooledBlock(spaceAccessor, block)
+			}
+		}
+
+		chunkNextController.Remove(&listOfChunks)
+		blockHeader.SetListOfChunks(listOfChunks)
+		blockHeader.SetListOfFreeChunks(listOfFreeChunks)
+
+		oldChunkSize = int(chunkController1.Size())
+	}
+
+	remainingChunkSize := oldChunkSize - chunkSize
+
+	if remainingChunkSize < minChunkSize {
+		return oldChunkSize, true
+	}
+
+	if chunkIsViolated(chunk + int32(chunkSize)) {
+		if remainingChunkSize-int(p.minAlignment) < minChunkSize {
+			return oldChunkSize, true
+		}
+
+		chunkSize += int(p.minAlignment)
+	}
+
+	remainingChunk := chunk + int32(chunkSize)
+	remainingChunkController := chunkController{blockAccessor, remainingChunk, itemRecorder}
+	remainingChunkController.SetUsed(true)
+	blockHeader := blockHeader(blockAccessor)
+	listOfChunks := blockHeader.ListOfChunks()
+	remainingChunkController.InsertAfter(&listOfChunks, chunk)
+	blockHeader.SetListOfChunks(listOfChunks)
+	p.mergeChunk(spaceAccessor, block, remainingChunk)
+	return chunkSize, true
+}
+
+// checkChunk checks whether the given chunk is a used chunk of
+// a pooled block, as far as it can be done in constant time.
+func (p *Pool) checkChunk(block int64, chunk int32) error {
+	if blockSize2, err := p.buddy.GetBlockSize(block); err != nil || blockSize2 != blockSize {
+		return ErrInvalidSpace
+	}
+
+	if !chunkIsInRange(chunk) {
+		return ErrInvalidSpace
+	}
+
+	chunkController := chunkController{accessBlock(p.accessSpace(), block), chunk, itemRecorder{}}
 
 	if !chunkController.IsUsed() {
-		panic(errInvalidChunk)
+		return ErrInvalidSpace
+	}
+
+	if chunkPrev := chunkController.Prev(); !chunkIsInRange(chunkPrev) ||
+		list.Item32Next(chunkController.blockAccessor, chunkPrev) != chunk {
+		return ErrInvalidSpace
+	}
+
+	if chunkNext := chunkController.Next(); !chunkIsInRange(chunkNext) ||
+		list.Item32Prev(chunkController.blockAccessor, chunkNext) != chunk {
+		return ErrInvalidSpace
+	}
+
+	return nil
+}
+
+// calculateChunkSize returns the size of the chunk for space with the
+// given size, which is rounded up to a multiple of the minimum alignment,
+// so that the chunk following it stays aligned.
+func (p *Pool) calculateChunkSize(spaceSize int) int {
+	chunkSize := chunkHeaderSize + spaceSize
+
+	if chunkSize < minChunkSize {
+		chunkSize = minChunkSize
 	}
 
+	return (chunkSize + int(p.minAlignment-1)) &^ int(p.minAlignment-1)
+}
+
+func (p *Pool) getChunkSize(block int64, chunk int32) int {
+	chunkController := chunkController{accessBlock(p.accessSpace(), block), chunk, itemRecorder{}}
 	return int(chunkController.Size())
 }
 
-func (p *Pool) splitChunk(spaceAccessor []byte, block int64, chunkSize int) (int32, int, bool) {
+// splitChunk allocates a chunk with the given size, whose space is aligned
+// to the given alignment, from the free chunks of the given pooled block.
+// When the aligned chunk does not start at the free chunk, the free chunk
+// is kept as a leading free chunk before it. Each free chunk too small for
+// the chunk has a miss counted, and gets dismissed on the maxMissCount-th
+// miss, if countsMisses is true.
+func (p *Pool) splitChunk(spaceAccessor []byte, block int64, chunkSize int, alignment int32, countsMisses bool) (int32, int, bool) {
 	blockAccessor := accessBlock(spaceAccessor, block)
 	blockHeader := blockHeader(blockAccessor)
 	listOfFreeChunks := blockHeader.ListOfFreeChunks()
 	getChunk := getFreeChunks(listOfFreeChunks)
+	itemRecorder := itemRecorder{p, block}
+	p.recordBlockHeader(block)
 
 	for chunk, ok := getChunk(blockAccessor); ok; chunk, ok = getChunk(blockAccessor) {
-		chunkController1 := chunkController{blockAccessor, chunk}
+		chunkController1 := chunkController{blockAccessor, chunk, itemRecorder}
 		chunkSize2 := int(chunkController1.Size())
+		alignedChunk := alignChunk(chunk, alignment)
 
-		if remainingChunkSize := chunkSize2 - chunkSize; remainingChunkSize >= 0 {
+		if remainingChunkSize := chunkSize2 - int(alignedChunk-chunk) - chunkSize; remainingChunkSize >= 0 {
 			if remainingChunkSize < minChunkSize {
-				chunkSize = chunkSize2
+				chunkSize += remainingChunkSize
 				remainingChunkSize = 0
 			} else {
-				if chunkIsViolated(chunk + int32(chunkSize)) {
-					if remainingChunkSize == minChunkSize {
-						chunkSize = chunkSize2
+				if chunkIsViolated(alignedChunk + int32(chunkSize)) {
+					if remainingChunkSize-int(p.minAlignment) < minChunkSize {
+						chunkSize += remainingChunkSize
 						remainingChunkSize = 0
 					} else {
-						chunkSize++
-						remainingChunkSize--
+						chunkSize += int(p.minAlignment)
+						remainingChunkSize -= int(p.minAlignment)
 					}
 				}
 			}
 
+			alignedChunkController := chunkController1
+			listOfChunks := blockHeader.ListOfChunks()
+
+			if alignedChunk != chunk {
+				alignedChunkController = chunkController{blockAccessor, alignedChunk, itemRecorder}
+				alignedChunkController.InsertAfter(&listOfChunks, chunk)
+			}
+
 			if remainingChunkSize >= 1 {
-				remainingChunkController := chunkController{blockAccessor, chunk + int32(chunkSize)}
+				remainingChunkController := chunkController{blockAccessor, alignedChunk + int32(chunkSize), itemRecorder}
 				remainingChunkController.SetUsed(false)
-				listOfChunks := blockHeader.ListOfChunks()
-				remainingChunkController.InsertAfter(&listOfChunks, chunk)
-				blockHeader.SetListOfChunks(listOfChunks)
+				remainingChunkController.InsertAfter(&listOfChunks, alignedChunk)
 				remainingChunkController.SetMissCount(0)
 				remainingChunkController.InsertFreeAfter(&listOfFreeChunks, chunk)
 			}
 
-			chunkController1.SetUsed(true)
+			blockHeader.SetListOfChunks(listOfChunks)
+			alignedChunkController.SetUsed(true)
 			chunkController1.SetAsFirstFree(&listOfFreeChunks)
-			chunkController1.RemoveFree(&listOfFreeChunks)
+
+			if alignedChunk == chunk {
+				chunkController1.RemoveFree(&listOfFreeChunks)
+			}
+
 			blockHeader.SetListOfFreeChunks(listOfFreeChunks)
-			p.listOfPooledBlocks.SetHead(spaceAccessor, block)
+			shard := p.shardOf(block)
+			shard.listOfPooledBlocks.SetHead(spaceAccessor, block)
 
 			if listOfFreeChunks.IsEmpty() {
-				p.listOfPooledBlocks.RemoveItem(spaceAccessor, block)
+				p.removePooledBlock(spaceAccessor, block)
 			}
 
-			return chunk, chunkSize, true
+			return alignedChunk, chunkSize, true
+		}
+
+		if !countsMisses {
+			continue
 		}
 
 		missCount := int(chunkController1.MissCount()) + 1
@@ -171,14 +492,14 @@ func (p *Pool) splitChunk(spaceAccessor []byte, block int64, chunkSize int) (int
 
 		if missCount == maxMissCount {
 			chunkController1.RemoveFree(&listOfFreeChunks)
-			p.dismissedSpaceSize += chunkSize2
+			p.shardOf(block).dismissedSpaceSize += chunkSize2
 		}
 	}
 
 	blockHeader.SetListOfFreeChunks(listOfFreeChunks)
 
 	if listOfFreeChunks.IsEmpty() {
-		p.listOfPooledBlocks.RemoveItem(spaceAccessor, block)
+		p.removePooledBlock(spaceAccessor, block)
 	}
 
 	return 0, 0, false
@@ -186,21 +507,19 @@ func (p *Pool) splitChunk(spaceAccessor []byte, block int64, chunkSize int) (int
 
 func (p *Pool) mergeChunk(spaceAccessor []byte, block int64, chunk int32) int {
 	blockAccessor := accessBlock(spaceAccessor, block)
-	chunkController1 := chunkController{blockAccessor, chunk}
-
-	if !chunkController1.IsUsed() {
-		panic(errInvalidChunk)
-	}
-
+	itemRecorder := itemRecorder{p, block}
+	chunkController1 := chunkController{blockAccessor, chunk, itemRecorder}
 	blockHeader := blockHeader(blockAccessor)
 	listOfChunks := blockHeader.ListOfChunks()
 	listOfFreeChunks := blockHeader.ListOfFreeChunks()
 	listOfFreeChunksWasEmpty := listOfFreeChunks.IsEmpty()
+	shard := p.shardOf(block)
+	p.recordBlockHeader(block)
 
 	if chunkPrev := chunkController1.Prev(); chunkPrev < chunk {
-		if chunkPrevController := (chunkController{blockAccessor, chunkPrev}); !chunkPrevController.IsUsed() {
+		if chunkPrevController := (chunkController{blockAccessor, chunkPrev, itemRecorder}); !chunkPrevController.IsUsed() {
 			if chunkPrevController.MissCount() == maxMissCount {
-				p.dismissedSpaceSize -= int(chunkPrevController.Size())
+				shard.dismissedSpaceSize -= int(chunkPrevController.Size())
 			} else {
 				chunkPrevController.RemoveFree(&listOfFreeChunks)
 			}
@@ -211,9 +530,9 @@ func (p *Pool) mergeChunk(spaceAccessor []byte, block int64, chunk int32) int {
 	}
 
 	if chunkNext := chunkController1.Next(); chunkNext > chunk {
-		if chunkNextController := (chunkController{blockAccessor, chunkNext}); !chunkNextController.IsUsed() {
+		if chunkNextController := (chunkController{blockAccessor, chunkNext, itemRecorder}); !chunkNextController.IsUsed() {
 			if chunkNextController.MissCount() == maxMissCount {
-				p.dismissedSpaceSize -= int(chunkNextController.Size())
+				shard.dismissedSpaceSize -= int(chunkNextController.Size())
 			} else {
 				chunkNextController.RemoveFree(&listOfFreeChunks)
 			}
@@ -229,49 +548,61 @@ func (p *Pool) mergeChunk(spaceAccessor []byte, block int64, chunk int32) int {
 	blockHeader.SetListOfFreeChunks(listOfFreeChunks)
 
 	if !listOfFreeChunksWasEmpty {
-		p.listOfPooledBlocks.RemoveItem(spaceAccessor, block)
+		p.removePooledBlock(spaceAccessor, block)
 	}
 
-	p.listOfPooledBlocks.PrependItem(spaceAccessor, block)
+	p.prependPooledBlock(spaceAccessor, block)
 	return int(chunkController1.Size())
 }
 
-func (p *Pool) allocateBlock(chunkSize int) (int64, int32) {
-	block, _ := p.buddy.MustAllocateBlock(blockSize)
-	spaceAccessor := p.accessSpace()
-	blockAccessor := accessBlock(spaceAccessor, block)
-	chunk := int32(blockHeaderSize)
+// allocateBlock allocates a pooled block with a single free chunk.
+func (p *Pool) allocateBlock() (int64, error) {
+	block, _, err := p.buddy.AllocateBlock(blockSize)
 
-	if chunkIsViolated(chunk + int32(chunkSize)) {
-		chunkSize++
+	if err != nil {
+		return 0, err
 	}
 
-	chunkController1 := chunkController{blockAccessor, chunk}
-	chunkController1.SetUsed(true)
+	spaceAccessor := p.accessSpace()
+	blockAccessor := accessBlock(spaceAccessor, block)
+	p.recordBlockHeader(block)
+	chunkController1 := chunkController{blockAccessor, blockHeaderSize, itemRecorder{p, block}}
+	chunkController1.SetUsed(false)
 	listOfChunks := new(list.List32).Init()
 	chunkController1.Prepend(listOfChunks)
-	remainingChunkController := chunkController{blockAccessor, chunk + int32(chunkSize)}
-	remainingChunkController.SetUsed(false)
-	remainingChunkController.InsertAfter(listOfChunks, chunk)
-	remainingChunkController.SetMissCount(0)
+	chunkController1.SetMissCount(0)
 	listOfFreeChunks := new(list.List32).Init()
-	remainingChunkController.PrependFree(listOfFreeChunks)
+	chunkController1.PrependFree(listOfFreeChunks)
 	blockHeader := blockHeader(blockAccessor)
 	blockHeader.SetListOfChunks(*listOfChunks)
 	blockHeader.SetListOfFreeChunks(*listOfFreeChunks)
-	p.listOfPooledBlocks.PrependItem(spaceAccessor, block)
-	return block, chunk
+	p.prependPooledBlock(spaceAccessor, block)
+	return block, nil
 }
 
-func (p *Pool) freeBlock(spaceAccessor []byte, block int64) {
-	p.listOfPooledBlocks.RemoveItem(spaceAccessor, block)
-	p.buddy.FreeBlock(block)
+func (p *Pool) freeBlock(spaceAccessor []byte, block int64) error {
+	p.removePooledBlock(spaceAccessor, block)
+	return p.buddy.FreeBlock(block)
 }
 
 func (p *Pool) accessSpace() []byte {
 	return p.buddy.SpaceMapper().AccessSpace()
 }
 
+// recordChange reports the given range of the space about to be changed
+// by the pool to the change listener, if any.
+func (p *Pool) recordChange(offset int64, size int) {
+	if p.changeListener != nil && size >= 1 {
+		p.changeListener(offset, size)
+	}
+}
+
+// recordBlockHeader records the chunk lists in the header of the given
+// pooled block, which are about to change.
+func (p *Pool) recordBlockHeader(block int64) {
+	p.recordChange(block+list.ItemSize64, 2*list.Size32)
+}
+
 func (p *Pool) doFprint(writer io.Writer, spaceAccessor []byte, block int64) error {
 	if _, err := fmt.Fprintf(writer, "pooled block %d:", block); err != nil {
 		return err
@@ -283,7 +614,7 @@ func (p *Pool) doFprint(writer io.Writer, spaceAccessor []byte, block int64) err
 	getChunk := listOfChunks.GetItems()
 
 	for chunk, ok := getChunk(blockAccessor); ok; chunk, ok = getChunk(blockAccessor) {
-		chunkController := chunkController{blockAccessor, chunk}
+		chunkController := chunkController{blockAccessor, chunk, itemRecorder{}}
 		var err error
 
 		if chunkController.IsUsed() {
@@ -304,23 +635,89 @@ func (p *Pool) doFprint(writer io.Writer, spaceAccessor []byte, block int64) err
 	return nil
 }
 
+// StateSize is the size of the state of pools, see StoreState.
+const StateSize = 8 + MaxNumberOfShards*(list.Size64+8)
+
+// StoreState stores the state of the pool, i.e. the number of shards and
+// the pooled block list and the dismissed space size of each shard, to the
+// given buffer, which must have a size of StateSize at least. Along with
+// the space, the state is all processes sharing the space need to take
+// turns using the pool, see Builder.LoadState.
+func (p *Pool) StoreState(buffer []byte) {
+	_ = buffer[StateSize-1]
+	binary.BigEndian.PutUint64(buffer, uint64(p.numberOfShards))
+	i := 8
+
+	for j := range p.shards {
+		shard := &p.shards[j]
+		shard.listOfPooledBlocks.Store(buffer[i:])
+		i += list.Size64
+		binary.BigEndian.PutUint64(buffer[i:], uint64(shard.dismissedSpaceSize))
+		i += 8
+	}
+}
+
 // Builder represents a builder of pools of space.
 type Builder struct {
 	p *Pool
 }
 
-// LoadPooledBlockList loads the pooled block list from the given data.
-func (b Builder) LoadPooledBlockList(data []byte) Builder {
-	b.p.listOfPooledBlocks.Load(data)
+// LoadPooledBlockList loads the pooled block list of the given shard
+// from the given data.
+func (b Builder) LoadPooledBlockList(shardIndex int, data []byte) Builder {
+	b.p.shards[shardIndex].listOfPooledBlocks.Load(data)
+	return b
+}
+
+// LoadState loads the state of the pool from the given data stored by
+// StoreState.
+func (b Builder) LoadState(data []byte) Builder {
+	_ = data[StateSize-1]
+	b.p.numberOfShards = int(binary.BigEndian.Uint64(data))
+	i := 8
+
+	for j := range b.p.shards {
+		shard := &b.p.shards[j]
+		shard.listOfPooledBlocks.Load(data[i:])
+		i += list.Size64
+		shard.dismissedSpaceSize = int(binary.BigEndian.Uint64(data[i:]))
+		i += 8
+	}
+
 	return b
 }
 
 // SetDismissedSpaceSize sets the dismissed space size.
 func (b Builder) SetDismissedSpaceSize(dismissedSpaceSize int) Builder {
-	b.p.dismissedSpaceSize = dismissedSpaceSize
+	for i := range b.p.shards {
+		b.p.shards[i].dismissedSpaceSize = 0
+	}
+
+	b.p.shards[0].dismissedSpaceSize = dismissedSpaceSize
 	return b
 }
 
+// SetChangeListener sets the function called with the offset and size of
+// each range of the space holding the bookkeeping of the pool, i.e. the
+// headers and the list items of pooled blocks and chunks, before changing
+// it, or nil for none. The content of space allocated is never reported.
+// The function may be called concurrently by calls on different shards,
+// see AllocateSpaceFromShard.
+func (b Builder) SetChangeListener(changeListener func(int64, int)) Builder {
+	b.p.changeListener = changeListener
+	return b
+}
+
+// SetMinAlignment sets the minimum alignment of space allocated, which
+// must be a power of two less than 64 KiB.
+func (b Builder) SetMinAlignment(minAlignment int) Builder {
+	b.p.minAlignment = int32(minAlignment)
+	return b
+}
+
+// DefaultMinAlignment is the minimum alignment of space allocated from pools by default.
+const DefaultMinAlignment = 8
+
 const (
 	blockSize             = 1 << 20
 	blockPayloadSize      = blockSize - blockHeaderSize
@@ -357,6 +754,7 @@ const blockHeaderSize = list.ItemSize64 + 2*list.Size32
 type chunkController struct {
 	blockAccessor []byte
 	c             int32
+	itemRecorder  itemRecorder
 }
 
 func (cc chunkController) SetUsed(isUsed bool) {
@@ -368,18 +766,22 @@ func (cc chunkController) SetUsed(isUsed bool) {
 		flags = 0
 	}
 
+	cc.itemRecorder.Record(cc.c)
 	list.SetItem32Flags(cc.blockAccessor, cc.c, flags)
 }
 
 func (cc chunkController) Prepend(listOfChunks *list.List32) {
+	cc.recordPrepending(listOfChunks, cc.c)
 	listOfChunks.PrependItem(cc.blockAccessor, cc.c)
 }
 
 func (cc chunkController) InsertAfter(listOfChunks *list.List32, other int32) {
+	cc.recordInsertion(cc.c, other)
 	listOfChunks.InsertItemAfter(cc.blockAccessor, cc.c, other)
 }
 
 func (cc chunkController) Remove(listOfChunks *list.List32) {
+	cc.recordRemoval(cc.c)
 	listOfChunks.RemoveItem(cc.blockAccessor, cc.c)
 }
 
@@ -411,18 +813,22 @@ const (
 )
 
 func (cc chunkController) SetMissCount(missCount int8) {
+	cc.itemRecorder.Record(cc.c + freeListItemOffsetOfChunk)
 	list.SetItem32Flags(cc.blockAccessor, cc.c+freeListItemOffsetOfChunk, missCount)
 }
 
 func (cc chunkController) PrependFree(listOfFreeChunks *list.List32) {
+	cc.recordPrepending(listOfFreeChunks, cc.c+freeListItemOffsetOfChunk)
 	listOfFreeChunks.PrependItem(cc.blockAccessor, cc.c+freeListItemOffsetOfChunk)
 }
 
 func (cc chunkController) InsertFreeAfter(listOfFreeChunks *list.List32, other int32) {
+	cc.recordInsertion(cc.c+freeListItemOffsetOfChunk, other+freeListItemOffsetOfChunk)
 	listOfFreeChunks.InsertItemAfter(cc.blockAccessor, cc.c+freeListItemOffsetOfChunk, other+freeListItemOffsetOfChunk)
 }
 
 func (cc chunkController) RemoveFree(listOfFreeChunks *list.List32) {
+	cc.recordRemoval(cc.c + freeListItemOffsetOfChunk)
 	listOfFreeChunks.RemoveItem(cc.blockAccessor, cc.c+freeListItemOffsetOfChunk)
 }
 
@@ -444,7 +850,56 @@ func (cc chunkController) FreeNext() int32 {
 
 const freeChunkHeaderSize = freeListItemOffsetOfChunk + list.ItemSize32
 
-var errInvalidChunk = errors.New("pool: invalid chunk")
+// recordPrepending records the list items changed by prepending the given
+// item to the given list.
+func (cc chunkController) recordPrepending(l *list.List32, item int32) {
+	if l.IsEmpty() {
+		cc.itemRecorder.Record(item)
+	} else {
+		cc.itemRecorder.Record(item, l.Tail(), l.Head())
+	}
+}
+
+// recordInsertion records the list items changed by inserting the given
+// item after the other one.
+func (cc chunkController) recordInsertion(item int32, other int32) {
+	cc.itemRecorder.Record(item, other, list.Item32Next(cc.blockAccessor, other))
+}
+
+// recordRemoval records the list items changed by removing the given item,
+// including the item itself, whose bytes are free to be overwritten then.
+func (cc chunkController) recordRemoval(item int32) {
+	cc.itemRecorder.Record(item, list.Item32Prev(cc.blockAccessor, item), list.Item32Next(cc.blockAccessor, item))
+}
+
+// itemRecorder records the list items in a pooled block about to change
+// to the change listener of the pool, if any.
+type itemRecorder struct {
+	p     *Pool
+	block int64
+}
+
+func (ir itemRecorder) Record(items ...int32) {
+	if ir.p == nil || ir.p.changeListener == nil {
+		return
+	}
+
+	for _, item := range items {
+		ir.p.changeListener(ir.block+int64(item), list.ItemSize32)
+	}
+}
+
+var (
+	// ErrInvalidSpace is returned when freeing or getting size of an invalid space.
+	ErrInvalidSpace = errors.New("pool: invalid space")
+
+	// ErrInvalidAlignment is returned when allocating space with an invalid alignment.
+	ErrInvalidAlignment = errors.New("pool: invalid alignment")
+)
+
+func chunkIsInRange(chunk int32) bool {
+	return chunk >= blockHeaderSize && chunk <= blockSize-minChunkSize
+}
 
 func makeChunkSpace(block int64, chunk int32) int64 {
 	return block | int64(chunk+chunkHeaderSize)
@@ -464,6 +919,19 @@ func chunkIsViolated(chunk int32) bool {
 	return (chunk+chunkHeaderSize)&(minUnmanagedBlockSize-1) == 0
 }
 
+// alignChunk returns the first chunk, at or after the given free chunk,
+// whose space is aligned to the given alignment, leaving room for a free
+// chunk before it if they differ.
+func alignChunk(chunk int32, alignment int32) int32 {
+	alignedChunk := (chunk+chunkHeaderSize+alignment-1)&^(alignment-1) - chunkHeaderSize
+
+	for (alignedChunk != chunk && alignedChunk-chunk < minChunkSize) || chunkIsViolated(alignedChunk) {
+		alignedChunk += alignment
+	}
+
+	return alignedChunk
+}
+
 func calculateChunkSpaceSize(chunkSize int) int {
 	return chunkSize - chunkHeaderSize
 }
@@ -1,9 +1,11 @@
 package pool_test
 
 import (
+	"errors"
 	"math/rand"
 	"os"
 	"sort"
+	"strings"
 	"testing"
 
 	"github.com/roy2220/fsm/internal/buddy"
@@ -44,7 +46,8 @@ func TestPoolAllocateSpace(t *testing.T) {
 
 	for _, si := range sis {
 		assert.GreaterOrEqual(t, si.Ptr, lastSpaceEnd)
-		ss := p.GetSpaceSize(si.Ptr)
+		assert.Equal(t, int64(0), si.Ptr%pool.DefaultMinAlignment)
+		ss := p.MustGetSpaceSize(si.Ptr)
 		assert.Equal(t, int(si.Size), ss)
 		lastSpaceEnd = si.Ptr + int64(si.Size)
 	}
@@ -58,12 +61,12 @@ func TestPoolFreeSpace(t *testing.T) {
 	})
 
 	for _, si := range sis {
-		p.FreeSpace(si.Ptr)
+		p.MustFreeSpace(si.Ptr)
 	}
 
 	for _, si := range sis {
 		assert.Panics(t, func() {
-			p.FreeSpace(si.Ptr)
+			p.MustFreeSpace(si.Ptr)
 		})
 	}
 
@@ -71,7 +74,7 @@ func TestPoolFreeSpace(t *testing.T) {
 	assert.Equal(t, 0, b.SpaceSize())
 	assert.Equal(t, 0, p.DismissedSpaceSize())
 	buf := [list.Size64]byte{}
-	p.StorePooledBlockList(buf[:])
+	p.StorePooledBlockList(0, buf[:])
 	l := new(list.List64).Init()
 	l.Load(buf[:])
 
@@ -93,7 +96,7 @@ func MakePool(t *testing.T) (*pool.Pool, *buddy.Buddy, []*SpaceInfo) {
 
 		if i%2 == 1 {
 			j := rand.Intn(i + 1)
-			pool1.FreeSpace(sis[j].Ptr)
+			pool1.MustFreeSpace(sis[j].Ptr)
 			tss2 -= sis[j].AllocSize
 			sis[j] = MakeSpaceInfo(t, pool1)
 			tss2 += sis[j].AllocSize
@@ -113,7 +116,7 @@ func MakeSpaceInfo(t *testing.T, pool1 *pool.Pool) *SpaceInfo {
 	f *= f
 	f *= f
 	ss = int(float64(ss) * f)
-	sptr, ss2 := pool1.AllocateSpace(ss)
+	sptr, ss2 := pool1.MustAllocateSpace(ss)
 
 	if !assert.GreaterOrEqual(t, ss2, ss) {
 		t.FailNow()
@@ -121,3 +124,592 @@ func MakeSpaceInfo(t *testing.T, pool1 *pool.Pool) *SpaceInfo {
 
 	return &SpaceInfo{sptr, int32(ss), int32(ss2)}
 }
+
+func TestPoolVerify(t *testing.T) {
+	p, _, _ := MakePool(t)
+	dss, vs := p.Verify()
+	assert.Len(t, vs, 0)
+	assert.Equal(t, p.DismissedSpaceSize(), dss)
+	p.Build().SetDismissedSpaceSize(dss + 1)
+	_, vs = p.Verify()
+	assert.Len(t, vs, 1)
+}
+
+func TestPoolInvalidSpace(t *testing.T) {
+	p, _, sis := MakePool(t)
+
+	for _, s := range []int64{-1, 1, sis[0].Ptr + 1, sis[0].Ptr - 1, 1 << 40} {
+		_, err := p.GetSpaceSize(s)
+		assert.Error(t, err)
+		assert.Error(t, p.FreeSpace(s))
+	}
+
+	_, vs := p.Verify()
+	assert.Len(t, vs, 0)
+}
+
+func TestPoolMapSpaceError(t *testing.T) {
+	spaceMapper := LimitedSpaceMapper{MaxSpaceSize: 8 << 20}
+	buddy := new(buddy.Buddy).Init(&spaceMapper)
+	pool1 := new(pool.Pool).Init(buddy)
+	var ss []int64
+	var err error
+
+	for {
+		var s int64
+
+		if s, _, err = pool1.AllocateSpace(1000); err != nil {
+			break
+		}
+
+		ss = append(ss, s)
+	}
+
+	assert.Equal(t, errSpaceTooLarge, err)
+	_, _, err = pool1.AllocateSpace(10 << 20)
+	assert.Equal(t, errSpaceTooLarge, err)
+	_, vs := pool1.Verify()
+	assert.Len(t, vs, 0)
+
+	for _, s := range ss {
+		assert.NoError(t, pool1.FreeSpace(s))
+	}
+
+	buddy.ShrinkSpace()
+	assert.Equal(t, 0, buddy.SpaceSize())
+}
+
+type LimitedSpaceMapper struct {
+	SpaceMapper
+
+	MaxSpaceSize int
+}
+
+func (lsm *LimitedSpaceMapper) MapSpace(spaceSize int) error {
+	if spaceSize > lsm.MaxSpaceSize {
+		return errSpaceTooLarge
+	}
+
+	return lsm.SpaceMapper.MapSpace(spaceSize)
+}
+
+var errSpaceTooLarge = errors.New("space too large")
+
+func TestPoolReallocateSpace(t *testing.T) {
+	spaceMapper := SpaceMapper{}
+	buddy := new(buddy.Buddy).Init(&spaceMapper)
+	pool1 := new(pool.Pool).Init(buddy)
+	sis := make([]*SpaceInfo, 1000)
+
+	randomSpaceSize := func() int {
+		f := rand.Float64()
+		return int(f * f * f * 200000)
+	}
+
+	fill := func(si *SpaceInfo) {
+		buf := spaceMapper.AccessSpace()[si.Ptr : si.Ptr+int64(si.Size)]
+
+		for i := range buf {
+			buf[i] = byte(si.Ptr) + byte(i)
+		}
+	}
+
+	for i := range sis {
+		s, ss := pool1.MustAllocateSpace(randomSpaceSize())
+		sis[i] = &SpaceInfo{s, 0, int32(ss)}
+		fill(sis[i])
+	}
+
+	for n := 0; n < 20000; n++ {
+		si := sis[rand.Intn(len(sis))]
+		s, ss, err := pool1.ReallocateSpace(si.Ptr, randomSpaceSize())
+
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+
+		buf := spaceMapper.AccessSpace()[s : s+int64(ss)]
+
+		for i := 0; i < len(buf) && i < int(si.Size); i++ {
+			if buf[i] != byte(si.Ptr)+byte(i) {
+				t.Fatalf("content of space %d not preserved at %d", si.Ptr, i)
+			}
+		}
+
+		si.Ptr, si.Size = s, int32(ss)
+		fill(si)
+	}
+
+	_, vs := pool1.Verify()
+	assert.Len(t, vs, 0)
+	_, vs = buddy.Verify()
+	assert.Len(t, vs, 0)
+
+	for _, si := range sis {
+		pool1.MustFreeSpace(si.Ptr)
+	}
+
+	buddy.ShrinkSpace()
+	assert.Equal(t, 0, buddy.SpaceSize())
+	assert.Equal(t, 0, pool1.DismissedSpaceSize())
+}
+
+func TestPoolAllocateSpaceAligned(t *testing.T) {
+	spaceMapper := SpaceMapper{}
+	buddy := new(buddy.Buddy).Init(&spaceMapper)
+	pool1 := new(pool.Pool).Init(buddy)
+	sis := make([]*SpaceInfo, 10000)
+
+	for i := range sis {
+		a := 1 << uint(rand.Intn(18))
+		ss := rand.Intn(2000)
+
+		if i%100 == 0 {
+			ss = rand.Intn(200000)
+		}
+
+		s, ss2 := pool1.MustAllocateSpaceAligned(ss, a)
+
+		if !assert.Equal(t, int64(0), s&int64(a-1)) || !assert.GreaterOrEqual(t, ss2, ss) {
+			t.FailNow()
+		}
+
+		sis[i] = &SpaceInfo{s, int32(ss), int32(ss2)}
+
+		if j := rand.Intn(i + 1); i%3 == 2 && sis[j].Ptr >= 0 {
+			pool1.MustFreeSpace(sis[j].Ptr)
+			sis[j] = &SpaceInfo{Ptr: -1}
+		}
+	}
+
+	sort.Slice(sis, func(i, j int) bool {
+		return sis[i].Ptr < sis[j].Ptr
+	})
+
+	lastSpaceEnd := int64(0)
+
+	for _, si := range sis {
+		if si.Ptr < 0 {
+			continue
+		}
+
+		assert.GreaterOrEqual(t, si.Ptr, lastSpaceEnd)
+		assert.Equal(t, int(si.Size), pool1.MustGetSpaceSize(si.Ptr))
+		lastSpaceEnd = si.Ptr + int64(si.Size)
+	}
+
+	_, vs := pool1.Verify()
+	assert.Len(t, vs, 0)
+
+	for _, a := range []int{0, -1, 3, 48, 1 << 33} {
+		_, _, err := pool1.AllocateSpaceAligned(100, a)
+		assert.Equal(t, pool.ErrInvalidAlignment, err)
+	}
+
+	for _, si := range sis {
+		if si.Ptr >= 0 {
+			pool1.MustFreeSpace(si.Ptr)
+		}
+	}
+
+	buddy.ShrinkSpace()
+	assert.Equal(t, 0, buddy.SpaceSize())
+	assert.Equal(t, 0, pool1.DismissedSpaceSize())
+}
+
+func TestPoolMinAlignment(t *testing.T) {
+	spaceMapper := SpaceMapper{}
+	buddy := new(buddy.Buddy).Init(&spaceMapper)
+	pool1 := new(pool.Pool).Init(buddy)
+	pool1.Build().SetMinAlignment(16)
+	ss := make([]int64, 1000)
+
+	for i := range ss {
+		ss[i], _ = pool1.MustAllocateSpace(rand.Intn(1000))
+	}
+
+	for n := 0; n < 20000; n++ {
+		i := rand.Intn(len(ss))
+
+		if n%2 == 0 {
+			pool1.MustFreeSpace(ss[i])
+			ss[i], _ = pool1.MustAllocateSpace(rand.Intn(1000))
+		} else {
+			s, _, err := pool1.ReallocateSpace(ss[i], rand.Intn(1000))
+
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+
+			ss[i] = s
+		}
+
+		if !assert.Equal(t, int64(0), ss[i]%16) {
+			t.FailNow()
+		}
+	}
+
+	_, vs := pool1.Verify()
+	assert.Len(t, vs, 0)
+
+	for _, s := range ss {
+		pool1.MustFreeSpace(s)
+	}
+
+	buddy.ShrinkSpace()
+	assert.Equal(t, 0, buddy.SpaceSize())
+	assert.Equal(t, 0, pool1.DismissedSpaceSize())
+}
+
+func TestPoolAllocateSpaces(t *testing.T) {
+	spaceMapper := SpaceMapper{}
+	buddy := new(buddy.Buddy).Init(&spaceMapper)
+	pool1 := new(pool.Pool).Init(buddy)
+	s, _ := pool1.MustAllocateSpace(100)
+	sss := make([]int, 10000)
+
+	for i := range sss {
+		sss[i] = rand.Intn(200)
+
+		if i%1000 == 0 {
+			sss[i] = 100000 + rand.Intn(100000)
+		}
+	}
+
+	ss := pool1.MustAllocateSpaces(sss)
+	n := 0
+
+	for i := range ss {
+		assert.GreaterOrEqual(t, pool1.MustGetSpaceSize(ss[i]), sss[i])
+
+		if i >= 1 && ss[i] > ss[i-1] && ss[i]-ss[i-1] <= 256 {
+			n++
+		}
+	}
+
+	assert.Greater(t, n, len(ss)*9/10)
+	_, vs := pool1.Verify()
+	assert.Len(t, vs, 0)
+	assert.Equal(t, pool.ErrInvalidSpace, pool1.FreeSpaces([]int64{ss[0], ss[1], ss[0]}))
+	assert.Error(t, pool1.FreeSpaces([]int64{ss[0], ss[1], ss[1] + 1}))
+	ss = append(ss, s)
+	rand.Shuffle(len(ss), func(i, j int) { ss[i], ss[j] = ss[j], ss[i] })
+	pool1.MustFreeSpaces(ss)
+	_, vs = pool1.Verify()
+	assert.Len(t, vs, 0)
+	buddy.ShrinkSpace()
+	assert.Equal(t, 0, buddy.SpaceSize())
+	assert.Equal(t, 0, pool1.DismissedSpaceSize())
+}
+
+func TestPoolAllocateSpacesMixed(t *testing.T) {
+	spaceMapper := SpaceMapper{}
+	buddy := new(buddy.Buddy).Init(&spaceMapper)
+	pool1 := new(pool.Pool).Init(buddy)
+	var ss []int64
+
+	// leave small free chunks in a pooled block
+	for i := 0; i < 8000; i++ {
+		s, _ := pool1.MustAllocateSpace(100)
+		ss = append(ss, s)
+	}
+
+	for i := 0; i < len(ss); i += 2 {
+		pool1.MustFreeSpace(ss[i])
+	}
+
+	dismissedSpaceSize := pool1.DismissedSpaceSize()
+	sss := []int{100}
+
+	for i := 0; i < 1500; i++ {
+		sss = append(sss, 1000)
+	}
+
+	ss = pool1.MustAllocateSpaces(sss)
+
+	for i := range ss {
+		assert.GreaterOrEqual(t, pool1.MustGetSpaceSize(ss[i]), sss[i])
+	}
+
+	// no misses are counted for the small free chunks tried for the batch
+	assert.Equal(t, dismissedSpaceSize, pool1.DismissedSpaceSize())
+	_, vs := pool1.Verify()
+	assert.Len(t, vs, 0)
+}
+
+func TestPoolAllocateZeroedSpace(t *testing.T) {
+	spaceMapper := SpaceMapper{}
+	buddy := new(buddy.Buddy).Init(&spaceMapper)
+	pool1 := new(pool.Pool).Init(buddy)
+	ss := make([]int64, 2000)
+
+	for i := range ss {
+		if i%10 == 0 {
+			ss[i], _ = pool1.MustAllocateZeroedSpace(100000 + rand.Intn(100000))
+		} else {
+			ss[i], _ = pool1.MustAllocateZeroedSpace(1 + rand.Intn(300))
+		}
+
+		buf := spaceMapper.AccessSpace()[ss[i] : ss[i]+int64(pool1.MustGetSpaceSize(ss[i]))]
+
+		if !assert.Equal(t, make([]byte, len(buf)), buf) {
+			t.FailNow()
+		}
+
+		for j := range buf {
+			buf[j] = 0xFF
+		}
+	}
+
+	assert.Equal(t, buddy.UsedSpaceSize(), buddy.DirtySpaceSize())
+	rand.Shuffle(len(ss), func(i, j int) { ss[i], ss[j] = ss[j], ss[i] })
+
+	for i := range ss[:len(ss)/2] {
+		pool1.MustFreeSpace(ss[i])
+		ss[i], _ = pool1.MustAllocateZeroedSpace(1 + rand.Intn(1000))
+		buf := spaceMapper.AccessSpace()[ss[i] : ss[i]+int64(pool1.MustGetSpaceSize(ss[i]))]
+
+		if !assert.Equal(t, make([]byte, len(buf)), buf) {
+			t.FailNow()
+		}
+	}
+
+	_, vs := pool1.Verify()
+	assert.Len(t, vs, 0)
+}
+
+func TestPoolAllocateSpacesInShard(t *testing.T) {
+	spaceMapper := SpaceMapper{}
+	buddy := new(buddy.Buddy).Init(&spaceMapper)
+	pool1 := new(pool.Pool).Init(buddy)
+	pool1.Build().SetNumberOfShards(4).SetMinAlignment(64)
+	sss := make([]int, 40000)
+
+	for i := range sss {
+		sss[i] = 100
+	}
+
+	ss := pool1.MustAllocateSpaces(sss)
+
+	for i := 0; i < len(ss); i += 2 {
+		pool1.MustFreeSpace(ss[i])
+	}
+
+	for i := 0; i < 4; i++ {
+		ss, err := pool1.AllocateSpacesInShard(i, sss[:1000])
+
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+
+		for _, s := range ss {
+			assert.Equal(t, i, pool1.ShardOf(s))
+			assert.Equal(t, int64(0), s%64)
+		}
+	}
+
+	_, vs := pool1.Verify()
+	assert.Len(t, vs, 0)
+}
+
+func TestPoolShards(t *testing.T) {
+	spaceMapper := SpaceMapper{}
+	buddy := new(buddy.Buddy).Init(&spaceMapper)
+	pool1 := new(pool.Pool).Init(buddy)
+	pool1.Build().SetNumberOfShards(4)
+	assert.Equal(t, 4, pool1.NumberOfShards())
+	ss := make([]int64, 4000)
+
+	for i := range ss {
+		s, _, err := pool1.AllocateSpaceInShard(i%4, 1+rand.Intn(300))
+
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+
+		if shardIndex := pool1.ShardOf(s); shardIndex < 0 || shardIndex >= 4 {
+			t.Fatalf("shard index %d", shardIndex)
+		}
+
+		ss[i] = s
+	}
+
+	s, _ := pool1.MustAllocateSpace(100000)
+	assert.Equal(t, -1, pool1.ShardOf(s))
+	ok, err := pool1.FreeSpaceToShard(s)
+	assert.False(t, ok)
+	assert.NoError(t, err)
+	pool1.MustFreeSpace(s)
+	rand.Shuffle(len(ss), func(i, j int) { ss[i], ss[j] = ss[j], ss[i] })
+	n := 0
+
+	for _, s := range ss[:len(ss)/2] {
+		ok, err := pool1.FreeSpaceToShard(s)
+
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+
+		if ok {
+			n++
+		} else {
+			pool1.MustFreeSpace(s)
+		}
+	}
+
+	assert.NotEqual(t, 0, n)
+	ss = ss[len(ss)/2:]
+	_, err = pool1.FreeSpaceToShard(ss[0] + 1)
+	assert.Equal(t, pool.ErrInvalidSpace, err)
+
+	for i := 0; i < 4; i++ {
+		for {
+			s, _, ok := pool1.AllocateSpaceFromShard(i, 1+rand.Intn(300))
+
+			if !ok {
+				break
+			}
+
+			if !assert.Equal(t, i, pool1.ShardOf(s)) {
+				t.FailNow()
+			}
+
+			ss = append(ss, s)
+		}
+	}
+
+	_, vs := pool1.Verify()
+	assert.Len(t, vs, 0)
+	dismissedSpaceSize := pool1.DismissedSpaceSize()
+
+	for _, numberOfShards := range []int{3, pool.MaxNumberOfShards, 1} {
+		pool1.Build().SetNumberOfShards(numberOfShards)
+		assert.Equal(t, numberOfShards, pool1.NumberOfShards())
+		assert.Equal(t, dismissedSpaceSize, pool1.DismissedSpaceSize())
+		_, vs := pool1.Verify()
+		assert.Len(t, vs, 0)
+	}
+
+	for _, s := range ss {
+		pool1.MustFreeSpace(s)
+	}
+
+	assert.Equal(t, 0, buddy.AllocatedSpaceSize())
+}
+
+func TestPoolChangeListener(t *testing.T) {
+	spaceMapper := SpaceMapper{}
+	buddy := new(buddy.Buddy).Init(&spaceMapper)
+	pool1 := new(pool.Pool).Init(buddy)
+	type Change struct {
+		Offset   int64
+		PreImage []byte
+	}
+	var changes []Change
+	pool1.Build().SetNumberOfShards(2).SetChangeListener(func(offset int64, size int) {
+		preImage := append([]byte(nil), spaceMapper.AccessSpace()[offset:offset+int64(size)]...)
+		changes = append(changes, Change{offset, preImage})
+	})
+	var ss []int64
+
+	for i := 0; i < 3000; i++ {
+		s, _ := pool1.MustAllocateSpace(2000)
+		ss = append(ss, s)
+	}
+
+	rand.Shuffle(len(ss), func(i, j int) { ss[i], ss[j] = ss[j], ss[i] })
+
+	for _, s := range ss[:2000] {
+		pool1.MustFreeSpace(s)
+	}
+
+	ss = ss[2000:]
+
+	// f returns the space allocated, if any, whose content is not reported
+	check := func(f func() int64) {
+		oldSpace := append([]byte(nil), spaceMapper.AccessSpace()...)
+		changes = changes[:0]
+		s := f()
+		space := append([]byte(nil), spaceMapper.AccessSpace()...)
+		sEnd := s
+
+		if s >= 0 {
+			sEnd += int64(pool1.MustGetSpaceSize(s))
+		}
+
+		// undo the changes with the pre-images
+		for i := len(changes) - 1; i >= 0; i-- {
+			copy(space[changes[i].Offset:], changes[i].PreImage)
+		}
+
+		for i := 0; i < len(oldSpace) && i < len(space); i++ {
+			if int64(i) >= s && int64(i) < sEnd {
+				continue
+			}
+
+			if oldSpace[i] != space[i] {
+				t.Fatalf("offset %d", i)
+			}
+		}
+	}
+
+	for i := 0; i < 300; i++ {
+		switch k := rand.Intn(10); {
+		case k < 4 || len(ss) == 0:
+			check(func() int64 {
+				s, _ := pool1.MustAllocateSpace(1 + rand.Intn(3000))
+				ss = append(ss, s)
+				return -1
+			})
+		case k < 5:
+			check(func() int64 {
+				s, _ := pool1.MustAllocateZeroedSpace(1 + rand.Intn(70000))
+				ss = append(ss, s)
+				return s
+			})
+		case k < 7:
+			n := rand.Intn(len(ss))
+			check(func() int64 { pool1.MustFreeSpace(ss[n]); return -1 })
+			ss = append(ss[:n], ss[n+1:]...)
+		case k < 8:
+			n := rand.Intn(len(ss))
+			check(func() int64 { ss[n], _, _ = pool1.ReallocateSpace(ss[n], 1+rand.Intn(3000)); return ss[n] })
+		default:
+			n := rand.Intn(len(ss))
+			check(func() int64 {
+				if ok, _ := pool1.FreeSpaceToShard(ss[n]); !ok {
+					pool1.MustFreeSpace(ss[n])
+				}
+
+				return -1
+			})
+			ss = append(ss[:n], ss[n+1:]...)
+		}
+
+		if len(ss) >= 1 {
+			s := ss[len(ss)-1]
+			rand.Read(spaceMapper.AccessSpace()[s : s+int64(pool1.MustGetSpaceSize(s))])
+		}
+	}
+
+	check(func() int64 { pool1.Build().SetNumberOfShards(3); return -1 })
+	_, vs := pool1.Verify()
+	assert.Len(t, vs, 0)
+}
+
+func TestPoolState(t *testing.T) {
+	p, buddy, _ := MakePool(t)
+	p.Build().SetNumberOfShards(3)
+	state := make([]byte, pool.StateSize)
+	p.StoreState(state)
+	p2 := new(pool.Pool).Init(buddy)
+	p2.Build().LoadState(state)
+	assert.Equal(t, p.NumberOfShards(), p2.NumberOfShards())
+	assert.Equal(t, p.DismissedSpaceSize(), p2.DismissedSpaceSize())
+	s1, s2 := &strings.Builder{}, &strings.Builder{}
+	p.Fprint(s1)
+	p2.Fprint(s2)
+	assert.Equal(t, s1.String(), s2.String())
+	_, vs := p2.Verify()
+	assert.Len(t, vs, 0)
+}
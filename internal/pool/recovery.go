@@ -0,0 +1,120 @@
+package pool
+
+import (
+	"fmt"
+
+	"github.com/roy2220/fsm/internal/list"
+)
+
+// BlockSize is the size of blocks pooled.
+const BlockSize = blockSize
+
+// IsPooledBlock reports whether the given block of the buddy system
+// looks like a pooled block, by checking the chunk list in it.
+func (p *Pool) IsPooledBlock(block int64) bool {
+	return checkChunkList(accessBlock(p.accessSpace(), block)) == nil
+}
+
+// GetSpaces calls the given callback with each space, and it's size,
+// allocated from the given pooled block.
+func (p *Pool) GetSpaces(block int64, callback func(int64, int)) {
+	blockAccessor := accessBlock(p.accessSpace(), block)
+	listOfChunks := blockHeader(blockAccessor).ListOfChunks()
+	getChunk := listOfChunks.GetItems()
+
+	for chunk, ok := getChunk(blockAccessor); ok; chunk, ok = getChunk(blockAccessor) {
+		if chunkController := (chunkController{blockAccessor, chunk, itemRecorder{}}); chunkController.IsUsed() {
+			callback(makeChunkSpace(block, chunk), calculateChunkSpaceSize(int(chunkController.Size())))
+		}
+	}
+}
+
+// RecoverPooledBlock rebuilds the free chunk list of the given pooled
+// block from the chunk list in it, merging adjacent free chunks and
+// undoing chunk dismissal, then adds the block to the pooled block list
+// of the shard owning it if it has any free chunks. The chunk list must
+// have been checked by IsPooledBlock.
+func (b Builder) RecoverPooledBlock(block int64) Builder {
+	spaceAccessor := b.p.accessSpace()
+	blockAccessor := accessBlock(spaceAccessor, block)
+	blockHeader := blockHeader(blockAccessor)
+	listOfChunks := blockHeader.ListOfChunks()
+	listOfFreeChunks := new(list.List32).Init()
+	b.p.recordChange(block, blockSize)
+	getChunk := listOfChunks.GetItems()
+	lastChunkIsFree := false
+
+	for chunk, ok := getChunk(blockAccessor); ok; chunk, ok = getChunk(blockAccessor) {
+		chunkController := chunkController{blockAccessor, chunk, itemRecorder{}}
+
+		if chunkController.IsUsed() {
+			lastChunkIsFree = false
+			continue
+		}
+
+		if lastChunkIsFree {
+			chunkController.Remove(&listOfChunks)
+			continue
+		}
+
+		chunkController.SetUsed(false)
+		chunkController.SetMissCount(0)
+		chunkController.PrependFree(listOfFreeChunks)
+		lastChunkIsFree = true
+	}
+
+	blockHeader.SetListOfChunks(listOfChunks)
+	blockHeader.SetListOfFreeChunks(*listOfFreeChunks)
+
+	if !listOfFreeChunks.IsEmpty() {
+		b.p.prependPooledBlock(spaceAccessor, block)
+	}
+
+	return b
+}
+
+// checkChunkList checks the chunk list in the given pooled block.
+func checkChunkList(blockAccessor []byte) error {
+	blockHeader := blockHeader(blockAccessor)
+	listOfChunks := blockHeader.ListOfChunks()
+
+	if listOfChunks.IsEmpty() {
+		return fmt.Errorf("pool: empty chunk list")
+	}
+
+	firstChunk := listOfChunks.Head()
+
+	if firstChunk != blockHeaderSize {
+		return fmt.Errorf("pool: bad first chunk %d", firstChunk)
+	}
+
+	for chunk := firstChunk; ; {
+		if flags := list.Item32Flags(blockAccessor, chunk); flags != 0 && flags != int8(chunk%3+1) {
+			return fmt.Errorf("pool: bad flags %d of chunk %d", flags, chunk)
+		}
+
+		chunkNext := list.Item32Next(blockAccessor, chunk)
+
+		if chunkNext == firstChunk {
+			if lastChunk := listOfChunks.Tail(); chunk != lastChunk {
+				return fmt.Errorf("pool: bad last chunk %d, expected %d", lastChunk, chunk)
+			}
+
+			if chunkPrev := list.Item32Prev(blockAccessor, firstChunk); chunkPrev != chunk {
+				return fmt.Errorf("pool: bad predecessor %d of chunk %d, expected %d", chunkPrev, firstChunk, chunk)
+			}
+
+			return nil
+		}
+
+		if chunkNext < chunk+minChunkSize || chunkNext > blockSize-minChunkSize {
+			return fmt.Errorf("pool: bad successor %d of chunk %d", chunkNext, chunk)
+		}
+
+		if chunkPrev := list.Item32Prev(blockAccessor, chunkNext); chunkPrev != chunk {
+			return fmt.Errorf("pool: bad predecessor %d of chunk %d, expected %d", chunkPrev, chunkNext, chunk)
+		}
+
+		chunk = chunkNext
+	}
+}
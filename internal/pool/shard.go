@@ -0,0 +1,219 @@
+package pool
+
+import "github.com/roy2220/fsm/internal/list"
+
+// MaxNumberOfShards is the maximum number of shards of pools.
+const MaxNumberOfShards = 16
+
+// NumberOfShards returns the number of shards of the pool.
+// Each shard has a pooled block list of its own, and pooled
+// blocks are distributed among shards by block address.
+func (p *Pool) NumberOfShards() int {
+	return p.numberOfShards
+}
+
+// ShardOf returns the index of the shard owning the pooled block which
+// the given space is allocated from, or -1 if the space is not allocated
+// from pooled blocks.
+func (p *Pool) ShardOf(space int64) int {
+	block, _, ok := parseChunkSpace(space)
+
+	if !ok {
+		return -1
+	}
+
+	return p.locateShard(block)
+}
+
+// AllocateSpaceInShard is like AllocateSpace but small space is allocated
+// from the pooled blocks of the given shard in preference to those of the
+// other shards.
+func (p *Pool) AllocateSpaceInShard(shardIndex int, spaceSize int) (int64, int, error) {
+	return p.allocateSpace(shardIndex, spaceSize, int(p.minAlignment))
+}
+
+// AllocateSpaceFromShard allocates small space with the given size only
+// from the pooled blocks of the given shard, without allocating blocks from
+// the buddy system, returns it, it's actual size and true, or false if it
+// can't. It touches nothing but the shard and the pooled blocks owned by
+// the shard, so calls on different shards can run in parallel.
+func (p *Pool) AllocateSpaceFromShard(shardIndex int, spaceSize int) (int64, int, bool) {
+	chunkSize := p.calculateChunkSize(spaceSize)
+
+	if chunkSize > maxChunkSize {
+		return 0, 0, false
+	}
+
+	block, chunk, chunkSize, ok := p.splitChunkOfShard(shardIndex, p.accessSpace(), chunkSize, p.minAlignment)
+
+	if !ok {
+		return 0, 0, false
+	}
+
+	return makeChunkSpace(block, chunk), calculateChunkSpaceSize(chunkSize), true
+}
+
+// FreeSpaceToShard releases the given space back to the shard owning the
+// pooled block which the space is allocated from, without releasing blocks
+// to the buddy system, returns true, or false if it can't, i.e. the space
+// is not allocated from pooled blocks or is the last one of the pooled
+// block. Like AllocateSpaceFromShard, calls on different shards can run in
+// parallel.
+func (p *Pool) FreeSpaceToShard(space int64) (bool, error) {
+	block, chunk, ok := parseChunkSpace(space)
+
+	if !ok {
+		return false, nil
+	}
+
+	if err := p.checkChunk(block, chunk); err != nil {
+		return false, err
+	}
+
+	spaceAccessor := p.accessSpace()
+
+	if chunkIsLastUsed(accessBlock(spaceAccessor, block), chunk) {
+		return false, nil
+	}
+
+	p.mergeChunk(spaceAccessor, block, chunk)
+	return true, nil
+}
+
+func (p *Pool) splitChunkOfShard(shardIndex int, spaceAccessor []byte, chunkSize int, alignment int32) (int64, int32, int, bool) {
+	getBlock := p.shards[shardIndex].listOfPooledBlocks.GetItems()
+
+	for block, ok := getBlock(spaceAccessor); ok; block, ok = getBlock(spaceAccessor) {
+		if chunk, chunkSize, ok := p.splitChunk(spaceAccessor, block, chunkSize, alignment, true); ok {
+			return block, chunk, chunkSize, true
+		}
+	}
+
+	return 0, 0, 0, false
+}
+
+func (p *Pool) shardOf(block int64) *shard {
+	return &p.shards[p.locateShard(block)]
+}
+
+func (p *Pool) locateShard(block int64) int {
+	return int(block/blockSize) % p.numberOfShards
+}
+
+// SetNumberOfShards sets the number of shards of pools to the given value,
+// which must be between 1 and MaxNumberOfShards, and moves pooled blocks
+// to the shards owning them accordingly.
+func (b Builder) SetNumberOfShards(numberOfShards int) Builder {
+	p := b.p
+
+	if numberOfShards == p.numberOfShards {
+		return b
+	}
+
+	spaceAccessor := p.accessSpace()
+	var blocks []int64
+	dismissedSpaceSize := 0
+
+	for i := 0; i < p.numberOfShards; i++ {
+		shard := &p.shards[i]
+		getBlock := shard.listOfPooledBlocks.GetItems()
+
+		for block, ok := getBlock(spaceAccessor); ok; block, ok = getBlock(spaceAccessor) {
+			blocks = append(blocks, block)
+		}
+
+		dismissedSpaceSize += shard.dismissedSpaceSize
+		shard.Init()
+	}
+
+	p.numberOfShards = numberOfShards
+	p.shards[0].dismissedSpaceSize = dismissedSpaceSize
+
+	for _, block := range blocks {
+		p.appendPooledBlock(spaceAccessor, block)
+	}
+
+	return b
+}
+
+// prependPooledBlock prepends the given pooled block to the pooled block
+// list of the shard owning it.
+func (p *Pool) prependPooledBlock(spaceAccessor []byte, block int64) {
+	listOfPooledBlocks := &p.shardOf(block).listOfPooledBlocks
+	p.recordListChange(listOfPooledBlocks, block)
+	listOfPooledBlocks.PrependItem(spaceAccessor, block)
+}
+
+// appendPooledBlock appends the given pooled block to the pooled block
+// list of the shard owning it.
+func (p *Pool) appendPooledBlock(spaceAccessor []byte, block int64) {
+	listOfPooledBlocks := &p.shardOf(block).listOfPooledBlocks
+	p.recordListChange(listOfPooledBlocks, block)
+	listOfPooledBlocks.AppendItem(spaceAccessor, block)
+}
+
+// removePooledBlock removes the given pooled block from the pooled block
+// list of the shard owning it.
+func (p *Pool) removePooledBlock(spaceAccessor []byte, block int64) {
+	if p.changeListener != nil {
+		// the list items of the blocks linked to the block get changed,
+		// and the list item of the block is free to be overwritten then
+		p.recordChange(block, list.ItemSize64)
+		p.recordChange(list.Item64Prev(spaceAccessor, block), list.ItemSize64)
+		p.recordChange(list.Item64Next(spaceAccessor, block), list.ItemSize64)
+	}
+
+	p.shardOf(block).listOfPooledBlocks.RemoveItem(spaceAccessor, block)
+}
+
+// recordListChange records the list items changed by inserting the given
+// pooled block between the tail and the head of the given pooled block list.
+func (p *Pool) recordListChange(listOfPooledBlocks *list.List64, block int64) {
+	p.recordChange(block, list.ItemSize64)
+
+	if !listOfPooledBlocks.IsEmpty() {
+		p.recordChange(listOfPooledBlocks.Tail(), list.ItemSize64)
+		p.recordChange(listOfPooledBlocks.Head(), list.ItemSize64)
+	}
+}
+
+type shard struct {
+	listOfPooledBlocks list.List64
+	dismissedSpaceSize int
+}
+
+func (s *shard) Init() *shard {
+	s.listOfPooledBlocks.Init()
+	s.dismissedSpaceSize = 0
+	return s
+}
+
+// chunkIsLastUsed reports whether the given used chunk is the only one
+// used in the given pooled block, i.e. releasing the chunk leaves the
+// pooled block entirely free.
+func chunkIsLastUsed(blockAccessor []byte, chunk int32) bool {
+	chunkController1 := chunkController{blockAccessor, chunk, itemRecorder{}}
+	chunkSize := int(chunkController1.Size())
+
+	if chunkPrev := chunkController1.Prev(); chunkPrev < chunk {
+		chunkPrevController := chunkController{blockAccessor, chunkPrev, itemRecorder{}}
+
+		if chunkPrevController.IsUsed() {
+			return false
+		}
+
+		chunkSize += int(chunkPrevController.Size())
+	}
+
+	if chunkNext := chunkController1.Next(); chunkNext > chunk {
+		chunkNextController := chunkController{blockAccessor, chunkNext, itemRecorder{}}
+
+		if chunkNextController.IsUsed() {
+			return false
+		}
+
+		chunkSize += int(chunkNextController.Size())
+	}
+
+	return chunkSize == blockPayloadSize
+}
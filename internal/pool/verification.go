@@ -0,0 +1,184 @@
+package pool
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/roy2220/fsm/internal/list"
+)
+
+// Verify walks the chunk list and the free chunk list of every pooled
+// block in the pool, returns the dismissed space size recomputed and the
+// descriptions of the violations found.
+func (p *Pool) Verify() (int, []string) {
+	spaceAccessor := p.accessSpace()
+	pooledBlocks := map[int64]bool{}
+	var violations []string
+
+	for i := 0; i < p.numberOfShards; i++ {
+		violations = append(violations, p.verifyListOfPooledBlocks(spaceAccessor, i, pooledBlocks)...)
+	}
+
+	p.buddy.GetAllocatedBlocks(func(block int64, blockSize2 int) {
+		if _, ok := pooledBlocks[block]; !ok && blockSize2 == blockSize && p.IsPooledBlock(block) {
+			pooledBlocks[block] = false
+		}
+	})
+
+	blocks := make([]int64, 0, len(pooledBlocks))
+
+	for block := range pooledBlocks {
+		blocks = append(blocks, block)
+	}
+
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i] < blocks[j] })
+	dismissedSpaceSize := 0
+
+	for _, block := range blocks {
+		dismissedChunkSize, hasFreeChunks, violations2 := verifyBlock(accessBlock(spaceAccessor, block))
+
+		for _, violation := range violations2 {
+			violations = append(violations, fmt.Sprintf("pooled block %d: %s", block, violation))
+		}
+
+		if isListed := pooledBlocks[block]; isListed != hasFreeChunks {
+			violations = append(violations, fmt.Sprintf("pooled block %d: listed=%v, has free chunks=%v",
+				block, isListed, hasFreeChunks))
+		}
+
+		dismissedSpaceSize += dismissedChunkSize
+	}
+
+	if dismissedSpaceSize2 := p.DismissedSpaceSize(); dismissedSpaceSize != dismissedSpaceSize2 {
+		violations = append(violations, fmt.Sprintf("dismissed space size %d, expected %d",
+			dismissedSpaceSize2, dismissedSpaceSize))
+	}
+
+	return dismissedSpaceSize, violations
+}
+
+func (p *Pool) verifyListOfPooledBlocks(spaceAccessor []byte, shardIndex int, pooledBlocks map[int64]bool) []string {
+	listOfPooledBlocks := &p.shards[shardIndex].listOfPooledBlocks
+
+	if listOfPooledBlocks.IsEmpty() {
+		return nil
+	}
+
+	lastBlock := listOfPooledBlocks.Tail()
+
+	for block := listOfPooledBlocks.Head(); ; {
+		if block < 0 || block&(blockSize-1) != 0 || block+blockSize > int64(len(spaceAccessor)) {
+			return []string{fmt.Sprintf("bad block %d in pooled block list %d", block, shardIndex)}
+		}
+
+		if blockSize2, err := p.buddy.GetBlockSize(block); err != nil || blockSize2 != blockSize {
+			return []string{fmt.Sprintf("unallocated block %d in pooled block list %d", block, shardIndex)}
+		}
+
+		if _, ok := pooledBlocks[block]; ok {
+			return []string{fmt.Sprintf("pooled block list %d looped at block %d", shardIndex, block)}
+		}
+
+		if err := checkChunkList(accessBlock(spaceAccessor, block)); err != nil {
+			return []string{fmt.Sprintf("bad block %d in pooled block list %d: %v", block, shardIndex, err)}
+		}
+
+		if shardIndex2 := p.locateShard(block); shardIndex2 != shardIndex {
+			return []string{fmt.Sprintf("block %d of shard %d in pooled block list %d", block, shardIndex2, shardIndex)}
+		}
+
+		pooledBlocks[block] = true
+
+		if block == lastBlock {
+			return nil
+		}
+
+		blockNext := list.Item64Next(spaceAccessor, block)
+
+		if blockPrev := list.Item64Prev(spaceAccessor, blockNext&^(blockSize-1)); blockNext&(blockSize-1) == 0 && blockPrev != block {
+			return []string{fmt.Sprintf("bad predecessor %d of block %d in pooled block list %d", blockPrev, blockNext, shardIndex)}
+		}
+
+		block = blockNext
+	}
+}
+
+func verifyBlock(blockAccessor []byte) (int, bool, []string) {
+	if err := checkChunkList(blockAccessor); err != nil {
+		return 0, false, []string{err.Error()}
+	}
+
+	var violations []string
+	blockHeader := blockHeader(blockAccessor)
+	listOfChunks := blockHeader.ListOfChunks()
+	freeChunks := map[int32]bool{}
+	getChunk := listOfChunks.GetItems()
+	lastChunkIsFree := false
+
+	for chunk, ok := getChunk(blockAccessor); ok; chunk, ok = getChunk(blockAccessor) {
+		if (chunkController{blockAccessor, chunk, itemRecorder{}}).IsUsed() {
+			lastChunkIsFree = false
+			continue
+		}
+
+		if lastChunkIsFree {
+			violations = append(violations, fmt.Sprintf("adjacent free chunk %d not merged", chunk))
+		}
+
+		freeChunks[chunk] = false
+		lastChunkIsFree = true
+	}
+
+	listOfFreeChunks := blockHeader.ListOfFreeChunks()
+	hasFreeChunks := !listOfFreeChunks.IsEmpty()
+
+	if hasFreeChunks {
+		lastChunk := listOfFreeChunks.Tail() - freeListItemOffsetOfChunk
+
+		for chunk := listOfFreeChunks.Head() - freeListItemOffsetOfChunk; ; {
+			isListed, ok := freeChunks[chunk]
+
+			if !ok {
+				violations = append(violations, fmt.Sprintf("bad chunk %d in free chunk list", chunk))
+				break
+			}
+
+			if isListed {
+				violations = append(violations, fmt.Sprintf("free chunk list looped at chunk %d", chunk))
+				break
+			}
+
+			freeChunks[chunk] = true
+
+			if missCount := (chunkController{blockAccessor, chunk, itemRecorder{}}).MissCount(); missCount >= maxMissCount {
+				violations = append(violations, fmt.Sprintf("dismissed chunk %d in free chunk list", chunk))
+			}
+
+			if chunk == lastChunk {
+				break
+			}
+
+			chunk = (chunkController{blockAccessor, chunk, itemRecorder{}}).FreeNext()
+		}
+	}
+
+	dismissedChunkSize := 0
+
+	for chunk, isListed := range freeChunks {
+		if isListed {
+			continue
+		}
+
+		chunkController := chunkController{blockAccessor, chunk, itemRecorder{}}
+
+		if chunkController.MissCount() != maxMissCount {
+			violations = append(violations, fmt.Sprintf("free chunk %d neither listed nor dismissed", chunk))
+			continue
+		}
+
+		dismissedChunkSize += int(chunkController.Size())
+	}
+
+	sort.Strings(violations)
+	return dismissedChunkSize, hasFreeChunks, violations
+}
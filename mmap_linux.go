@@ -5,28 +5,131 @@ package fsm
 import (
 	"os"
 	"syscall"
+	"unsafe"
 )
 
-func mmap(file *os.File, offset int64, length int) ([]byte, error) {
-	buffer, err := syscall.Mmap(
+func mmap(file *os.File, offset int64, length int, flags mmapFlags) ([]byte, error) {
+	protection, mapFlags := convertMmapFlags(flags)
+
+	return syscall.Mmap(
 		int(file.Fd()),
 		offset,
 		length,
-		syscall.PROT_READ|syscall.PROT_WRITE,
-		syscall.MAP_SHARED,
+		protection,
+		mapFlags,
+	)
+}
+
+// reserveAddressSpace reserves an address range with the given length
+// without mapping anything into it.
+func reserveAddressSpace(length int) ([]byte, error) {
+	if unsafe.Sizeof(uintptr(0)) < 8 {
+		return nil, ErrStableAccessorsNotSupported
+	}
+
+	return syscall.Mmap(
+		-1,
+		0,
+		length,
+		syscall.PROT_NONE,
+		syscall.MAP_PRIVATE|syscall.MAP_ANON|syscall.MAP_NORESERVE,
+	)
+}
+
+// mmapAt maps the given file into the address range of the given
+// buffer, which is within an address range reserved.
+func mmapAt(buffer []byte, file *os.File, offset int64, flags mmapFlags) error {
+	protection, mapFlags := convertMmapFlags(flags)
+
+	_, _, errno := syscall.Syscall6(
+		syscall.SYS_MMAP,
+		uintptr(unsafe.Pointer(&buffer[0])),
+		uintptr(len(buffer)),
+		uintptr(protection),
+		uintptr(mapFlags|syscall.MAP_FIXED),
+		file.Fd(),
+		uintptr(offset),
+	)
+
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// munmapAt unmaps the address range of the given buffer, which is
+// mapped by mmapAt, but keeps it reserved.
+func munmapAt(buffer []byte) error {
+	_, _, errno := syscall.Syscall6(
+		syscall.SYS_MMAP,
+		uintptr(unsafe.Pointer(&buffer[0])),
+		uintptr(len(buffer)),
+		syscall.PROT_NONE,
+		syscall.MAP_PRIVATE|syscall.MAP_ANON|syscall.MAP_NORESERVE|syscall.MAP_FIXED,
+		^uintptr(0),
+		0,
 	)
 
-	if err != nil {
-		return nil, err
+	if errno != 0 {
+		return errno
 	}
 
-	if err := syscall.Madvise(buffer, syscall.MADV_RANDOM); err != nil {
-		return nil, err
+	return nil
+}
+
+func convertMmapFlags(flags mmapFlags) (int, int) {
+	protection := syscall.PROT_READ | syscall.PROT_WRITE
+
+	if flags&mmapReadOnly != 0 {
+		protection = syscall.PROT_READ
 	}
 
-	return buffer, nil
+	mapFlags := syscall.MAP_SHARED
+
+	if flags&mmapPrivate != 0 {
+		mapFlags = syscall.MAP_PRIVATE
+	}
+
+	return protection, mapFlags
+}
+
+func madvise(buffer []byte, advice MmapAdvice) error {
+	var advice2 int
+
+	switch advice {
+	case MmapAdviceDefault:
+		advice2 = syscall.MADV_RANDOM
+	case MmapAdviceNormal:
+		advice2 = syscall.MADV_NORMAL
+	case MmapAdviceRandom:
+		advice2 = syscall.MADV_RANDOM
+	case MmapAdviceSequential:
+		advice2 = syscall.MADV_SEQUENTIAL
+	case MmapAdviceWillNeed:
+		advice2 = syscall.MADV_WILLNEED
+	default:
+		return nil
+	}
+
+	return syscall.Madvise(buffer, advice2)
 }
 
 func munmap(buffer []byte) error {
 	return syscall.Munmap(buffer)
 }
+
+func msync(buffer []byte) error {
+	_, _, errno := syscall.Syscall(
+		syscall.SYS_MSYNC,
+		uintptr(unsafe.Pointer(&buffer[0])),
+		uintptr(len(buffer)),
+		syscall.MS_SYNC,
+	)
+
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
@@ -31,11 +31,21 @@ var allocationGranularity = func() int {
 	return int(systemInfo.dwAllocationGranularity)
 }()
 
-func mmap(file *os.File, offset int64, length int) ([]byte, error) {
+func mmap(file *os.File, offset int64, length int, flags mmapFlags) ([]byte, error) {
+	var protection, access uint32
+
+	if flags&mmapReadOnly != 0 {
+		protection, access = syscall.PAGE_READONLY, syscall.FILE_MAP_READ
+	} else if flags&mmapPrivate == 0 {
+		protection, access = syscall.PAGE_READWRITE, syscall.FILE_MAP_READ|syscall.FILE_MAP_WRITE
+	} else {
+		protection, access = syscall.PAGE_WRITECOPY, syscall.FILE_MAP_COPY
+	}
+
 	fileMappingHandle, err := syscall.CreateFileMapping(
 		syscall.Handle(file.Fd()),
 		nil,
-		syscall.PAGE_READWRITE,
+		protection,
 		0,
 		0,
 		nil,
@@ -58,7 +68,7 @@ func mmap(file *os.File, offset int64, length int) ([]byte, error) {
 
 	bufferPtr, err := syscall.MapViewOfFile(
 		fileMappingHandle,
-		syscall.FILE_MAP_READ|syscall.FILE_MAP_WRITE,
+		access,
 		uint32(offset>>32),
 		uint32(offset),
 		uintptr(length),
@@ -72,7 +82,32 @@ func mmap(file *os.File, offset int64, length int) ([]byte, error) {
 	return buffer, nil
 }
 
+func reserveAddressSpace(length int) ([]byte, error) {
+	// not supported
+	return nil, ErrStableAccessorsNotSupported
+}
+
+func mmapAt(buffer []byte, file *os.File, offset int64, flags mmapFlags) error {
+	// not supported
+	return ErrStableAccessorsNotSupported
+}
+
+func munmapAt(buffer []byte) error {
+	// not supported
+	return ErrStableAccessorsNotSupported
+}
+
+func madvise(buffer []byte, advice MmapAdvice) error {
+	// not supported
+	return nil
+}
+
 func munmap(buffer []byte) error {
 	bufferPtr := (*reflect.SliceHeader)(unsafe.Pointer(&buffer)).Data &^ uintptr(allocationGranularity-1)
 	return syscall.UnmapViewOfFile(bufferPtr)
 }
+
+func msync(buffer []byte) error {
+	bufferPtr := (*reflect.SliceHeader)(unsafe.Pointer(&buffer)).Data
+	return syscall.FlushViewOfFile(bufferPtr, uintptr(len(buffer)))
+}
@@ -0,0 +1,283 @@
+package fsm
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"math/bits"
+	"sync"
+
+	"github.com/roy2220/fsm/internal/pool"
+)
+
+// Scrub verifies the pages of the space on the file against the page
+// checksums committed last time (see OpenOptions.UsePageChecksums),
+// incrementally from where the last call stopped, until all the pages
+// have been verified or the given context is done. It returns the
+// checksum mismatches found.
+// Without the write-ahead log, pages changed since the last Sync or
+// Close mismatch as well, so Sync should be called before scrubbing.
+func (fs *FileStorage) Scrub(ctx context.Context) ([]PageChecksumMismatch, error) {
+	if !fs.options.UsePageChecksums {
+		return nil, ErrNoPageChecksums
+	}
+
+	numberOfPages := fs.pageChecksums.NumberOfPages()
+	buffer := make([]byte, pageSize)
+	var pageChecksumMismatches []PageChecksumMismatch
+
+	for ; fs.scrubCursor < numberOfPages; fs.scrubCursor++ {
+		if fs.scrubCursor%scrubBatchSize == 0 {
+			select {
+			case <-ctx.Done():
+				return pageChecksumMismatches, ctx.Err()
+			default:
+			}
+		}
+
+		page := int64(fs.scrubCursor * pageSize)
+
+		if _, err := fs.spaceMapper.File.ReadAt(buffer, int64(fileHeaderSize)+page); err != nil {
+			return pageChecksumMismatches, err
+		}
+
+		if !fs.pageChecksums.Check(fs.scrubCursor, buffer) {
+			pageChecksumMismatches = append(pageChecksumMismatches, PageChecksumMismatch{
+				Page:   page,
+				Spaces: fs.locateSpaces(page, pageSize),
+			})
+		}
+	}
+
+	fs.scrubCursor = 0
+	return pageChecksumMismatches, nil
+}
+
+// PageChecksumMismatch represents a page of the space with a checksum mismatch.
+type PageChecksumMismatch struct {
+	// Page is the offset of the page in the space.
+	Page int64
+
+	// Spaces are the allocated spaces overlapping the page.
+	Spaces []int64
+}
+
+// ErrNoPageChecksums is returned when scrubbing a file storage
+// opened without page checksums.
+var ErrNoPageChecksums = errors.New("fsm: no page checksums")
+
+// locateSpaces returns the allocated spaces overlapping the given range of the space.
+func (fs *FileStorage) locateSpaces(offset int64, size int) []int64 {
+	block, blockSize, ok := fs.buddy.LocateBlock(offset)
+
+	if !ok {
+		return nil
+	}
+
+	if !(blockSize == pool.BlockSize && fs.pool.IsPooledBlock(block)) {
+		return []int64{block}
+	}
+
+	var spaces []int64
+
+	fs.pool.GetSpaces(block, func(space int64, spaceSize int) {
+		if space < offset+int64(size) && space+int64(spaceSize) > offset {
+			spaces = append(spaces, space)
+		}
+	})
+
+	return spaces
+}
+
+const scrubBatchSize = 256
+
+// pageChecksums holds the CRC32C of each page of the space, 4 bytes per page.
+type pageChecksums []byte
+
+func makePageChecksums(spaceAccessor []byte, spaceSize int) pageChecksums {
+	numberOfPages := spaceSize / pageSize
+	pageChecksums := make(pageChecksums, 4*numberOfPages)
+
+	for i := 0; i < numberOfPages; i++ {
+		pageChecksums.Update(i, spaceAccessor)
+	}
+
+	return pageChecksums
+}
+
+// Resize returns the page checksums resized for the given number of pages,
+// the checksums of the pages added are left to update.
+func (pc pageChecksums) Resize(numberOfPages int) pageChecksums {
+	if n := 4 * numberOfPages; n <= len(pc) {
+		return pc[:n]
+	}
+
+	return append(pc, make([]byte, 4*numberOfPages-len(pc))...)
+}
+
+func (pc pageChecksums) Update(pageIndex int, spaceAccessor []byte) {
+	checksum := crc32.Checksum(spaceAccessor[pageIndex*pageSize:(pageIndex+1)*pageSize], crc32cTable)
+	binary.BigEndian.PutUint32(pc[4*pageIndex:], checksum)
+}
+
+func (pc pageChecksums) Check(pageIndex int, page []byte) bool {
+	return binary.BigEndian.Uint32(pc[4*pageIndex:]) == crc32.Checksum(page, crc32cTable)
+}
+
+func (pc pageChecksums) NumberOfPages() int {
+	return len(pc) / 4
+}
+
+// dirtyPages tracks the pages of the space which may have changed since the
+// last commit, so that only those pages get journaled through the write-ahead
+// log and have their page checksums refreshed on commit. Besides
+// the pages changed by the pool, the pages exposed through accessors count
+// as changed as long as the accessors stay valid, i.e. until the next
+// allocation or free, or forever with stable accessors.
+// All the methods are no-ops on nil, and are safe for concurrent use, as
+// the pool shards change and leases access the space in parallel.
+type dirtyPages struct {
+	mutex             sync.Mutex
+	changedPages      pageSet
+	exposedPages      pageSet
+	keepsExposedPages bool
+}
+
+// AddChanged marks the pages overlapping the given range of the space dirty.
+func (dp *dirtyPages) AddChanged(offset int64, size int) {
+	if dp == nil {
+		return
+	}
+
+	dp.mutex.Lock()
+	dp.changedPages.AddRange(offset, size)
+	dp.mutex.Unlock()
+}
+
+// AddExposed marks the pages overlapping the given range of the space,
+// which is exposed through an accessor, dirty until the accessor gets
+// invalidated.
+func (dp *dirtyPages) AddExposed(offset int64, size int) {
+	if dp == nil {
+		return
+	}
+
+	dp.mutex.Lock()
+	dp.exposedPages.AddRange(offset, size)
+	dp.mutex.Unlock()
+}
+
+// InvalidateAccessors takes the pages exposed so far as changed, as the
+// accessors exposing them get invalidated.
+func (dp *dirtyPages) InvalidateAccessors() {
+	if dp == nil || dp.keepsExposedPages {
+		return
+	}
+
+	dp.mutex.Lock()
+	dp.changedPages.AddSet(&dp.exposedPages)
+	dp.exposedPages.Clear()
+	dp.mutex.Unlock()
+}
+
+// Take returns the indexes of the dirty pages and clears the pages changed,
+// while the pages exposed through accessors valid stay dirty.
+func (dp *dirtyPages) Take() []int {
+	pageIndexes := dp.PageIndexes()
+	dp.ClearChanged()
+	return pageIndexes
+}
+
+// PageIndexes returns the indexes of the dirty pages.
+func (dp *dirtyPages) PageIndexes() []int {
+	if dp == nil {
+		return nil
+	}
+
+	dp.mutex.Lock()
+	defer dp.mutex.Unlock()
+	var pages pageSet
+	pages.AddSet(&dp.changedPages)
+	pages.AddSet(&dp.exposedPages)
+	return pages.PageIndexes()
+}
+
+// ClearChanged clears the pages changed, while the pages exposed through
+// accessors valid stay dirty.
+func (dp *dirtyPages) ClearChanged() {
+	if dp == nil {
+		return
+	}
+
+	dp.mutex.Lock()
+	dp.changedPages.Clear()
+	dp.mutex.Unlock()
+}
+
+// pageSet represents a set of pages as a bitmap of page indexes, which
+// also lists the words set, so that adding and clearing it cost nothing
+// proportional to the space size.
+type pageSet struct {
+	words       []uint64
+	wordIndexes []int
+}
+
+func (ps *pageSet) AddRange(offset int64, size int) {
+	if size < 1 {
+		return
+	}
+
+	firstPageIndex := int(offset / pageSize)
+	lastPageIndex := int((offset + int64(size) - 1) / pageSize)
+
+	for i := firstPageIndex; i <= lastPageIndex; {
+		wordIndex := i / 64
+		word := ^uint64(0) << uint(i%64)
+
+		if n := lastPageIndex - wordIndex*64; n < 63 {
+			word &= ^uint64(0) >> uint(63-n)
+		}
+
+		ps.addWord(wordIndex, word)
+		i = (wordIndex + 1) * 64
+	}
+}
+
+func (ps *pageSet) AddSet(other *pageSet) {
+	for _, wordIndex := range other.wordIndexes {
+		ps.addWord(wordIndex, other.words[wordIndex])
+	}
+}
+
+func (ps *pageSet) PageIndexes() []int {
+	var pageIndexes []int
+
+	for _, wordIndex := range ps.wordIndexes {
+		for word := ps.words[wordIndex]; word != 0; word &= word - 1 {
+			pageIndexes = append(pageIndexes, wordIndex*64+bits.TrailingZeros64(word))
+		}
+	}
+
+	return pageIndexes
+}
+
+func (ps *pageSet) Clear() {
+	for _, wordIndex := range ps.wordIndexes {
+		ps.words[wordIndex] = 0
+	}
+
+	ps.wordIndexes = ps.wordIndexes[:0]
+}
+
+func (ps *pageSet) addWord(wordIndex int, word uint64) {
+	if wordIndex >= len(ps.words) {
+		ps.words = append(ps.words, make([]uint64, wordIndex+1-len(ps.words))...)
+	}
+
+	if ps.words[wordIndex] == 0 {
+		ps.wordIndexes = append(ps.wordIndexes, wordIndex)
+	}
+
+	ps.words[wordIndex] |= word
+}
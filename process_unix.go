@@ -0,0 +1,12 @@
+// +build darwin linux
+
+package fsm
+
+import "syscall"
+
+// processExists reports whether the process with the given ID exists,
+// which is told by sending signal 0 to it.
+func processExists(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,32 @@
+// +build windows
+
+package fsm
+
+import "syscall"
+
+const (
+	processQueryLimitedInformation = 0x1000
+	stillActive                    = 259
+
+	errorInvalidParameter syscall.Errno = 87
+)
+
+// processExists reports whether the process with the given ID exists,
+// i.e. it can be opened and has not exited yet.
+func processExists(pid int) bool {
+	handle, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(pid))
+
+	if err != nil {
+		// other errors, e.g. access denied, mean the process exists
+		return err != errorInvalidParameter
+	}
+
+	defer syscall.CloseHandle(handle)
+	var exitCode uint32
+
+	if err := syscall.GetExitCodeProcess(handle, &exitCode); err != nil {
+		return true
+	}
+
+	return exitCode == stillActive
+}
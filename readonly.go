@@ -0,0 +1,92 @@
+package fsm
+
+import (
+	"errors"
+	"os"
+)
+
+// openReadOnly opens a file storage on the given file in read-only mode
+// (see OpenOptions.ReadOnly).
+func (fs *FileStorage) openReadOnly(fileName string, options OpenOptions) error {
+	if options.Recover {
+		// recovery rebuilds the free chunk lists in the space
+		return ErrReadOnly
+	}
+
+	file, err := os.Open(fileName)
+
+	if err != nil {
+		return err
+	}
+
+	if !options.NoLock {
+		if err := lockInitializedFile(file, options.LockTimeout); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	if err := checkWALFile(fileName); err != nil {
+		file.Close()
+		return err
+	}
+
+	fs.spaceMapper.File = file
+	fs.spaceMapper.ReadOnly = true
+	fs.spaceMapper.Advice = options.MmapAdvice
+
+	if options.StableAccessors {
+		fs.spaceMapper.ReservedSpaceSize = options.maxSpaceSize()
+	}
+
+	fs.options = options
+
+	if err := fs.loadFile(options.AllowUncleanShutdown); err != nil {
+		fs.spaceMapper.Close()
+		file.Close()
+		return err
+	}
+
+	return nil
+}
+
+// closeReadOnly closes the file storage in read-only mode.
+func (fs *FileStorage) closeReadOnly() error {
+	if err := fs.spaceMapper.Close(); err != nil {
+		return err
+	}
+
+	return fs.spaceMapper.File.Close()
+}
+
+// checkWALFile returns ErrUncleanShutdown if the write-ahead log file for
+// the given file has committed records left to replay, which can not be
+// done in read-only mode.
+func checkWALFile(fileName string) error {
+	walFile, err := os.Open(fileName + walFileNameSuffix)
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	defer walFile.Close()
+	ok, err := checkWAL(walFile)
+
+	if err != nil {
+		return err
+	}
+
+	if ok {
+		return ErrUncleanShutdown
+	}
+
+	return nil
+}
+
+// ErrReadOnly is returned when changing a file storage open in
+// read-only mode.
+var ErrReadOnly = errors.New("fsm: read only")
@@ -0,0 +1,312 @@
+package fsm
+
+import (
+	"hash/crc32"
+	"io"
+
+	"github.com/roy2220/fsm/internal/buddy"
+	"github.com/roy2220/fsm/internal/pool"
+)
+
+// recoverFile rebuilds the allocation state, for when the file header or
+// the block allocation bitmap is lost or damaged, or the file storage was
+// not closed cleanly.
+//
+// The block allocation bitmap committed last time is used if it is intact,
+// which is found through the file header, or through the newest copy of
+// the file header in the file if the file header slots are lost, so that
+// the boundaries of blocks are kept. Pooled blocks allocated since then are
+// taken back as well, while the other space allocated since then is lost.
+//
+// Otherwise the space is scanned. Pooled blocks are recognized by checking
+// the chunk lists in them. The rest of the space in use can not be told
+// apart from free space, so it is kept allocated as blocks as large as
+// alignment allows, and space larger than 4 GiB ends up split into blocks
+// of 4 GiB.
+//
+// Either way, the free chunk lists of pooled blocks are rebuilt.
+func (fs *FileStorage) recoverFile() error {
+	buffer := [fileHeaderSize]byte{}
+
+	if _, err := fs.spaceMapper.File.ReadAt(buffer[:], 0); err != nil {
+		return err
+	}
+
+	fileHeader, fileHeaderSlotIndex, err := loadFileHeader(buffer[:])
+	fileHeaderIsFound := err == nil
+
+	if !fileHeaderIsFound {
+		if fileHeader, fileHeaderIsFound, err = fs.findFileHeaderCopy(); err != nil {
+			return err
+		}
+
+		fileHeaderSlotIndex = 0
+	}
+
+	var usedSpaceSize int
+	rootDirectory := int64(-1)
+	numberOfPoolShards := fs.options.NumberOfPoolShards
+	var blockAllocationBitmap []byte
+
+	if fileHeaderIsFound {
+		usedSpaceSize = int(fileHeader.UsedSpaceSize)
+		fs.primarySpace = fileHeader.PrimarySpace
+		rootDirectory = fileHeader.RootDirectory
+		fs.fileHeaderSlotIndex = fileHeaderSlotIndex
+		fs.fileHeaderSequenceNumber = fileHeader.SequenceNumber
+		fs.setBitmapRange(fileHeader.BlockAllocationBitmapOffset, fileHeader.BitmapEnd())
+
+		if numberOfPoolShards == 0 {
+			numberOfPoolShards = int(fileHeader.NumberOfPoolShards)
+		}
+
+		if blockAllocationBitmap, err = fs.readIntactBlockAllocationBitmap(&fileHeader); err != nil {
+			return err
+		}
+	} else {
+		fileInfo, err := fs.spaceMapper.File.Stat()
+
+		if err != nil {
+			return err
+		}
+
+		if usedSpaceSize = int(fileInfo.Size()) - fileHeaderSize; usedSpaceSize < 0 {
+			usedSpaceSize = 0
+		}
+
+		fs.primarySpace = -1
+	}
+
+	var pooledBlocks []int64
+
+	if blockAllocationBitmap != nil {
+		pooledBlocks, err = fs.recoverBlocks(&fileHeader, blockAllocationBitmap)
+	} else {
+		usedSpaceSize &^= buddy.MinBlockSize - 1
+		pooledBlocks, err = fs.scanBlocks(usedSpaceSize)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if fs.primarySpace >= int64(usedSpaceSize) {
+		fs.primarySpace = -1
+	}
+
+	if numberOfPoolShards == 0 {
+		numberOfPoolShards = 1
+	}
+
+	poolBuilder := fs.pool.Build()
+	poolBuilder.SetNumberOfShards(numberOfPoolShards)
+
+	for _, pooledBlock := range pooledBlocks {
+		poolBuilder.RecoverPooledBlock(pooledBlock)
+	}
+
+	poolBuilder.SetDismissedSpaceSize(0)
+
+	if err := fs.recoverRoots(rootDirectory, usedSpaceSize); err != nil {
+		return err
+	}
+
+	if fs.options.UsePageChecksums {
+		fs.pageChecksums = makePageChecksums(fs.spaceMapper.AccessSpace(), usedSpaceSize)
+	}
+
+	return nil
+}
+
+// findFileHeaderCopy finds the newest valid copy of the file header by
+// scanning the pages of the file, see fileHeader.FileHeaderCopyOffset.
+func (fs *FileStorage) findFileHeaderCopy() (fileHeader, bool, error) {
+	fileInfo, err := fs.spaceMapper.File.Stat()
+
+	if err != nil {
+		return fileHeader{}, false, err
+	}
+
+	buffer := make([]byte, fileHeaderCopyScanSize)
+	var latestFileHeader fileHeader
+	fileHeaderIsFound := false
+
+	for offset := int64(fileHeaderSize); offset < fileInfo.Size(); offset += fileHeaderCopyScanSize {
+		n, err := fs.spaceMapper.File.ReadAt(buffer, offset)
+
+		if err != nil && err != io.EOF {
+			return fileHeader{}, false, err
+		}
+
+		for i := 0; i+fileHeaderSlotSize <= n; i += pageSize {
+			var fileHeader fileHeader
+
+			// a copy of the file header in the space, e.g. of another file,
+			// doesn't match the offset in the file
+			if fileHeader.Deserialize(buffer[i:]) != nil || fileHeader.Check() != nil ||
+				fileHeader.FileHeaderCopyOffset() != offset+int64(i) {
+				continue
+			}
+
+			if !fileHeaderIsFound || fileHeader.SequenceNumber > latestFileHeader.SequenceNumber {
+				latestFileHeader = fileHeader
+				fileHeaderIsFound = true
+			}
+		}
+	}
+
+	return latestFileHeader, fileHeaderIsFound, nil
+}
+
+// readIntactBlockAllocationBitmap reads the block allocation bitmap the
+// given file header refers to, and returns nil if it is damaged.
+func (fs *FileStorage) readIntactBlockAllocationBitmap(fileHeader *fileHeader) ([]byte, error) {
+	// the checksum of the block allocation bitmap is missing
+	if fileHeader.Flags&fileHeaderLegacy != 0 {
+		return nil, nil
+	}
+
+	blockAllocationBitmap := make([]byte, fileHeader.BlockAllocationBitmapSize)
+
+	if _, err := fs.spaceMapper.File.ReadAt(blockAllocationBitmap, fileHeader.BlockAllocationBitmapOffset); err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	if crc32.Checksum(blockAllocationBitmap, crc32cTable) != fileHeader.BlockAllocationBitmapChecksum {
+		return nil, nil
+	}
+
+	return blockAllocationBitmap, nil
+}
+
+// recoverBlocks sets up the buddy system with the given block allocation
+// bitmap and returns the pooled blocks, including the ones allocated since
+// the block allocation bitmap was committed, which are taken back.
+func (fs *FileStorage) recoverBlocks(fileHeader *fileHeader, blockAllocationBitmap []byte) ([]int64, error) {
+	if err := fs.spaceMapper.MapSpace(int(fileHeader.MappedSpaceSize)); err != nil {
+		return nil, err
+	}
+
+	fs.buddy.Build().
+		SetSpaceSize(int(fileHeader.SpaceSize)).
+		SetUsedSpaceSize(int(fileHeader.UsedSpaceSize)).
+		SetMappedSpaceSize(int(fileHeader.MappedSpaceSize)).
+		SetAllocatedSpaceSize(int(fileHeader.AllocatedSpaceSize)).
+		SetBlockAllocationBitmap(blockAllocationBitmap)
+	pooledBlocks := []int64(nil)
+
+	for block := int64(0); block+pool.BlockSize <= fileHeader.UsedSpaceSize; block += pool.BlockSize {
+		if blockSize, err := fs.buddy.GetBlockSize(block); err == nil {
+			if blockSize == pool.BlockSize && fs.pool.IsPooledBlock(block) {
+				pooledBlocks = append(pooledBlocks, block)
+			}
+
+			continue
+		}
+
+		// a pooled block freed entirely has no used chunks
+		if fs.pool.IsPooledBlock(block) && countSpaces(&fs.pool, block) >= 1 &&
+			fs.buddy.ClaimBlock(block, pool.BlockSize) {
+			pooledBlocks = append(pooledBlocks, block)
+		}
+	}
+
+	return pooledBlocks, nil
+}
+
+// scanBlocks rebuilds the block allocation bitmap of the buddy system by
+// scanning the given used space, and returns the pooled blocks.
+func (fs *FileStorage) scanBlocks(usedSpaceSize int) ([]int64, error) {
+	mappedSpaceSize := 0
+
+	if usedSpaceSize >= 1 {
+		mappedSpaceSize = buddy.MinBlockSize
+
+		for mappedSpaceSize < usedSpaceSize {
+			mappedSpaceSize *= 2
+		}
+	}
+
+	if err := fs.spaceMapper.MapSpace(mappedSpaceSize); err != nil {
+		return nil, err
+	}
+
+	pooledBlocks := []int64(nil)
+
+	for block := int64(0); block+pool.BlockSize <= int64(usedSpaceSize); block += pool.BlockSize {
+		if fs.pool.IsPooledBlock(block) {
+			pooledBlocks = append(pooledBlocks, block)
+		}
+	}
+
+	fs.buddy.Build().
+		SetMappedSpaceSize(mappedSpaceSize).
+		SetAllocatedBlocks(func(callback func(int64, int)) {
+			blockEnd := int64(0)
+
+			for _, pooledBlock := range pooledBlocks {
+				getUnknownBlocks(blockEnd, pooledBlock, callback)
+				callback(pooledBlock, pool.BlockSize)
+				blockEnd = pooledBlock + pool.BlockSize
+			}
+
+			getUnknownBlocks(blockEnd, int64(usedSpaceSize), callback)
+		})
+
+	return pooledBlocks, nil
+}
+
+// recoverRoots reads the roots from the given root directory, which may
+// no longer be a valid space after recovery, in which case the roots are
+// written to a new root directory. The roots are dropped if the root
+// directory is corrupted.
+func (fs *FileStorage) recoverRoots(rootDirectory int64, usedSpaceSize int) error {
+	fs.rootDirectory = -1
+	fs.roots = nil
+
+	if rootDirectory < 0 || rootDirectory >= int64(usedSpaceSize) {
+		return nil
+	}
+
+	roots, err := decodeRoots(fs.spaceMapper.AccessSpace()[rootDirectory:usedSpaceSize])
+
+	if err != nil {
+		return nil
+	}
+
+	if _, err := fs.pool.GetSpaceSize(rootDirectory); err == nil {
+		fs.rootDirectory = rootDirectory
+		fs.roots = roots
+		return nil
+	}
+
+	return fs.storeRoots(roots)
+}
+
+// countSpaces returns the number of spaces in the given pooled block.
+func countSpaces(pool *pool.Pool, block int64) int {
+	numberOfSpaces := 0
+	pool.GetSpaces(block, func(int64, int) { numberOfSpaces++ })
+	return numberOfSpaces
+}
+
+// getUnknownBlocks divides the given space into blocks as large as
+// alignment allows.
+func getUnknownBlocks(spaceStart, spaceEnd int64, callback func(int64, int)) {
+	for block := spaceStart; block < spaceEnd; {
+		blockSize := int64(buddy.MaxBlockSize)
+
+		for block&(blockSize-1) != 0 || block+blockSize > spaceEnd {
+			blockSize /= 2
+		}
+
+		callback(block, int(blockSize))
+		block += blockSize
+	}
+}
+
+const fileHeaderCopyScanSize = 1 << 20
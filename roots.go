@@ -0,0 +1,252 @@
+package fsm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// SetRoot sets the root with the given name on the file to the given
+// space. Roots are allocated by user and serve as the entries to user
+// data, so that several users can share the file under different names.
+// The root named the empty string is the primary space (see
+// SetPrimarySpace).
+// It panics when an error occurs, see TrySetRoot.
+func (fs *FileStorage) SetRoot(name string, space int64) {
+	if err := fs.TrySetRoot(name, space); err != nil {
+		panic(err)
+	}
+}
+
+// TrySetRoot is like SetRoot but returns an error, e.g. ErrReadOnly,
+// ErrInvalidSpace for a negative space or an I/O error, instead of
+// panicking. The file storage stays unchanged when an error occurs.
+func (fs *FileStorage) TrySetRoot(name string, space int64) error {
+	if fs.options.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if space < 0 {
+		return ErrInvalidSpace
+	}
+
+	if name == "" {
+		fs.primarySpace = space
+		return nil
+	}
+
+	if oldSpace, ok := fs.roots[name]; ok && oldSpace == space {
+		return nil
+	}
+
+	roots := make(map[string]int64, len(fs.roots)+1)
+
+	for name2, space2 := range fs.roots {
+		roots[name2] = space2
+	}
+
+	roots[name] = space
+	return fs.storeRoots(roots)
+}
+
+// DeleteRoot deletes the root with the given name on the file, if any.
+// The space of the root is not freed.
+// It panics when an error occurs, see TryDeleteRoot.
+func (fs *FileStorage) DeleteRoot(name string) {
+	if err := fs.TryDeleteRoot(name); err != nil {
+		panic(err)
+	}
+}
+
+// TryDeleteRoot is like DeleteRoot but returns an error, e.g.
+// ErrReadOnly or an I/O error, instead of panicking.
+// The file storage stays unchanged when an error occurs.
+func (fs *FileStorage) TryDeleteRoot(name string) error {
+	if fs.options.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if name == "" {
+		fs.primarySpace = -1
+		return nil
+	}
+
+	if _, ok := fs.roots[name]; !ok {
+		return nil
+	}
+
+	roots := make(map[string]int64, len(fs.roots)-1)
+
+	for name2, space2 := range fs.roots {
+		if name2 != name {
+			roots[name2] = space2
+		}
+	}
+
+	return fs.storeRoots(roots)
+}
+
+// Root returns the space of the root with the given name on the file
+// and whether the root exists.
+func (fs *FileStorage) Root(name string) (int64, bool) {
+	if name == "" {
+		return fs.primarySpace, fs.primarySpace >= 0
+	}
+
+	space, ok := fs.roots[name]
+	return space, ok
+}
+
+// Roots returns the spaces of all the roots on the file by name,
+// including the primary space named the empty string if set.
+func (fs *FileStorage) Roots() map[string]int64 {
+	roots := make(map[string]int64, len(fs.roots)+1)
+
+	for name, space := range fs.roots {
+		roots[name] = space
+	}
+
+	if fs.primarySpace >= 0 {
+		roots[""] = fs.primarySpace
+	}
+
+	return roots
+}
+
+// storeRoots writes the given roots to a new root directory, which is a
+// space on the file, and then replaces the current root directory with
+// the new one, so that the roots are committed along with the other
+// changes to the space. In shared mode, the change is committed right
+// away, see completeChange.
+func (fs *FileStorage) storeRoots(roots map[string]int64) error {
+	rootDirectory := int64(-1)
+
+	if len(roots) >= 1 {
+		data := encodeRoots(roots)
+		space, spaceSize, err := fs.pool.AllocateSpace(len(data))
+
+		if err != nil {
+			return convertError(err)
+		}
+
+		copy(fs.spaceMapper.AccessSpace()[space:space+int64(spaceSize)], data)
+		fs.dirtyPages.AddChanged(space, spaceSize)
+		rootDirectory = space
+	}
+
+	if fs.rootDirectory >= 0 {
+		if err := fs.pool.FreeSpace(fs.rootDirectory); err != nil {
+			if rootDirectory >= 0 {
+				fs.pool.FreeSpace(rootDirectory)
+			}
+
+			return convertError(err)
+		}
+	}
+
+	fs.rootDirectory = rootDirectory
+	fs.roots = roots
+	fs.completeChange()
+	return nil
+}
+
+// loadRoots reads the roots from the given root directory.
+func (fs *FileStorage) loadRoots(rootDirectory int64) error {
+	fs.rootDirectory = -1
+	fs.roots = nil
+
+	if rootDirectory < 0 {
+		return nil
+	}
+
+	spaceSize, err := fs.pool.GetSpaceSize(rootDirectory)
+
+	if err != nil {
+		return &CorruptionError{"root directory", "space not allocated"}
+	}
+
+	roots, err := decodeRoots(fs.spaceMapper.AccessSpace()[rootDirectory : rootDirectory+int64(spaceSize)])
+
+	if err != nil {
+		return &CorruptionError{"root directory", err.Error()}
+	}
+
+	fs.rootDirectory = rootDirectory
+	fs.roots = roots
+	return nil
+}
+
+// encodeRoots encodes the given roots, sorted by name, as the number of
+// the roots followed by the name size, the name and the space of each.
+func encodeRoots(roots map[string]int64) []byte {
+	names := make([]string, 0, len(roots))
+	dataSize := 4
+
+	for name := range roots {
+		names = append(names, name)
+		dataSize += 4 + len(name) + 8
+	}
+
+	sort.Strings(names)
+	data := make([]byte, dataSize)
+	binary.BigEndian.PutUint32(data, uint32(len(names)))
+	i := 4
+
+	for _, name := range names {
+		binary.BigEndian.PutUint32(data[i:], uint32(len(name)))
+		i += 4
+		i += copy(data[i:], name)
+		binary.BigEndian.PutUint64(data[i:], uint64(roots[name]))
+		i += 8
+	}
+
+	return data
+}
+
+func decodeRoots(data []byte) (map[string]int64, error) {
+	if len(data) < 4 {
+		return nil, errTruncatedRootDirectory
+	}
+
+	numberOfRoots := int(binary.BigEndian.Uint32(data))
+	i := 4
+
+	if numberOfRoots > (len(data)-i)/(4+8) {
+		return nil, errTruncatedRootDirectory
+	}
+
+	roots := make(map[string]int64, numberOfRoots)
+
+	for j := 0; j < numberOfRoots; j++ {
+		if len(data)-i < 4 {
+			return nil, errTruncatedRootDirectory
+		}
+
+		nameSize := int(binary.BigEndian.Uint32(data[i:]))
+		i += 4
+
+		if nameSize > len(data)-i-8 {
+			return nil, errTruncatedRootDirectory
+		}
+
+		name := string(data[i : i+nameSize])
+		i += nameSize
+		space := int64(binary.BigEndian.Uint64(data[i:]))
+		i += 8
+
+		if name == "" {
+			return nil, errors.New("bad root name")
+		}
+
+		if space < 0 {
+			return nil, fmt.Errorf("bad space %d of root %q", space, name)
+		}
+
+		roots[name] = space
+	}
+
+	return roots, nil
+}
+
+var errTruncatedRootDirectory = errors.New("truncated")
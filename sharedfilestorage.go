@@ -0,0 +1,270 @@
+package fsm
+
+import "errors"
+
+// SharedFileStorage represents a file storage shared by processes, which
+// open the same file with shared file storages and allocate and free space
+// concurrently. The allocation state, including the block allocation
+// bitmap, the free block lists, the pooled block lists and the counters,
+// lives in the mapping shared by the processes, i.e. in the space and in a
+// control block in the file header, which also holds a lock taken by each
+// call. The bookkeeping changed by a call gets saved to an undo log in the
+// space beforehand, so that if the process dies in the middle of the call,
+// the next process taking the lock steals it and rolls the change back.
+// Processes holding the lock are told dead by process ID, so a process
+// which died is taken as alive if another process reuses its ID, in which
+// case the lock is never released.
+//
+// The allocation state is committed to the file only by Sync and Close,
+// the last process closing the file marking it clean. If all the processes
+// die, the file is left marked dirty like a file storage not closed, see
+// OpenOptions.AllowUncleanShutdown and OpenOptions.Recover.
+//
+// Shared file storages are not safe for concurrent use by goroutines, and
+// accessors get *INVALIDATED* by the next call as the space may be
+// remapped to catch up with the other processes.
+type SharedFileStorage struct {
+	fs FileStorage
+}
+
+// Init initializes the shared file storage and returns it.
+func (sfs *SharedFileStorage) Init() *SharedFileStorage {
+	sfs.fs.Init()
+	sfs.fs.sharing = new(sharing)
+	return sfs
+}
+
+// Open opens a shared file storage on the given file.
+func (sfs *SharedFileStorage) Open(fileName string, createFileIfNotExists bool) error {
+	return sfs.OpenWithOptions(fileName, OpenOptions{
+		CreateFileIfNotExists: createFileIfNotExists,
+	})
+}
+
+// OpenWithOptions opens a shared file storage on the given file with the
+// given options, see FileStorage.OpenWithOptions. The file is locked
+// shared rather than exclusively, so that it is open by no processes but
+// those with shared file storages, except in read-only mode, which fails
+// with ErrUncleanShutdown by default as the file is marked dirty while
+// open. The file is loaded, and unclean shutdowns are checked, only if the
+// file is not shared by other processes yet, whose allocation state is
+// taken otherwise, along with the options it was loaded with, e.g.
+// NumberOfPoolShards. Up to 256 shared file storages can have the same
+// file open, beyond which opening fails with ErrTooManyProcesses. The
+// options UseWAL, UsePageChecksums, ReadOnly and NoLock are not supported.
+func (sfs *SharedFileStorage) OpenWithOptions(fileName string, options OpenOptions) error {
+	if options.UseWAL || options.UsePageChecksums || options.ReadOnly || options.NoLock {
+		return ErrSharedNotSupported
+	}
+
+	return sfs.fs.OpenWithOptions(fileName, options)
+}
+
+// Close closes the shared file storage after syncing the changes to the
+// file, see Sync. The shared file storage stays open if syncing fails.
+// The file is marked clean only if it is not open by other processes.
+func (sfs *SharedFileStorage) Close() error {
+	return sfs.fs.closeShared()
+}
+
+// Sync syncs the changes to the file, see FileStorage.Sync.
+func (sfs *SharedFileStorage) Sync() error {
+	return sfs.Update(func(fs *FileStorage) error {
+		return fs.Sync()
+	})
+}
+
+// Update calls the given function with the underlying file storage, which
+// is up to date with the other processes and used exclusively until the
+// function returns, then commits the changes made by the function to the
+// shared mapping. It returns the error returned by the function. Each call
+// of the file storage changing the allocation state is committed on its
+// own, so that a single call is what gets rolled back if the process dies
+// in the middle of it, or if the function panics, in which case the panic
+// goes on after the rollback. A call changing too much bookkeeping to be
+// rolled back gets rolled back right away, making Update return
+// ErrChangeTooLarge.
+func (sfs *SharedFileStorage) Update(callback func(fs *FileStorage) error) (err error) {
+	if err := sfs.fs.lockShared(); err != nil {
+		return err
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			// the change is left over to the next call if rolling back fails
+			sfs.fs.rollBackSharedChange()
+			sfs.fs.unlockShared()
+
+			if r != ErrChangeTooLarge {
+				panic(r)
+			}
+
+			err = ErrChangeTooLarge
+		}
+	}()
+
+	err = callback(&sfs.fs)
+	sfs.fs.completeChange()
+	sfs.fs.unlockShared()
+	return err
+}
+
+// View is like Update but the given function must make no changes, which
+// fail with ErrReadOnly, so that nothing is committed.
+func (sfs *SharedFileStorage) View(callback func(fs *FileStorage) error) error {
+	if err := sfs.fs.lockShared(); err != nil {
+		return err
+	}
+
+	defer sfs.fs.unlockShared()
+	sfs.fs.options.ReadOnly = true
+	defer func() { sfs.fs.options.ReadOnly = false }()
+	return callback(&sfs.fs)
+}
+
+// AllocateSpace allocates space with the given size on the file, see
+// FileStorage.AllocateSpace.
+// It panics when an error occurs, see TryAllocateSpace.
+func (sfs *SharedFileStorage) AllocateSpace(spaceSize int) (int64, []byte) {
+	space, spaceAccessor, err := sfs.TryAllocateSpace(spaceSize)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return space, spaceAccessor
+}
+
+// TryAllocateSpace is like AllocateSpace but returns an error instead
+// of panicking, see FileStorage.TryAllocateSpace.
+func (sfs *SharedFileStorage) TryAllocateSpace(spaceSize int) (int64, []byte, error) {
+	var space int64
+	var spaceAccessor []byte
+
+	err := sfs.Update(func(fs *FileStorage) error {
+		var err error
+		space, spaceAccessor, err = fs.TryAllocateSpace(spaceSize)
+		return err
+	})
+
+	return space, spaceAccessor, err
+}
+
+// FreeSpace releases the given space back to the file.
+// It panics when an error occurs, see TryFreeSpace.
+func (sfs *SharedFileStorage) FreeSpace(space int64) {
+	if err := sfs.TryFreeSpace(space); err != nil {
+		panic(err)
+	}
+}
+
+// TryFreeSpace is like FreeSpace but returns an error instead
+// of panicking, see FileStorage.TryFreeSpace.
+func (sfs *SharedFileStorage) TryFreeSpace(space int64) error {
+	return sfs.Update(func(fs *FileStorage) error {
+		return fs.TryFreeSpace(space)
+	})
+}
+
+// ReallocateSpace resizes the given space on the file to the given
+// size, see FileStorage.ReallocateSpace.
+// It panics when an error occurs, see TryReallocateSpace.
+func (sfs *SharedFileStorage) ReallocateSpace(space int64, spaceSize int) (int64, []byte) {
+	space, spaceAccessor, err := sfs.TryReallocateSpace(space, spaceSize)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return space, spaceAccessor
+}
+
+// TryReallocateSpace is like ReallocateSpace but returns an error
+// instead of panicking, see FileStorage.TryReallocateSpace.
+func (sfs *SharedFileStorage) TryReallocateSpace(space int64, spaceSize int) (int64, []byte, error) {
+	var spaceAccessor []byte
+
+	err := sfs.Update(func(fs *FileStorage) error {
+		var err error
+		space, spaceAccessor, err = fs.TryReallocateSpace(space, spaceSize)
+		return err
+	})
+
+	return space, spaceAccessor, err
+}
+
+// AccessSpace returns an ephemeral accessor of the given space on the
+// file, see FileStorage.AccessSpace.
+// It panics when an error occurs, see TryAccessSpace.
+func (sfs *SharedFileStorage) AccessSpace(space int64) []byte {
+	spaceAccessor, err := sfs.TryAccessSpace(space)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return spaceAccessor
+}
+
+// TryAccessSpace is like AccessSpace but returns an error instead
+// of panicking, see FileStorage.TryAccessSpace.
+func (sfs *SharedFileStorage) TryAccessSpace(space int64) ([]byte, error) {
+	var spaceAccessor []byte
+
+	err := sfs.View(func(fs *FileStorage) error {
+		var err error
+		spaceAccessor, err = fs.TryAccessSpace(space)
+		return err
+	})
+
+	return spaceAccessor, err
+}
+
+// AllocateAlignedSpace allocates aligned space, aka a block, with the
+// given size on the file, see FileStorage.AllocateAlignedSpace.
+// It panics when an error occurs, see TryAllocateAlignedSpace.
+func (sfs *SharedFileStorage) AllocateAlignedSpace(blockSize int) (int64, []byte) {
+	block, blockAccessor, err := sfs.TryAllocateAlignedSpace(blockSize)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return block, blockAccessor
+}
+
+// TryAllocateAlignedSpace is like AllocateAlignedSpace but returns an
+// error instead of panicking, see FileStorage.TryAllocateAlignedSpace.
+func (sfs *SharedFileStorage) TryAllocateAlignedSpace(blockSize int) (int64, []byte, error) {
+	var block int64
+	var blockAccessor []byte
+
+	err := sfs.Update(func(fs *FileStorage) error {
+		var err error
+		block, blockAccessor, err = fs.TryAllocateAlignedSpace(blockSize)
+		return err
+	})
+
+	return block, blockAccessor, err
+}
+
+// FreeAlignedSpace releases the given aligned space, aka a
+// block, back to the file.
+// It panics when an error occurs, see TryFreeAlignedSpace.
+func (sfs *SharedFileStorage) FreeAlignedSpace(block int64) {
+	if err := sfs.TryFreeAlignedSpace(block); err != nil {
+		panic(err)
+	}
+}
+
+// TryFreeAlignedSpace is like FreeAlignedSpace but returns an error
+// instead of panicking, see FileStorage.TryFreeAlignedSpace.
+func (sfs *SharedFileStorage) TryFreeAlignedSpace(block int64) error {
+	return sfs.Update(func(fs *FileStorage) error {
+		return fs.TryFreeAlignedSpace(block)
+	})
+}
+
+// ErrSharedNotSupported is returned when opening shared file storages
+// with options not supported, see SharedFileStorage.OpenWithOptions.
+var ErrSharedNotSupported = errors.New("fsm: shared mode not supported")
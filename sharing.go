@@ -0,0 +1,616 @@
+package fsm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/roy2220/fsm/internal/buddy"
+	"github.com/roy2220/fsm/internal/pool"
+)
+
+// The control block of shared file storages takes the rest of the file
+// header after the file header slots, which is mapped by every process
+// sharing the file, and is laid out as follows:
+//
+//	| signature (8 bytes) | lock (8 bytes) | undo log size (8 bytes) |
+//	| undo log block (8 bytes) | ... | shared state | ... | member slots |
+//
+// The signature is present while processes share the file. The lock and
+// the undo log size are native-endian words accessed atomically, the lock
+// holding the ID of the owner (see newOwnerID) or zero. The undo log is a
+// block allocated from the space, see recordSharedChange, and the member
+// slots hold the IDs of the owners having the file open, or zero.
+const (
+	sharedControlBlockOffset = numberOfFileHeaderSlots * fileHeaderSlotSize
+	sharedControlBlockSize   = fileHeaderSize - sharedControlBlockOffset
+	sharedSignature          = "!MSF.SHR"
+
+	sharedLockOffset          = 8
+	undoLogSizeOffset         = 16
+	undoLogBlockOffset        = 24
+	sharedStateOffset         = 64
+	sharedStateSize           = 8*8 + buddy.StateSize + pool.StateSize
+	sharedMemberSlotsOffset   = 1024
+	numberOfSharedMemberSlots = (sharedControlBlockSize - sharedMemberSlotsOffset) / 8
+
+	// the shared state must not overlap the member slots
+	_ = uint(sharedMemberSlotsOffset - (sharedStateOffset + sharedStateSize))
+)
+
+const (
+	// undoLogSize is the size of undo logs, which bounds the size of the
+	// bookkeeping changed by a single change, see ErrChangeTooLarge.
+	undoLogSize          = 1 << 20
+	undoRecordHeaderSize = 16
+)
+
+const (
+	numberOfSharedLockSpins    = 100
+	minSharedLockRetryInterval = 10 * time.Microsecond
+	maxSharedLockRetryInterval = time.Millisecond
+)
+
+// sharing represents the part of file storages in shared mode, i.e. the
+// control block mapped and what the process knows about it.
+type sharing struct {
+	header        []byte
+	controlBlock  []byte
+	ownerID       uint64
+	undoLogBlock  int64
+	stateIsLoaded bool
+	changeCount   uint64
+	rootsVersion  uint64
+	stateBuffer   [sharedStateSize]byte
+}
+
+// lock takes the lock in the control block, waiting for the owner holding
+// it to release it, or steals the lock if the process of the owner has
+// died. The lock is taken by the owner rather than the process, so that it
+// never gets stolen from another owner in the same process.
+func (s *sharing) lock() {
+	lockWord := s.word(sharedLockOffset)
+	pid := uint64(os.Getpid())
+	retryInterval := minSharedLockRetryInterval
+
+	for i := 0; ; i++ {
+		ownerID := atomic.LoadUint64(lockWord)
+
+		if ownerID == 0 {
+			if atomic.CompareAndSwapUint64(lockWord, 0, s.ownerID) {
+				return
+			}
+
+			continue
+		}
+
+		if i < numberOfSharedLockSpins {
+			runtime.Gosched()
+			continue
+		}
+
+		if ownerPID := ownerID >> 32; ownerPID != pid && !processExists(int(ownerPID)) {
+			if atomic.CompareAndSwapUint64(lockWord, ownerID, s.ownerID) {
+				return
+			}
+
+			continue
+		}
+
+		time.Sleep(retryInterval)
+
+		if retryInterval *= 2; retryInterval > maxSharedLockRetryInterval {
+			retryInterval = maxSharedLockRetryInterval
+		}
+	}
+}
+
+func (s *sharing) unlock() {
+	atomic.CompareAndSwapUint64(s.word(sharedLockOffset), s.ownerID, 0)
+}
+
+// isStarted reports whether processes are sharing the file, i.e. the
+// signature is present.
+func (s *sharing) isStarted() bool {
+	return string(s.controlBlock[:len(sharedSignature)]) == sharedSignature
+}
+
+// join adds the owner to the member slots, after removing the members
+// whose processes have died.
+func (s *sharing) join() error {
+	s.removeDeadMembers()
+
+	for i := 0; i < numberOfSharedMemberSlots; i++ {
+		memberSlot := s.controlBlock[sharedMemberSlotsOffset+i*8:]
+
+		if binary.BigEndian.Uint64(memberSlot) == 0 {
+			binary.BigEndian.PutUint64(memberSlot, s.ownerID)
+			return nil
+		}
+	}
+
+	return ErrTooManyProcesses
+}
+
+// leave removes the owner from the member slots, along with the members
+// whose processes have died, and reports whether no members are left.
+func (s *sharing) leave() bool {
+	s.removeDeadMembers()
+	isLast := true
+
+	for i := 0; i < numberOfSharedMemberSlots; i++ {
+		memberSlot := s.controlBlock[sharedMemberSlotsOffset+i*8:]
+
+		switch binary.BigEndian.Uint64(memberSlot) {
+		case 0:
+		case s.ownerID:
+			binary.BigEndian.PutUint64(memberSlot, 0)
+		default:
+			isLast = false
+		}
+	}
+
+	return isLast
+}
+
+func (s *sharing) removeDeadMembers() {
+	pid := uint64(os.Getpid())
+
+	for i := 0; i < numberOfSharedMemberSlots; i++ {
+		memberSlot := s.controlBlock[sharedMemberSlotsOffset+i*8:]
+
+		if ownerID := binary.BigEndian.Uint64(memberSlot); ownerID != 0 {
+			if ownerPID := ownerID >> 32; ownerPID != pid && !processExists(int(ownerPID)) {
+				binary.BigEndian.PutUint64(memberSlot, 0)
+			}
+		}
+	}
+}
+
+func (s *sharing) state() []byte {
+	return s.controlBlock[sharedStateOffset : sharedStateOffset+sharedStateSize]
+}
+
+func (s *sharing) undoLogSize() int {
+	return int(atomic.LoadUint64(s.word(undoLogSizeOffset)))
+}
+
+func (s *sharing) setUndoLogSize(undoLogSize int) {
+	atomic.StoreUint64(s.word(undoLogSizeOffset), uint64(undoLogSize))
+}
+
+func (s *sharing) word(offset int) *uint64 {
+	return (*uint64)(unsafe.Pointer(&s.controlBlock[offset]))
+}
+
+// openShared maps the control block and then either starts sharing the
+// file if no other processes are sharing it, or joins them.
+func (fs *FileStorage) openShared() error {
+	header, err := mmap(fs.spaceMapper.File, 0, fileHeaderSize, 0)
+
+	if err != nil {
+		return err
+	}
+
+	// the file storage may have been open in shared mode before
+	fs.buddy.Init(&fs.spaceMapper)
+	fs.buddy.Build().SetMappedSpaceSize(0)
+	fs.roots = nil
+	s := fs.sharing
+	s.header = header
+	s.controlBlock = header[sharedControlBlockOffset:]
+	s.ownerID = newOwnerID()
+	s.stateIsLoaded = false
+	s.lock()
+
+	if s.isStarted() {
+		err = fs.joinSharing()
+	} else {
+		err = fs.startSharing()
+	}
+
+	s.unlock()
+
+	if err != nil {
+		munmap(header)
+		s.header, s.controlBlock = nil, nil
+		return err
+	}
+
+	return nil
+}
+
+// startSharing loads the allocation state from the file and then moves
+// it into the shared mapping, i.e. the buddy system into the space (see
+// buddy.Buddy.MoveStateIntoSpace) and the rest into the control block,
+// along with a block allocated for the undo log. The file gets marked
+// dirty until the last process closes it.
+func (fs *FileStorage) startSharing() error {
+	var err error
+
+	if fs.options.Recover {
+		err = fs.recoverFile()
+	} else {
+		err = fs.loadFile(fs.options.AllowUncleanShutdown)
+
+		if n := fs.options.NumberOfPoolShards; err == nil && n >= 1 {
+			fs.pool.Build().SetNumberOfShards(n)
+		}
+	}
+
+	if err == nil {
+		err = fs.setDirtySpaceSize()
+	}
+
+	if err == nil {
+		err = fs.buddy.RemapSpace()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	undoLogBlock, _, err := fs.buddy.AllocateBlock(undoLogSize)
+
+	if err != nil {
+		return convertError(err)
+	}
+
+	if err := fs.buddy.MoveStateIntoSpace(); err != nil {
+		return convertError(err)
+	}
+
+	s := fs.sharing
+	s.undoLogBlock = undoLogBlock
+	binary.BigEndian.PutUint64(s.controlBlock[undoLogBlockOffset:], uint64(undoLogBlock))
+	s.setUndoLogSize(0)
+	s.changeCount = 0
+	s.rootsVersion = 0
+	fs.encodeSharedState(s.state())
+	s.stateIsLoaded = true
+	fs.setSharedChangeListener(fs.recordSharedChange)
+
+	if err := fs.Sync(); err != nil {
+		return err
+	}
+
+	fs.storeSharedState()
+
+	if err := s.join(); err != nil {
+		return err
+	}
+
+	copy(s.controlBlock, sharedSignature)
+	return nil
+}
+
+// joinSharing loads the allocation state from the shared mapping.
+func (fs *FileStorage) joinSharing() error {
+	s := fs.sharing
+	s.undoLogBlock = int64(binary.BigEndian.Uint64(s.controlBlock[undoLogBlockOffset:]))
+
+	if s.undoLogSize() >= 1 {
+		if err := fs.rollBackSharedChange(); err != nil {
+			return err
+		}
+	}
+
+	if err := fs.loadSharedState(); err != nil {
+		return err
+	}
+
+	if err := s.join(); err != nil {
+		return err
+	}
+
+	fs.setSharedChangeListener(fs.recordSharedChange)
+	return nil
+}
+
+// lockShared takes the lock in the control block, rolls back the change
+// left over by the process which held the lock last, if any, and brings
+// the allocation state up to date with the other processes.
+func (fs *FileStorage) lockShared() error {
+	s := fs.sharing
+	s.lock()
+
+	if s.undoLogSize() >= 1 {
+		if err := fs.rollBackSharedChange(); err != nil {
+			s.unlock()
+			return err
+		}
+	}
+
+	if err := fs.loadSharedState(); err != nil {
+		s.unlock()
+		return err
+	}
+
+	return nil
+}
+
+func (fs *FileStorage) unlockShared() {
+	fs.sharing.unlock()
+}
+
+// closeShared closes the file storage opened in shared mode. The file is
+// synced first, and the file storage stays open if that fails. The last
+// process closing the file moves the allocation state back out of the
+// shared mapping and marks the file clean.
+func (fs *FileStorage) closeShared() error {
+	if err := fs.lockShared(); err != nil {
+		return err
+	}
+
+	s := fs.sharing
+	err := fs.Sync()
+	fs.storeSharedState()
+
+	if err != nil {
+		s.unlock()
+		return err
+	}
+
+	if !s.leave() {
+		s.unlock()
+		err = fs.spaceMapper.Close()
+	} else {
+		// processes opening the file from now on start sharing it over
+		// again, which loads the allocation state synced above even if
+		// this process dies in the meantime
+		copy(s.controlBlock, make([]byte, len(sharedSignature)))
+		fs.setSharedChangeListener(nil)
+
+		if err = fs.buddy.MoveStateOutOfSpace(); err == nil {
+			err = fs.buddy.FreeBlock(s.undoLogBlock)
+		}
+
+		if err == nil {
+			err = fs.storeFile()
+		} else {
+			err = convertError(err)
+			fs.spaceMapper.Close()
+		}
+
+		copy(s.controlBlock[undoLogSizeOffset:], make([]byte, sharedControlBlockSize-undoLogSizeOffset))
+		s.unlock()
+	}
+
+	munmap(s.header)
+	s.header, s.controlBlock = nil, nil
+
+	if err2 := fs.spaceMapper.File.Close(); err == nil {
+		err = err2
+	}
+
+	return err
+}
+
+// loadSharedState loads the allocation state from the control block,
+// unless it's unchanged since it was loaded or stored last time.
+func (fs *FileStorage) loadSharedState() error {
+	s := fs.sharing
+	state := s.state()
+	changeCount := binary.BigEndian.Uint64(state)
+
+	if s.stateIsLoaded && changeCount == s.changeCount {
+		return nil
+	}
+
+	s.stateIsLoaded = false
+	fs.primarySpace = int64(binary.BigEndian.Uint64(state[8:]))
+	rootDirectory := int64(binary.BigEndian.Uint64(state[16:]))
+	rootsVersion := binary.BigEndian.Uint64(state[24:])
+	fs.fileHeaderSequenceNumber = int64(binary.BigEndian.Uint64(state[32:]))
+	fs.fileHeaderSlotIndex = int(binary.BigEndian.Uint64(state[40:]))
+	fs.setBitmapRange(int64(binary.BigEndian.Uint64(state[48:])), int64(binary.BigEndian.Uint64(state[56:])))
+
+	if err := fs.buddy.LoadState(state[64:]); err != nil {
+		return convertError(err)
+	}
+
+	fs.pool.Build().LoadState(state[64+buddy.StateSize:])
+
+	if fs.roots == nil || rootsVersion != s.rootsVersion || rootDirectory != fs.rootDirectory {
+		if err := fs.loadRoots(rootDirectory); err != nil {
+			return err
+		}
+	}
+
+	s.changeCount = changeCount
+	s.rootsVersion = rootsVersion
+	s.stateIsLoaded = true
+	return nil
+}
+
+// storeSharedState stores the allocation state to the control block if
+// changed, which commits the change in progress, if any, so that it's
+// no longer rolled back (see rollBackSharedChange). The roots version
+// advances whenever the root directory gets replaced, telling the other
+// processes to reload the roots.
+func (fs *FileStorage) storeSharedState() {
+	s := fs.sharing
+	state := s.state()
+	buffer := s.stateBuffer[:]
+	fs.encodeSharedState(buffer)
+
+	if s.undoLogSize() == 0 && bytes.Equal(buffer, state) {
+		return
+	}
+
+	if binary.BigEndian.Uint64(buffer[16:]) != binary.BigEndian.Uint64(state[16:]) {
+		s.rootsVersion++
+	}
+
+	s.changeCount++
+	fs.encodeSharedState(buffer)
+
+	if s.undoLogSize() == 0 {
+		fs.beginSharedChange()
+	}
+
+	copy(state, buffer)
+	s.setUndoLogSize(0)
+}
+
+// encodeSharedState encodes the allocation state to the given buffer as
+// | change count | primary space | root directory | roots version |
+// | file header sequence number | file header slot index | bitmap offset |
+// | bitmap end | buddy state | pool state |.
+func (fs *FileStorage) encodeSharedState(buffer []byte) {
+	s := fs.sharing
+	binary.BigEndian.PutUint64(buffer[0:], s.changeCount)
+	binary.BigEndian.PutUint64(buffer[8:], uint64(fs.primarySpace))
+	binary.BigEndian.PutUint64(buffer[16:], uint64(fs.rootDirectory))
+	binary.BigEndian.PutUint64(buffer[24:], s.rootsVersion)
+	binary.BigEndian.PutUint64(buffer[32:], uint64(fs.fileHeaderSequenceNumber))
+	binary.BigEndian.PutUint64(buffer[40:], uint64(fs.fileHeaderSlotIndex))
+	binary.BigEndian.PutUint64(buffer[48:], uint64(fs.bitmapOffset))
+	binary.BigEndian.PutUint64(buffer[56:], uint64(fs.bitmapEnd))
+	fs.buddy.StoreState(buffer[64:])
+	fs.pool.StoreState(buffer[64+buddy.StateSize:])
+}
+
+// beginSharedChange begins a change by saving the allocation state in the
+// control block to the undo log, which must be empty.
+func (fs *FileStorage) beginSharedChange() {
+	s := fs.sharing
+	copy(fs.accessUndoLog(), s.state())
+	s.setUndoLogSize(sharedStateSize)
+}
+
+// recordSharedChange saves the given range of the space, which is about
+// to be changed by the buddy system or the pool, to the undo log as a
+// record laid out as | offset (8 bytes) | size (8 bytes) | data |, with
+// the data padded to 8 bytes. The record takes effect once the undo log
+// size covers it, which is only after the record is written in full. It
+// panics with ErrChangeTooLarge when the undo log is full, see Update.
+func (fs *FileStorage) recordSharedChange(offset int64, size int) {
+	s := fs.sharing
+	undoLog := fs.accessUndoLog()
+	i := s.undoLogSize()
+
+	if i == 0 {
+		fs.beginSharedChange()
+		i = sharedStateSize
+	}
+
+	j := i + undoRecordHeaderSize + (size+7)&^7
+
+	if j > len(undoLog) {
+		panic(ErrChangeTooLarge)
+	}
+
+	binary.BigEndian.PutUint64(undoLog[i:], uint64(offset))
+	binary.BigEndian.PutUint64(undoLog[i+8:], uint64(size))
+	copy(undoLog[i+undoRecordHeaderSize:], fs.spaceMapper.AccessSpace()[offset:offset+int64(size)])
+	s.setUndoLogSize(j)
+}
+
+// rollBackSharedChange rolls back the change in progress, if any, left
+// over by a process which died in the middle of it or abandoned by Update,
+// by restoring the ranges of the space in the undo log backwards and then
+// the allocation state in the control block. The allocation state of the
+// file storage gets reloaded afterwards, see loadSharedState.
+func (fs *FileStorage) rollBackSharedChange() error {
+	s := fs.sharing
+	s.stateIsLoaded = false
+	n := s.undoLogSize()
+
+	if n == 0 {
+		return nil
+	}
+
+	// the space may be mapped short of the ranges changed by other processes
+	if err := fs.mapSharedSpace(int(s.undoLogBlock) + undoLogSize); err != nil {
+		return err
+	}
+
+	undoLog := fs.accessUndoLog()
+	var recordOffsets []int
+	spaceSize := 0
+
+	for i := sharedStateSize; i < n; {
+		offset := int(binary.BigEndian.Uint64(undoLog[i:]))
+		size := int(binary.BigEndian.Uint64(undoLog[i+8:]))
+		recordOffsets = append(recordOffsets, i)
+
+		if offset+size > spaceSize {
+			spaceSize = offset + size
+		}
+
+		i += undoRecordHeaderSize + (size+7)&^7
+	}
+
+	if err := fs.mapSharedSpace(spaceSize); err != nil {
+		return err
+	}
+
+	undoLog = fs.accessUndoLog()
+	spaceAccessor := fs.spaceMapper.AccessSpace()
+
+	for k := len(recordOffsets) - 1; k >= 0; k-- {
+		i := recordOffsets[k]
+		offset := int64(binary.BigEndian.Uint64(undoLog[i:]))
+		size := int64(binary.BigEndian.Uint64(undoLog[i+8:]))
+		copy(spaceAccessor[offset:offset+size], undoLog[i+undoRecordHeaderSize:])
+	}
+
+	copy(s.state(), undoLog)
+	s.setUndoLogSize(0)
+	return nil
+}
+
+// mapSharedSpace maps the space no less than the given size, so that the
+// ranges of the space changed by other processes are accessible before
+// the allocation state is loaded, which remaps the space as needed.
+func (fs *FileStorage) mapSharedSpace(spaceSize int) error {
+	if spaceSize <= len(fs.spaceMapper.AccessSpace()) {
+		return nil
+	}
+
+	spaceSize = (spaceSize + (pageSize - 1)) &^ (pageSize - 1)
+
+	if err := fs.spaceMapper.MapSpace(spaceSize); err != nil {
+		return err
+	}
+
+	fs.buddy.Build().SetMappedSpaceSize(spaceSize)
+	return nil
+}
+
+func (fs *FileStorage) accessUndoLog() []byte {
+	undoLogBlock := fs.sharing.undoLogBlock
+	return fs.spaceMapper.AccessSpace()[undoLogBlock : undoLogBlock+undoLogSize]
+}
+
+func (fs *FileStorage) setSharedChangeListener(changeListener func(int64, int)) {
+	fs.buddy.Build().SetChangeListener(changeListener)
+	fs.pool.Build().SetChangeListener(changeListener)
+}
+
+var lastOwnerToken uint32
+
+// newOwnerID returns a new ID of owners of locks in control blocks, made
+// of the process ID and a token unique within the process.
+func newOwnerID() uint64 {
+	return uint64(os.Getpid())<<32 | uint64(atomic.AddUint32(&lastOwnerToken, 1))
+}
+
+var (
+	// ErrTooManyProcesses is returned when opening a shared file storage
+	// on a file open by too many shared file storages already.
+	ErrTooManyProcesses = errors.New("fsm: too many processes")
+
+	// ErrChangeTooLarge is returned by shared file storages when a single
+	// change, e.g. allocating a large batch of spaces (see
+	// FileStorage.AllocateSpaces), changes too much bookkeeping to be
+	// rolled back if the process dies in the middle of it. The change
+	// gets rolled back, see SharedFileStorage.Update.
+	ErrChangeTooLarge = errors.New("fsm: change too large")
+)
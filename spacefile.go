@@ -0,0 +1,193 @@
+package fsm
+
+import (
+	"errors"
+	"io"
+)
+
+// SpaceFile represents a view over a space on the file as a file of a
+// fixed size, the size of the space. It accesses the space through the
+// file storage on each call, so unlike accessors it stays valid across
+// allocations and frees, until the space is freed.
+type SpaceFile struct {
+	fs     *FileStorage
+	space  int64
+	offset int64
+}
+
+var (
+	_ io.ReaderAt        = (*SpaceFile)(nil)
+	_ io.WriterAt        = (*SpaceFile)(nil)
+	_ io.ReadWriteSeeker = (*SpaceFile)(nil)
+	_ io.WriterTo        = (*SpaceFile)(nil)
+)
+
+// OpenSpace returns a space file over the given space on the file,
+// with the offset of the space file at the beginning of the space.
+// It panics when an error occurs, see TryOpenSpace.
+func (fs *FileStorage) OpenSpace(space int64) *SpaceFile {
+	spaceFile, err := fs.TryOpenSpace(space)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return spaceFile
+}
+
+// TryOpenSpace is like OpenSpace but returns ErrInvalidSpace
+// instead of panicking when the given space is invalid.
+func (fs *FileStorage) TryOpenSpace(space int64) (*SpaceFile, error) {
+	if _, err := fs.TryAccessSpace(space); err != nil {
+		return nil, err
+	}
+
+	return &SpaceFile{fs: fs, space: space}, nil
+}
+
+// Space returns the space of the space file.
+func (sf *SpaceFile) Space() int64 {
+	return sf.space
+}
+
+// Size returns the size of the space file, i.e. the size of the space.
+func (sf *SpaceFile) Size() (int64, error) {
+	spaceAccessor, err := sf.fs.TryAccessSpace(sf.space)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(len(spaceAccessor)), nil
+}
+
+// ReadAt implements io.ReaderAt.
+func (sf *SpaceFile) ReadAt(buffer []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, ErrInvalidOffset
+	}
+
+	spaceAccessor, err := sf.fs.TryAccessSpace(sf.space)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if offset >= int64(len(spaceAccessor)) {
+		return 0, io.EOF
+	}
+
+	n := copy(buffer, spaceAccessor[offset:])
+
+	if n < len(buffer) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// WriteAt implements io.WriterAt. As the size of the space file is
+// fixed, writing beyond the end of the space file fails with
+// io.ErrShortWrite.
+func (sf *SpaceFile) WriteAt(data []byte, offset int64) (int, error) {
+	if sf.fs.options.ReadOnly {
+		return 0, ErrReadOnly
+	}
+
+	if offset < 0 {
+		return 0, ErrInvalidOffset
+	}
+
+	spaceAccessor, err := sf.fs.TryAccessSpace(sf.space)
+
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+
+	if offset < int64(len(spaceAccessor)) {
+		n = copy(spaceAccessor[offset:], data)
+	}
+
+	if n < len(data) {
+		return n, io.ErrShortWrite
+	}
+
+	return n, nil
+}
+
+// Read implements io.Reader.
+func (sf *SpaceFile) Read(buffer []byte) (int, error) {
+	n, err := sf.ReadAt(buffer, sf.offset)
+	sf.offset += int64(n)
+
+	if err == io.EOF && n >= 1 {
+		err = nil
+	}
+
+	return n, err
+}
+
+// Write implements io.Writer.
+func (sf *SpaceFile) Write(data []byte) (int, error) {
+	n, err := sf.WriteAt(data, sf.offset)
+	sf.offset += int64(n)
+	return n, err
+}
+
+// Seek implements io.Seeker. Seeking beyond the end of the space file
+// is allowed, but reading or writing there fails.
+func (sf *SpaceFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += sf.offset
+	case io.SeekEnd:
+		size, err := sf.Size()
+
+		if err != nil {
+			return 0, err
+		}
+
+		offset += size
+	default:
+		return 0, ErrInvalidWhence
+	}
+
+	if offset < 0 {
+		return 0, ErrInvalidOffset
+	}
+
+	sf.offset = offset
+	return offset, nil
+}
+
+// WriteTo implements io.WriterTo. It writes the space file from the
+// offset to the end to the given writer, which is passed an accessor of
+// the space and hence must not allocate or free space on the file.
+func (sf *SpaceFile) WriteTo(writer io.Writer) (int64, error) {
+	spaceAccessor, err := sf.fs.TryAccessSpace(sf.space)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if sf.offset >= int64(len(spaceAccessor)) {
+		return 0, nil
+	}
+
+	n, err := writer.Write(spaceAccessor[sf.offset:])
+	sf.offset += int64(n)
+	return int64(n), err
+}
+
+var (
+	// ErrInvalidOffset is returned when reading, writing or seeking
+	// space files with a negative offset.
+	ErrInvalidOffset = errors.New("fsm: invalid offset")
+
+	// ErrInvalidWhence is returned when seeking space files
+	// with an invalid whence.
+	ErrInvalidWhence = errors.New("fsm: invalid whence")
+)
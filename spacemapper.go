@@ -7,9 +7,21 @@ import (
 )
 
 type spaceMapper struct {
-	File *os.File
+	File              *os.File
+	Private           bool
+	ReadOnly          bool
+	Shared            bool
+	Advice            MmapAdvice
+	ReservedSpaceSize int
+	MinFileSize       int64
 
-	buffer []byte
+	// GetDirtyPages returns the indexes of the pages changed since the
+	// last commit, which are carried over on remapping the space as
+	// copy-on-write.
+	GetDirtyPages func() []int
+
+	buffer      []byte
+	reservation []byte
 }
 
 func (sm *spaceMapper) MapSpace(spaceSize int) error {
@@ -21,26 +33,85 @@ func (sm *spaceMapper) MapSpace(spaceSize int) error {
 		return nil
 	}
 
-	if sm.buffer != nil {
-		if err := munmap(sm.buffer); err != nil {
+	if sm.ReservedSpaceSize >= 1 {
+		return sm.remapSpaceInPlace(spaceSize)
+	}
+
+	if sm.Private {
+		return sm.remapSpacePrivately(spaceSize)
+	}
+
+	// the old mapping is kept until the new one is in place so that
+	// the space stays accessible when an error occurs, e.g. no space
+	// left on the device.
+	oldFileSize := int64(fileHeaderSize + len(sm.buffer))
+	fileSize := int64(fileHeaderSize + spaceSize)
+
+	if oldFileSize < sm.MinFileSize {
+		// the file holds more beyond the space, which must stay intact
+		oldFileSize = sm.MinFileSize
+	}
+
+	if sm.Shared {
+		// the file never shrinks in shared mode as other processes
+		// may have mapped the space beyond the new space size.
+		fileInfo, err := sm.File.Stat()
+
+		if err != nil {
 			return err
 		}
 
-		sm.buffer = nil
+		oldFileSize = fileInfo.Size()
 	}
 
-	if err := sm.File.Truncate(int64(fileHeaderSize + spaceSize)); err != nil {
-		return err
+	if fileSize > oldFileSize && !sm.ReadOnly {
+		if err := sm.File.Truncate(fileSize); err != nil {
+			sm.File.Truncate(oldFileSize)
+			return err
+		}
 	}
 
+	var buffer []byte
+
 	if spaceSize >= 1 {
-		buffer, err := mmap(sm.File, int64(fileHeaderSize), spaceSize)
+		var err error
+		var flags mmapFlags
+
+		if sm.ReadOnly {
+			flags = mmapReadOnly
+		}
+
+		buffer, err = sm.mmap(spaceSize, flags)
 
 		if err != nil {
+			if fileSize > oldFileSize && !sm.ReadOnly {
+				sm.File.Truncate(oldFileSize)
+			}
+
 			return err
 		}
+	}
 
-		sm.buffer = buffer
+	if sm.buffer != nil {
+		if err := munmap(sm.buffer); err != nil {
+			if buffer != nil {
+				munmap(buffer)
+			}
+
+			return err
+		}
+	}
+
+	sm.buffer = buffer
+
+	if fileSize < sm.MinFileSize {
+		fileSize = sm.MinFileSize
+	}
+
+	if fileSize < oldFileSize && !sm.ReadOnly && !sm.Shared {
+		// failing to shrink the file is harmless as the space
+		// beyond the new space size is no longer in use.
+		sm.File.Truncate(fileSize)
 	}
 
 	return nil
@@ -50,12 +121,218 @@ func (sm *spaceMapper) AccessSpace() []byte {
 	return sm.buffer
 }
 
+func (sm *spaceMapper) Sync() error {
+	if sm.buffer == nil {
+		return nil
+	}
+
+	return msync(sm.buffer)
+}
+
 func (sm *spaceMapper) Close() error {
+	if sm.reservation != nil {
+		if err := munmap(sm.reservation); err != nil {
+			return err
+		}
+
+		sm.reservation = nil
+		sm.buffer = nil
+		return nil
+	}
+
 	if sm.buffer == nil {
 		return nil
 	}
 
-	return munmap(sm.buffer)
+	if err := munmap(sm.buffer); err != nil {
+		return err
+	}
+
+	sm.buffer = nil
+	return nil
+}
+
+// Unmap unmaps the space like Close but keeps the address range
+// reserved, if any, so that the space is mapped in place again.
+func (sm *spaceMapper) Unmap() error {
+	if sm.reservation == nil {
+		return sm.Close()
+	}
+
+	if sm.buffer == nil {
+		return nil
+	}
+
+	if err := munmapAt(sm.buffer); err != nil {
+		return err
+	}
+
+	sm.buffer = nil
+	return nil
+}
+
+// remapSpacePrivately remaps the space as copy-on-write so that changes
+// to the space never reach the file until they are committed explicitly.
+// The changes to the old mapping are carried over to the new one.
+func (sm *spaceMapper) remapSpacePrivately(spaceSize int) error {
+	// the file never shrinks here as the committed data beyond the new
+	// space size may still be in use.
+	if fileInfo, err := sm.File.Stat(); err != nil {
+		return err
+	} else if fileSize := int64(fileHeaderSize + spaceSize); fileInfo.Size() < fileSize {
+		if err := sm.File.Truncate(fileSize); err != nil {
+			return err
+		}
+	}
+
+	var buffer []byte
+
+	if spaceSize >= 1 {
+		var err error
+		buffer, err = sm.mmap(spaceSize, mmapPrivate)
+
+		if err != nil {
+			return err
+		}
+
+		numberOfPages := len(sm.buffer) / pageSize
+
+		if numberOfPages > spaceSize/pageSize {
+			numberOfPages = spaceSize / pageSize
+		}
+
+		// the other pages are the same as the ones committed to the file
+		for _, i := range sm.GetDirtyPages() {
+			if i < numberOfPages {
+				copy(buffer[i*pageSize:(i+1)*pageSize], sm.buffer[i*pageSize:])
+			}
+		}
+	}
+
+	if sm.buffer != nil {
+		if err := munmap(sm.buffer); err != nil {
+			if buffer != nil {
+				munmap(buffer)
+			}
+
+			return err
+		}
+	}
+
+	sm.buffer = buffer
+	return nil
+}
+
+// remapSpaceInPlace maps the space within the address range reserved, so
+// that the space never moves and accessors stay valid. Only the part of
+// the space grown or shrunk gets mapped or unmapped.
+func (sm *spaceMapper) remapSpaceInPlace(spaceSize int) error {
+	if spaceSize > sm.ReservedSpaceSize {
+		return ErrNoSpace
+	}
+
+	if sm.reservation == nil {
+		reservation, err := reserveAddressSpace(sm.ReservedSpaceSize)
+
+		if err != nil {
+			return err
+		}
+
+		sm.reservation = reservation
+	}
+
+	oldSpaceSize := len(sm.buffer)
+	fileSize := int64(fileHeaderSize + spaceSize)
+
+	if spaceSize > oldSpaceSize {
+		var flags mmapFlags
+
+		if sm.Private {
+			flags |= mmapPrivate
+		}
+
+		if sm.ReadOnly {
+			flags |= mmapReadOnly
+		}
+
+		// the file never shrinks here in private mode as the committed
+		// data beyond the new space size may still be in use.
+		oldFileSize := int64(0)
+
+		if !sm.ReadOnly {
+			fileInfo, err := sm.File.Stat()
+
+			if err != nil {
+				return err
+			}
+
+			if oldFileSize = fileInfo.Size(); oldFileSize < fileSize {
+				if err := sm.File.Truncate(fileSize); err != nil {
+					sm.File.Truncate(oldFileSize)
+					return err
+				}
+			}
+		}
+
+		buffer := sm.reservation[oldSpaceSize:spaceSize]
+
+		if err := mmapAt(buffer, sm.File, int64(fileHeaderSize+oldSpaceSize), flags); err != nil {
+			if oldFileSize < fileSize && !sm.ReadOnly {
+				sm.File.Truncate(oldFileSize)
+			}
+
+			return err
+		}
+
+		if err := madvise(buffer, sm.Advice); err != nil {
+			munmapAt(buffer)
+			return err
+		}
+	} else {
+		if err := munmapAt(sm.reservation[spaceSize:oldSpaceSize]); err != nil {
+			return err
+		}
+
+		if fileSize < sm.MinFileSize {
+			fileSize = sm.MinFileSize
+		}
+
+		if fileSize < int64(fileHeaderSize+oldSpaceSize) && !sm.ReadOnly && !sm.Private && !sm.Shared {
+			// failing to shrink the file is harmless as the space
+			// beyond the new space size is no longer in use.
+			sm.File.Truncate(fileSize)
+		}
+	}
+
+	if spaceSize == 0 {
+		sm.buffer = nil
+	} else {
+		sm.buffer = sm.reservation[:spaceSize:spaceSize]
+	}
+
+	return nil
 }
 
+func (sm *spaceMapper) mmap(spaceSize int, flags mmapFlags) ([]byte, error) {
+	buffer, err := mmap(sm.File, int64(fileHeaderSize), spaceSize, flags)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := madvise(buffer, sm.Advice); err != nil {
+		munmap(buffer)
+		return nil, err
+	}
+
+	return buffer, nil
+}
+
+type mmapFlags int
+
+const (
+	mmapPrivate mmapFlags = 1 << iota
+	mmapReadOnly
+)
+
 var _ = spacemapper.SpaceMapper(&spaceMapper{})
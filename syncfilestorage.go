@@ -0,0 +1,393 @@
+package fsm
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// SyncFileStorage represents a file storage safe for concurrent use.
+// Changes, e.g. allocations and frees, are serialized, while space is
+// accessed through leases, which are held in parallel. Accessors got
+// through a lease stay valid until the lease is released, as changes,
+// including those remapping the space, wait for outstanding leases to
+// be released.
+//
+// Small space is allocated and freed in parallel in different pool shards
+// (see OpenOptions.NumberOfPoolShards) as long as the pooled blocks of the
+// shards have room, without waiting for outstanding leases.
+type SyncFileStorage struct {
+	fs             FileStorage
+	rwMutex        sync.RWMutex
+	shardMutexes   [MaxNumberOfPoolShards]sync.Mutex
+	numberOfArenas uint32
+}
+
+// Init initializes the sync file storage and returns it.
+func (sfs *SyncFileStorage) Init() *SyncFileStorage {
+	sfs.fs.Init()
+	return sfs
+}
+
+// Open opens a sync file storage on the given file, see FileStorage.Open.
+func (sfs *SyncFileStorage) Open(fileName string, createFileIfNotExists bool) error {
+	sfs.rwMutex.Lock()
+	defer sfs.rwMutex.Unlock()
+	return sfs.fs.Open(fileName, createFileIfNotExists)
+}
+
+// OpenWithOptions opens a sync file storage on the given file with the
+// given options, see FileStorage.OpenWithOptions.
+func (sfs *SyncFileStorage) OpenWithOptions(fileName string, options OpenOptions) error {
+	sfs.rwMutex.Lock()
+	defer sfs.rwMutex.Unlock()
+	return sfs.fs.OpenWithOptions(fileName, options)
+}
+
+// Close closes the sync file storage, see FileStorage.Close.
+func (sfs *SyncFileStorage) Close() error {
+	sfs.rwMutex.Lock()
+	defer sfs.rwMutex.Unlock()
+	return sfs.fs.Close()
+}
+
+// Sync syncs the changes to the file, see FileStorage.Sync.
+func (sfs *SyncFileStorage) Sync() error {
+	sfs.rwMutex.Lock()
+	defer sfs.rwMutex.Unlock()
+	// no lease is held, so the accessors got through leases are invalid
+	sfs.fs.dirtyPages.InvalidateAccessors()
+	return sfs.fs.Sync()
+}
+
+// Update calls the given function with the underlying file storage,
+// which is used exclusively until the function returns, so that the
+// changes made by the function, e.g. allocating space and filling it
+// through the accessor, are seen as a whole by the other goroutines.
+// The function must not acquire leases. It returns the error returned
+// by the function.
+func (sfs *SyncFileStorage) Update(callback func(fs *FileStorage) error) error {
+	sfs.rwMutex.Lock()
+	defer sfs.rwMutex.Unlock()
+	return callback(&sfs.fs)
+}
+
+// AllocateSpace allocates space with the given size on the file
+// and returns it, see FileStorage.AllocateSpace. The space is
+// accessed through leases.
+// It panics when an error occurs, see TryAllocateSpace.
+func (sfs *SyncFileStorage) AllocateSpace(spaceSize int) int64 {
+	space, err := sfs.TryAllocateSpace(spaceSize)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return space
+}
+
+// TryAllocateSpace is like AllocateSpace but returns an error instead
+// of panicking, see FileStorage.TryAllocateSpace. The pool shards are
+// taken in turn, see Arena.
+func (sfs *SyncFileStorage) TryAllocateSpace(spaceSize int) (int64, error) {
+	return sfs.NewArena().TryAllocateSpace(spaceSize)
+}
+
+// AllocateSpaces allocates space with each of the given sizes on the file
+// and returns them, see FileStorage.AllocateSpaces.
+// It panics when an error occurs, see TryAllocateSpaces.
+func (sfs *SyncFileStorage) AllocateSpaces(spaceSizes []int) []int64 {
+	spaces, err := sfs.TryAllocateSpaces(spaceSizes)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return spaces
+}
+
+// TryAllocateSpaces is like AllocateSpaces but returns an error instead
+// of panicking, see FileStorage.TryAllocateSpaces. The pool shards are
+// taken in turn, see Arena.
+func (sfs *SyncFileStorage) TryAllocateSpaces(spaceSizes []int) ([]int64, error) {
+	return sfs.NewArena().TryAllocateSpaces(spaceSizes)
+}
+
+// FreeSpace releases the given space back to the file.
+// It panics when an error occurs, see TryFreeSpace.
+func (sfs *SyncFileStorage) FreeSpace(space int64) {
+	if err := sfs.TryFreeSpace(space); err != nil {
+		panic(err)
+	}
+}
+
+// TryFreeSpace is like FreeSpace but returns an error instead
+// of panicking, see FileStorage.TryFreeSpace.
+func (sfs *SyncFileStorage) TryFreeSpace(space int64) error {
+	if ok, err := sfs.freeSpaceToShard(space); ok || err != nil {
+		return err
+	}
+
+	sfs.rwMutex.Lock()
+	defer sfs.rwMutex.Unlock()
+	return sfs.fs.TryFreeSpace(space)
+}
+
+// ReallocateSpace resizes the given space on the file to the given
+// size and returns the space resized, see FileStorage.ReallocateSpace.
+// It panics when an error occurs, see TryReallocateSpace.
+func (sfs *SyncFileStorage) ReallocateSpace(space int64, spaceSize int) int64 {
+	space, err := sfs.TryReallocateSpace(space, spaceSize)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return space
+}
+
+// TryReallocateSpace is like ReallocateSpace but returns an error
+// instead of panicking, see FileStorage.TryReallocateSpace.
+func (sfs *SyncFileStorage) TryReallocateSpace(space int64, spaceSize int) (int64, error) {
+	sfs.rwMutex.Lock()
+	defer sfs.rwMutex.Unlock()
+	space, _, err := sfs.fs.TryReallocateSpace(space, spaceSize)
+	return space, err
+}
+
+// AllocateAlignedSpace allocates aligned space, aka a block, with the
+// given size on the file and returns it, see
+// FileStorage.AllocateAlignedSpace. The aligned space is accessed
+// through leases.
+// It panics when an error occurs, see TryAllocateAlignedSpace.
+func (sfs *SyncFileStorage) AllocateAlignedSpace(blockSize int) int64 {
+	block, err := sfs.TryAllocateAlignedSpace(blockSize)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return block
+}
+
+// TryAllocateAlignedSpace is like AllocateAlignedSpace but returns an
+// error instead of panicking, see FileStorage.TryAllocateAlignedSpace.
+func (sfs *SyncFileStorage) TryAllocateAlignedSpace(blockSize int) (int64, error) {
+	sfs.rwMutex.Lock()
+	defer sfs.rwMutex.Unlock()
+	block, _, err := sfs.fs.TryAllocateAlignedSpace(blockSize)
+	return block, err
+}
+
+// FreeAlignedSpace releases the given aligned space, aka a
+// block, back to the file.
+// It panics when an error occurs, see TryFreeAlignedSpace.
+func (sfs *SyncFileStorage) FreeAlignedSpace(block int64) {
+	if err := sfs.TryFreeAlignedSpace(block); err != nil {
+		panic(err)
+	}
+}
+
+// TryFreeAlignedSpace is like FreeAlignedSpace but returns an error
+// instead of panicking, see FileStorage.TryFreeAlignedSpace.
+func (sfs *SyncFileStorage) TryFreeAlignedSpace(block int64) error {
+	sfs.rwMutex.Lock()
+	defer sfs.rwMutex.Unlock()
+	return sfs.fs.TryFreeAlignedSpace(block)
+}
+
+// Stats returns the stats of the file.
+func (sfs *SyncFileStorage) Stats() Stats {
+	// the dismissed space size is changed by allocations and frees in
+	// the pool shards under leases
+	sfs.rwMutex.Lock()
+	defer sfs.rwMutex.Unlock()
+	return sfs.fs.Stats()
+}
+
+// NewArena returns a new arena, which allocates small space from a pool
+// shard of its own, so that arenas allocate in parallel. Each goroutine
+// allocating concurrently is meant to have an arena of its own, the
+// arenas are spread over the pool shards in turn.
+func (sfs *SyncFileStorage) NewArena() Arena {
+	return Arena{sfs, int(atomic.AddUint32(&sfs.numberOfArenas, 1) - 1)}
+}
+
+// AcquireLease acquires a lease on the space of the file, which must be
+// released by calling Lease.Release. Acquiring a lease waits for the
+// ongoing change, if any, to complete.
+// A goroutine must not acquire a lease or make changes while holding
+// a lease, otherwise it may deadlock with a pending change.
+func (sfs *SyncFileStorage) AcquireLease() Lease {
+	sfs.rwMutex.RLock()
+	return Lease{sfs}
+}
+
+// Lease represents a lease on the space of a sync file storage.
+type Lease struct {
+	sfs *SyncFileStorage
+}
+
+// Release releases the lease, any accessors got through the
+// lease are *INVALIDATED*.
+func (l Lease) Release() {
+	l.sfs.rwMutex.RUnlock()
+}
+
+// AccessSpace returns an accessor of the given space on the file,
+// which stays valid until the lease is released.
+// It panics when an error occurs, see TryAccessSpace.
+func (l Lease) AccessSpace(space int64) []byte {
+	spaceAccessor, err := l.TryAccessSpace(space)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return spaceAccessor
+}
+
+// TryAccessSpace is like AccessSpace but returns ErrInvalidSpace
+// instead of panicking when the given space is invalid.
+func (l Lease) TryAccessSpace(space int64) ([]byte, error) {
+	if shardIndex := l.sfs.fs.pool.ShardOf(space); shardIndex >= 0 {
+		// the headers of chunks are changed by allocations and
+		// frees in the pool shard under leases
+		shardMutex := &l.sfs.shardMutexes[shardIndex]
+		shardMutex.Lock()
+		defer shardMutex.Unlock()
+	}
+
+	return l.sfs.fs.TryAccessSpace(space)
+}
+
+// AccessAlignedSpace returns an accessor of the given aligned space on
+// the file, which stays valid until the lease is released.
+// It panics when an error occurs, see TryAccessAlignedSpace.
+func (l Lease) AccessAlignedSpace(block int64) []byte {
+	return l.sfs.fs.AccessAlignedSpace(block)
+}
+
+// TryAccessAlignedSpace is like AccessAlignedSpace but returns
+// ErrInvalidSpace instead of panicking when the given aligned
+// space is invalid.
+func (l Lease) TryAccessAlignedSpace(block int64) ([]byte, error) {
+	return l.sfs.fs.TryAccessAlignedSpace(block)
+}
+
+// Root returns the space of the root with the given name on the
+// file and whether the root exists, see FileStorage.Root.
+func (l Lease) Root(name string) (int64, bool) {
+	return l.sfs.fs.Root(name)
+}
+
+func (sfs *SyncFileStorage) allocateSpaceFromShard(shardIndex int, spaceSize int) (int64, bool) {
+	sfs.rwMutex.RLock()
+	defer sfs.rwMutex.RUnlock()
+
+	if sfs.fs.options.ReadOnly {
+		return 0, false
+	}
+
+	shardIndex %= sfs.fs.pool.NumberOfShards()
+	shardMutex := &sfs.shardMutexes[shardIndex]
+	shardMutex.Lock()
+	defer shardMutex.Unlock()
+	space, _, ok := sfs.fs.pool.AllocateSpaceFromShard(shardIndex, spaceSize)
+	return space, ok
+}
+
+func (sfs *SyncFileStorage) freeSpaceToShard(space int64) (bool, error) {
+	sfs.rwMutex.RLock()
+	defer sfs.rwMutex.RUnlock()
+
+	if sfs.fs.options.ReadOnly {
+		return false, nil
+	}
+
+	shardIndex := sfs.fs.pool.ShardOf(space)
+
+	if shardIndex < 0 {
+		return false, nil
+	}
+
+	shardMutex := &sfs.shardMutexes[shardIndex]
+	shardMutex.Lock()
+	defer shardMutex.Unlock()
+	ok, err := sfs.fs.pool.FreeSpaceToShard(space)
+	return ok, convertError(err)
+}
+
+// Arena represents an arena of a sync file storage, which allocates
+// small space from a pool shard of its own.
+type Arena struct {
+	sfs        *SyncFileStorage
+	arenaIndex int
+}
+
+// AllocateSpace allocates space with the given size on the file and
+// returns it, see SyncFileStorage.AllocateSpace.
+// It panics when an error occurs, see TryAllocateSpace.
+func (a Arena) AllocateSpace(spaceSize int) int64 {
+	space, err := a.TryAllocateSpace(spaceSize)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return space
+}
+
+// TryAllocateSpace is like AllocateSpace but returns an error instead
+// of panicking, see FileStorage.TryAllocateSpace.
+func (a Arena) TryAllocateSpace(spaceSize int) (int64, error) {
+	sfs := a.sfs
+
+	if space, ok := sfs.allocateSpaceFromShard(a.arenaIndex, spaceSize); ok {
+		return space, nil
+	}
+
+	sfs.rwMutex.Lock()
+	defer sfs.rwMutex.Unlock()
+
+	if sfs.fs.options.ReadOnly {
+		return 0, ErrReadOnly
+	}
+
+	space, _, err := sfs.fs.pool.AllocateSpaceInShard(a.arenaIndex%sfs.fs.pool.NumberOfShards(), spaceSize)
+	return space, convertError(err)
+}
+
+// AllocateSpaces allocates space with each of the given sizes on the file
+// and returns them, see FileStorage.AllocateSpaces. Small space which
+// can't be allocated from the pooled blocks used before is allocated from
+// the pool shard of the arena in preference to the others.
+// It panics when an error occurs, see TryAllocateSpaces.
+func (a Arena) AllocateSpaces(spaceSizes []int) []int64 {
+	spaces, err := a.TryAllocateSpaces(spaceSizes)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return spaces
+}
+
+// TryAllocateSpaces is like AllocateSpaces but returns an error instead
+// of panicking, see FileStorage.TryAllocateSpaces.
+func (a Arena) TryAllocateSpaces(spaceSizes []int) ([]int64, error) {
+	sfs := a.sfs
+	sfs.rwMutex.Lock()
+	defer sfs.rwMutex.Unlock()
+
+	if sfs.fs.options.ReadOnly {
+		return nil, ErrReadOnly
+	}
+
+	spaces, err := sfs.fs.pool.AllocateSpacesInShard(a.arenaIndex%sfs.fs.pool.NumberOfShards(), spaceSizes)
+
+	if err != nil {
+		return nil, convertError(err)
+	}
+
+	return spaces, nil
+}
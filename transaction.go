@@ -0,0 +1,88 @@
+package fsm
+
+import "errors"
+
+// Begin begins a transaction on the file storage. All the changes made
+// after that, including allocations, frees, root settings and
+// writes to accessors, are grouped into one atomic unit which either
+// gets committed by Commit or gets discarded by Rollback.
+// Transactions require the write-ahead log (see OpenOptions.UseWAL).
+// Changes made before calling Begin are committed first.
+func (fs *FileStorage) Begin() error {
+	if fs.options.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if fs.wal == nil {
+		return ErrWALRequired
+	}
+
+	if fs.inTransaction {
+		return ErrTransactionInProgress
+	}
+
+	if err := fs.Sync(); err != nil {
+		return err
+	}
+
+	fs.inTransaction = true
+	return nil
+}
+
+// Commit commits the current transaction to the file durably.
+func (fs *FileStorage) Commit() error {
+	if !fs.inTransaction {
+		return ErrNoTransaction
+	}
+
+	fs.inTransaction = false
+
+	if err := fs.Sync(); err != nil {
+		fs.inTransaction = true
+		return err
+	}
+
+	return nil
+}
+
+// Rollback discards the changes made in the current transaction,
+// restoring both the space and the allocation state as of the
+// beginning of the transaction. Any accessors got in the transaction
+// are *INVALIDATED*.
+func (fs *FileStorage) Rollback() error {
+	if !fs.inTransaction {
+		return ErrNoTransaction
+	}
+
+	if err := fs.spaceMapper.Unmap(); err != nil {
+		return err
+	}
+
+	fs.buddy.Init(&fs.spaceMapper)
+	fs.pool.Init(&fs.buddy)
+	fs.setMinSpaceAlignment()
+
+	if err := fs.loadFile(fs.options.AllowUncleanShutdown); err != nil {
+		return err
+	}
+
+	// the changes discarded are no longer to commit
+	fs.dirtyPages.InvalidateAccessors()
+	fs.dirtyPages.ClearChanged()
+	fs.inTransaction = false
+	return nil
+}
+
+var (
+	// ErrWALRequired is returned when beginning a transaction on a file
+	// storage opened without the write-ahead log.
+	ErrWALRequired = errors.New("fsm: write-ahead log required")
+
+	// ErrTransactionInProgress is returned when beginning a transaction
+	// or syncing while a transaction is in progress.
+	ErrTransactionInProgress = errors.New("fsm: transaction in progress")
+
+	// ErrNoTransaction is returned when committing or rolling back
+	// without a transaction in progress.
+	ErrNoTransaction = errors.New("fsm: no transaction")
+)
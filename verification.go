@@ -0,0 +1,87 @@
+package fsm
+
+import "fmt"
+
+// Verify cross-checks the allocation state of the file storage, including
+// the block allocation bitmap against the free block lists, the chunk lists
+// and the free chunk lists of the pooled blocks, and the stats, returns a
+// report of the violations found.
+func (fs *FileStorage) Verify() VerificationReport {
+	var violations []Violation
+	allocatedSpaceSize, buddyViolations := fs.buddy.Verify()
+
+	for _, description := range buddyViolations {
+		violations = append(violations, Violation{"buddy", description})
+	}
+
+	dismissedSpaceSize, poolViolations := fs.pool.Verify()
+
+	for _, description := range poolViolations {
+		violations = append(violations, Violation{"pool", description})
+	}
+
+	if fs.primarySpace >= 0 {
+		if !fs.spaceIsAllocated(fs.primarySpace) {
+			violations = append(violations, Violation{"primary space", "space not allocated"})
+		}
+	}
+
+	if fs.rootDirectory >= 0 {
+		if _, err := fs.pool.GetSpaceSize(fs.rootDirectory); err != nil {
+			violations = append(violations, Violation{"root directory", "space not allocated"})
+		}
+	}
+
+	for name, space := range fs.roots {
+		if !fs.spaceIsAllocated(space) {
+			violations = append(violations, Violation{"root", fmt.Sprintf("space of root %q not allocated", name)})
+		}
+	}
+
+	return VerificationReport{
+		AllocatedSpaceSize: allocatedSpaceSize,
+		DismissedSpaceSize: dismissedSpaceSize,
+		Violations:         violations,
+	}
+}
+
+// spaceIsAllocated reports whether the given space, or aligned space, is
+// allocated. A space in a pooled block must be a chunk in use, not just
+// in a block allocated.
+func (fs *FileStorage) spaceIsAllocated(space int64) bool {
+	if _, err := fs.pool.GetSpaceSize(space); err == nil {
+		return true
+	}
+
+	_, err := fs.buddy.GetBlockSize(space)
+	return err == nil
+}
+
+// VerificationReport represents the result of verifying a file storage.
+type VerificationReport struct {
+	// AllocatedSpaceSize is the allocated space size recomputed
+	// from the block allocation bitmap.
+	AllocatedSpaceSize int
+
+	// DismissedSpaceSize is the dismissed space size recomputed
+	// from the chunk lists of the pooled blocks.
+	DismissedSpaceSize int
+
+	// Violations are the violations found.
+	Violations []Violation
+}
+
+// OK reports whether no violations were found.
+func (vr VerificationReport) OK() bool {
+	return len(vr.Violations) == 0
+}
+
+// Violation represents an inconsistency found in a file storage.
+type Violation struct {
+	// Component is the component violated, i.e. "buddy", "pool",
+	// "primary space", "root directory" or "root".
+	Component string
+
+	// Description describes the violation.
+	Description string
+}
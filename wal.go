@@ -0,0 +1,227 @@
+package fsm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+const walFileNameSuffix = ".wal"
+
+// wal represents a write-ahead log of page-level redo records.
+//
+// Each record is laid out as | offset (8 bytes) | data size (4 bytes) | data |.
+// A batch of records is terminated by a commit record laid out as
+// | ^0 (8 bytes) | checksum (4 bytes) |, where the checksum is the CRC32C of
+// all the bytes preceding it. A batch without a valid commit record is
+// discarded on replay.
+type wal struct {
+	File   *os.File
+	NoSync bool
+
+	records []walRecord
+}
+
+type walRecord struct {
+	Offset int64
+	Data   []byte
+}
+
+// AddRecord adds a redo record which will write the given data at the
+// given offset on the data file. The data must stay unchanged until
+// Commit returns.
+func (w *wal) AddRecord(offset int64, data []byte) {
+	w.records = append(w.records, walRecord{offset, data})
+}
+
+// Commit durably writes the records added to the log and then
+// applies them to the given data file.
+func (w *wal) Commit(dataFile *os.File) error {
+	defer func() {
+		w.records = w.records[:0]
+	}()
+
+	if _, err := w.File.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(w.File)
+	checksum := uint32(0)
+	buffer := [8 + 4]byte{}
+
+	for _, record := range w.records {
+		binary.BigEndian.PutUint64(buffer[:], uint64(record.Offset))
+		binary.BigEndian.PutUint32(buffer[8:], uint32(len(record.Data)))
+		checksum = crc32.Update(checksum, crc32cTable, buffer[:])
+		checksum = crc32.Update(checksum, crc32cTable, record.Data)
+		writer.Write(buffer[:])
+		writer.Write(record.Data)
+	}
+
+	binary.BigEndian.PutUint64(buffer[:], ^uint64(0))
+	checksum = crc32.Update(checksum, crc32cTable, buffer[:8])
+	binary.BigEndian.PutUint32(buffer[8:], checksum)
+	writer.Write(buffer[:])
+
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+
+	if err := w.sync(w.File); err != nil {
+		return err
+	}
+
+	for _, record := range w.records {
+		if _, err := dataFile.WriteAt(record.Data, record.Offset); err != nil {
+			return err
+		}
+	}
+
+	if err := w.sync(dataFile); err != nil {
+		return err
+	}
+
+	return w.File.Truncate(0)
+}
+
+func (w *wal) sync(file *os.File) error {
+	if w.NoSync {
+		return nil
+	}
+
+	return file.Sync()
+}
+
+// openWALFile opens the write-ahead log file for the given file, the log
+// file is created if required, otherwise only an existing one is opened
+// for replay. A created log file gets the given permission bits.
+func openWALFile(fileName string, createFileIfNotExists bool, fileMode os.FileMode) (*os.File, error) {
+	flags := os.O_RDWR
+
+	if createFileIfNotExists {
+		flags |= os.O_CREATE
+	}
+
+	walFile, err := os.OpenFile(fileName+walFileNameSuffix, flags, fileMode)
+
+	if err != nil {
+		if !createFileIfNotExists && os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return walFile, nil
+}
+
+// replayWAL applies the committed records in the given log to the given
+// data file, and then empties the log.
+func replayWAL(walFile *os.File, dataFile *os.File) error {
+	ok, err := checkWAL(walFile)
+
+	if err != nil {
+		return err
+	}
+
+	if ok {
+		if err := doReplayWAL(walFile, dataFile); err != nil {
+			return err
+		}
+
+		if err := dataFile.Sync(); err != nil {
+			return err
+		}
+	}
+
+	if err := walFile.Truncate(0); err != nil {
+		return err
+	}
+
+	return walFile.Sync()
+}
+
+func checkWAL(walFile *os.File) (bool, error) {
+	if _, err := walFile.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	reader := bufio.NewReader(walFile)
+	checksum := uint32(0)
+	buffer := [8 + 4]byte{}
+	var data []byte
+
+	for {
+		if _, err := io.ReadFull(reader, buffer[:]); err != nil {
+			return false, ignoreEOF(err)
+		}
+
+		if offset := int64(binary.BigEndian.Uint64(buffer[:])); offset == -1 {
+			checksum = crc32.Update(checksum, crc32cTable, buffer[:8])
+			return binary.BigEndian.Uint32(buffer[8:]) == checksum, nil
+		}
+
+		checksum = crc32.Update(checksum, crc32cTable, buffer[:])
+		dataSize := int(binary.BigEndian.Uint32(buffer[8:]))
+
+		if cap(data) < dataSize {
+			data = make([]byte, dataSize)
+		}
+
+		data = data[:dataSize]
+
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return false, ignoreEOF(err)
+		}
+
+		checksum = crc32.Update(checksum, crc32cTable, data)
+	}
+}
+
+func doReplayWAL(walFile *os.File, dataFile *os.File) error {
+	if _, err := walFile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(walFile)
+	buffer := [8 + 4]byte{}
+	var data []byte
+
+	for {
+		if _, err := io.ReadFull(reader, buffer[:]); err != nil {
+			return err
+		}
+
+		offset := int64(binary.BigEndian.Uint64(buffer[:]))
+
+		if offset == -1 {
+			return nil
+		}
+
+		dataSize := int(binary.BigEndian.Uint32(buffer[8:]))
+
+		if cap(data) < dataSize {
+			data = make([]byte, dataSize)
+		}
+
+		data = data[:dataSize]
+
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return err
+		}
+
+		if _, err := dataFile.WriteAt(data, offset); err != nil {
+			return err
+		}
+	}
+}
+
+func ignoreEOF(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil
+	}
+
+	return err
+}